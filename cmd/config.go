@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mdordoy/peloton-to-garmin/config"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+var configInitConfig struct {
+	Force bool
+}
+
+var ConfigCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Manage the peloton-to-garmin configuration file",
+	// The config file is not applied to its own management commands, so a
+	// broken file can still be replaced.
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error { return nil },
+}
+
+var ConfigInitCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Writes a commented configuration file template",
+	Args:  cobra.NoArgs,
+	RunE:  configInitCmd,
+}
+
+func configInitCmd(cmd *cobra.Command, args []string) error {
+	path := rootConfig.ConfigFile
+	if path == "" {
+		var err error
+		path, err = config.DefaultPath()
+		if err != nil {
+			return err
+		}
+	}
+
+	err := config.WriteFile(path, []byte(configTemplate()), configInitConfig.Force)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.OutOrStdout(), "Wrote configuration template to %s\n", path)
+	return nil
+}
+
+// configTemplate builds a commented configuration file listing every flag of
+// the commands that read the configuration file.
+func configTemplate() string {
+	template := strings.Builder{}
+	template.WriteString(`# peloton-to-garmin configuration file.
+#
+# Every setting is named after its command line flag and can also be set with
+# the PTG_* environment variable shown next to it. Command line flags take
+# precedence over environment variables, which take precedence over this file.
+# Uncomment and edit the settings you need.
+`)
+
+	seen := map[string]bool{"help": true, "config": true}
+	for _, cmd := range []*cobra.Command{SyncCmd, WatchCmd} {
+		cmd.Flags().VisitAll(func(flag *pflag.Flag) {
+			if seen[flag.Name] {
+				return
+			}
+			seen[flag.Name] = true
+
+			value := flag.DefValue
+			if flag.Value.Type() == "string" {
+				value = fmt.Sprintf("%q", value)
+			}
+			fmt.Fprintf(&template, "\n# %s (%s)\n#%s: %s\n", flag.Usage, config.EnvName(flag.Name), flag.Name, value)
+		})
+	}
+	return template.String()
+}
+
+func init() {
+	RootCmd.AddCommand(ConfigCmd)
+	ConfigCmd.AddCommand(ConfigInitCmd)
+	ConfigInitCmd.Flags().BoolVar(&configInitConfig.Force, "force", false, "Overwrite an existing configuration file")
+}
@@ -0,0 +1,191 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/mdordoy/peloton-to-garmin/garmin"
+	"github.com/mdordoy/peloton-to-garmin/logger"
+	"github.com/mdordoy/peloton-to-garmin/peloton"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+)
+
+// gearSection is the config file section holding the gear mappings.
+const gearSection = "gear"
+
+// gearDevices are the Peloton device types gear can be mapped from.
+var gearDevices = []string{"Bike", "Bike+", "Tread", "Row"}
+
+// gearMapping links workouts of a discipline, taken on a device type, to
+// Garmin gear. An empty discipline or device matches any.
+type gearMapping struct {
+	Discipline string `yaml:"discipline"`
+	Device     string `yaml:"device"`
+	Gear       string `yaml:"gear"`
+}
+
+// gearMappings are the gear section of the config file, in order. The first
+// mapping matching a workout is used.
+var gearMappings []gearMapping
+
+var gearConfig struct {
+	Output string
+}
+
+var GearCmd = &cobra.Command{
+	Use:   "gear",
+	Short: "Inspect the gear uploaded workouts can be linked to",
+}
+
+var GearListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Lists your Garmin Connect gear and the UUIDs to use in the gear config file section",
+	Args:  cobra.NoArgs,
+	RunE:  gearListCmd,
+}
+
+func gearListCmd(cmd *cobra.Command, args []string) error {
+	if gearConfig.Output != "table" && gearConfig.Output != "json" {
+		return errors.New(fmt.Sprintf("unsupported output format %s, use table or json", gearConfig.Output))
+	}
+	err := resolveSecret(&syncConfig.GarminPassword, syncConfig.GarminPasswordFrom, "garminPassword")
+	if err != nil {
+		return err
+	}
+	if syncConfig.GarminEmail == "" {
+		return errors.New("Garmin email not provided, this is required")
+	}
+	if syncConfig.GarminPassword == "" {
+		return errors.New("Garmin password not provided, this is required")
+	}
+	garminClient := garmin.NewClient(syncConfig.GarminEmail, syncConfig.GarminPassword, syncConfig.GarminSessionCache, logger.NewLogger("warn", true))
+	gear, err := garminClient.Gear()
+	if err != nil {
+		return err
+	}
+
+	if gearConfig.Output == "json" {
+		enc := json.NewEncoder(cmd.OutOrStdout())
+		enc.SetIndent("", "  ")
+		return enc.Encode(gear)
+	}
+	w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "UUID\tTYPE\tSTATUS\tNAME")
+	for _, item := range gear {
+		status := "active"
+		if !item.DateEnd.IsZero() {
+			status = "retired"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", item.Uuid, item.GearTypeName, status, garmin.GearName(item))
+	}
+	return w.Flush()
+}
+
+// parseGearMappings reads and checks the gear section of the config file.
+func parseGearMappings() error {
+	mappings := []gearMapping{}
+	err := configFile.Decode(gearSection, &mappings)
+	if err != nil {
+		return err
+	}
+	for i, mapping := range mappings {
+		if mapping.Gear == "" {
+			return errors.New(fmt.Sprintf("gear: mapping %d has no gear UUID, find it with the gear list command", i+1))
+		}
+		if mapping.Discipline != "" && !garmin.Supported(mapping.Discipline) {
+			return errors.New(fmt.Sprintf("gear: unsupported discipline %s, use one of %s", mapping.Discipline, strings.Join(garmin.SupportedDisciplines(), ", ")))
+		}
+		if mapping.Device != "" {
+			device, ok := gearDevice(mapping.Device)
+			if !ok {
+				return errors.New(fmt.Sprintf("gear: unknown device %s, use one of %s", mapping.Device, strings.Join(gearDevices, ", ")))
+			}
+			mappings[i].Device = device
+		}
+	}
+	gearMappings = mappings
+	return nil
+}
+
+// gearDevice returns the Peloton device type named, ignoring case.
+func gearDevice(name string) (string, bool) {
+	for _, device := range gearDevices {
+		if strings.EqualFold(device, name) {
+			return device, true
+		}
+	}
+	return "", false
+}
+
+// gearFor returns the Garmin gear a workout is mapped to, if any.
+func gearFor(workoutDetail peloton.WorkoutDetail) (string, bool) {
+	for _, mapping := range gearMappings {
+		if mapping.Discipline != "" && mapping.Discipline != workoutDetail.FitnessDiscipline {
+			continue
+		}
+		if mapping.Device != "" && !strings.EqualFold(mapping.Device, workoutDetail.DeviceType) {
+			continue
+		}
+		return mapping.Gear, true
+	}
+	return "", false
+}
+
+// linkGear links an uploaded activity to the gear its workout is mapped to,
+// unlinking any other gear Garmin assigned it by default. Activities of
+// workouts without a mapping are left alone. Gear that cannot be unlinked is
+// only logged.
+func (u *uploader) linkGear(ctx context.Context, activityID int, workoutDetail peloton.WorkoutDetail, rLogger zerolog.Logger) error {
+	uuid, ok := gearFor(workoutDetail)
+	if !ok {
+		return nil
+	}
+	gLogger := rLogger.With().Str("Gear", uuid).Logger()
+	if u.limit.Wait(ctx) != nil {
+		return errors.New("sync was cancelled before gear was linked")
+	}
+	linked, err := u.garminClient.GearForActivity(activityID)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, gear := range linked {
+		if gear.Uuid == uuid {
+			found = true
+			continue
+		}
+		if u.limit.Wait(ctx) != nil {
+			return errors.New("sync was cancelled before gear was linked")
+		}
+		err = u.garminClient.GearUnlink(gear.Uuid, activityID)
+		if err != nil {
+			gLogger.Warn().Err(err).Str("Unlinked Gear", gear.Uuid).Msg("Failed to unlink gear garmin assigned to the workout")
+			continue
+		}
+		gLogger.Info().Str("Unlinked Gear", gear.Uuid).Str("Unlinked Gear Name", garmin.GearName(gear)).Msg("Unlinked gear garmin assigned to the workout")
+	}
+	if found {
+		return nil
+	}
+	if u.limit.Wait(ctx) != nil {
+		return errors.New("sync was cancelled before gear was linked")
+	}
+	err = u.garminClient.GearLink(uuid, activityID)
+	if err != nil {
+		return err
+	}
+	gLogger.Info().Msg("Linked gear to the workout")
+	return nil
+}
+
+func init() {
+	RootCmd.AddCommand(GearCmd)
+	GearCmd.AddCommand(GearListCmd)
+	addGarminFlags(GearListCmd)
+	GearListCmd.Flags().StringVar(&gearConfig.Output, "output", "table", "Format of the gear list: table or json")
+}
@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mdordoy/peloton-to-garmin/garmin"
+	"github.com/mdordoy/peloton-to-garmin/peloton"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var meConfig struct {
+	Output string
+}
+
+var MeCmd = &cobra.Command{
+	Use:   "me",
+	Short: "Prints the Peloton profile, FTP and training zones workouts are measured against",
+	Args:  cobra.NoArgs,
+	RunE:  meCmd,
+}
+
+// profile is the Peloton profile as printed by the me command.
+type profile struct {
+	peloton.User
+	PowerZones     []garmin.Zone `json:"power_zones,omitempty"`
+	HeartRateZones []garmin.Zone `json:"heart_rate_zones,omitempty"`
+}
+
+func meCmd(cmd *cobra.Command, args []string) error {
+	if meConfig.Output != "table" && meConfig.Output != "json" {
+		return errors.New(fmt.Sprintf("unsupported output format %s, use table or json", meConfig.Output))
+	}
+	err := validateLogins(false)
+	if err != nil {
+		return err
+	}
+	peloClient, err := newPelotonClient()
+	if err != nil {
+		return err
+	}
+	user, err := peloClient.GetUser()
+	if err != nil {
+		return err
+	}
+
+	athlete := garmin.NewAthlete(user)
+	p := profile{User: user, PowerZones: athlete.PowerZones(), HeartRateZones: athlete.HeartRateZones()}
+	if meConfig.Output == "json" {
+		enc := json.NewEncoder(cmd.OutOrStdout())
+		enc.SetIndent("", "  ")
+		return enc.Encode(p)
+	}
+	return writeProfile(cmd.OutOrStdout(), p, athlete)
+}
+
+// writeProfile prints the profile as a table.
+func writeProfile(out io.Writer, p profile, athlete *garmin.Athlete) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Username\t%s\n", p.Username)
+	fmt.Fprintf(w, "Name\t%s\n", strings.TrimSpace(p.FirstName+" "+p.LastName))
+	fmt.Fprintf(w, "User ID\t%s\n", p.ID)
+	fmt.Fprintf(w, "Location\t%s\n", p.Location)
+	fmt.Fprintf(w, "Total workouts\t%d\n", p.TotalWorkOuts)
+	if p.LastWorkout > 0 {
+		fmt.Fprintf(w, "Last workout\t%s\n", time.Unix(int64(p.LastWorkout), 0).Format("Mon Jan 2 2006 15:04:05"))
+	}
+	if p.Weight > 0 {
+		fmt.Fprintf(w, "Weight\t%.1f lb\n", p.Weight)
+	}
+	if p.Height > 0 {
+		fmt.Fprintf(w, "Height\t%.0f in\n", p.Height)
+	}
+	fmt.Fprintf(w, "FTP\t%s\n", ftpDescription(p.User))
+	fmt.Fprintf(w, "Max heart rate\t%s\n", maxHeartRateDescription(p.User))
+	writeZones(w, "Power zone", p.PowerZones, "W")
+	writeZones(w, "Heart rate zone", p.HeartRateZones, "bpm")
+	if athlete.FTP <= 0 {
+		fmt.Fprintln(w, "\nTake an FTP test on Peloton to add power zones and training load to rides.")
+	}
+	return w.Flush()
+}
+
+func ftpDescription(user peloton.User) string {
+	switch {
+	case user.Ftp > 0:
+		return fmt.Sprintf("%d W", user.Ftp)
+	case user.EstimatedFtp > 0:
+		return fmt.Sprintf("%d W (estimated)", user.EstimatedFtp)
+	}
+	return "not set"
+}
+
+func maxHeartRateDescription(user peloton.User) string {
+	switch {
+	case user.CustomMaxHr > 0:
+		return fmt.Sprintf("%d bpm", user.CustomMaxHr)
+	case user.DefaultMaxHr > 0:
+		return fmt.Sprintf("%d bpm (from age)", user.DefaultMaxHr)
+	}
+	return "not set"
+}
+
+func writeZones(w io.Writer, label string, zones []garmin.Zone, unit string) {
+	for _, zone := range zones {
+		if zone.Max == 0 {
+			fmt.Fprintf(w, "%s %d\t%d+ %s\n", label, zone.Zone, zone.Min, unit)
+			continue
+		}
+		fmt.Fprintf(w, "%s %d\t%d-%d %s\n", label, zone.Zone, zone.Min, zone.Max-1, unit)
+	}
+}
+
+func init() {
+	RootCmd.AddCommand(MeCmd)
+	addPelotonFlags(MeCmd)
+	MeCmd.Flags().StringVar(&meConfig.Output, "output", "table", "Format of the profile: table or json")
+}
@@ -0,0 +1,147 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	connect "github.com/abrander/garmin-connect"
+	"github.com/mdordoy/peloton-to-garmin/garmin"
+	"github.com/mdordoy/peloton-to-garmin/peloton"
+	"github.com/mdordoy/peloton-to-garmin/state"
+	"github.com/pkg/errors"
+)
+
+// Overlap policies, deciding what happens to a workout that was also recorded
+// by a Garmin device.
+const (
+	overlapSkip    = "skip"
+	overlapUpload  = "upload"
+	overlapReplace = "replace"
+	overlapMerge   = "merge"
+)
+
+// overlapLookback is how long before the earliest workout Garmin activities
+// are listed, so activities started well before a workout are still found.
+const overlapLookback = 12 * time.Hour
+
+// overlapChecker finds Garmin activities, usually recorded by a watch, that
+// cover the same time as a workout. Garmin is listed once per run.
+type overlapChecker struct {
+	activities []connect.Activity
+	// uploaded holds the activities this tool created, which always overlap
+	// the workout they were created from.
+	uploaded  map[int]bool
+	threshold float64
+}
+
+// newOverlapChecker lists the Garmin activities around the workouts that
+// still need syncing. It returns nil when there is nothing to check.
+func newOverlapChecker(ctx context.Context, garminClient garminAPI, store *state.Store, limit *rateLimiter, workouts []peloton.WorkoutData) (*overlapChecker, error) {
+	since := time.Time{}
+	for _, workout := range workouts {
+		if _, ok := synced(store, workout.ID); ok || !garmin.Supported(workout.FitnessDiscipline) {
+			continue
+		}
+		start := time.Unix(int64(workout.StartTime), 0)
+		if since.IsZero() || start.Before(since) {
+			since = start
+		}
+	}
+	if since.IsZero() {
+		return nil, nil
+	}
+	if err := limit.Wait(ctx); err != nil {
+		return nil, err
+	}
+	activities, err := garminClient.ActivitiesSince(since.Add(-overlapLookback))
+	if err != nil {
+		return nil, err
+	}
+	checker := &overlapChecker{
+		activities: activities,
+		uploaded:   map[int]bool{},
+		threshold:  syncConfig.OverlapThreshold / 100,
+	}
+	for _, entry := range store.List() {
+		if entry.GarminActivityID != 0 {
+			checker.uploaded[entry.GarminActivityID] = true
+		}
+	}
+	return checker, nil
+}
+
+// find returns the Garmin activity covering the largest part of a workout,
+// when it covers at least the overlap threshold. Activities named after the
+// class or given the activity name were uploaded by an earlier sync and are
+// ignored.
+func (c *overlapChecker) find(workoutDetail peloton.WorkoutDetail, name string) (connect.Activity, float64, bool) {
+	best, bestFraction := connect.Activity{}, 0.0
+	if c == nil {
+		return best, 0, false
+	}
+	for _, activity := range c.activities {
+		if c.uploaded[activity.ID] || strings.EqualFold(activity.ActivityName, workoutDetail.Title) || strings.EqualFold(activity.ActivityName, name) {
+			continue
+		}
+		fraction := garmin.Overlap(activity, workoutDetail.StartTime, workoutDetail.EndTime)
+		if fraction > bestFraction {
+			best, bestFraction = activity, fraction
+		}
+	}
+	if bestFraction == 0 || bestFraction < c.threshold {
+		return connect.Activity{}, bestFraction, false
+	}
+	return best, bestFraction, true
+}
+
+// validateOverlapConfig checks the overlap flags.
+func validateOverlapConfig() error {
+	switch syncConfig.OverlapPolicy {
+	case overlapSkip, overlapUpload, overlapReplace, overlapMerge:
+	default:
+		return errors.New(fmt.Sprintf("unsupported overlap policy %s, use skip, upload, replace or merge", syncConfig.OverlapPolicy))
+	}
+	if syncConfig.OverlapThreshold <= 0 || syncConfig.OverlapThreshold > 100 {
+		return errors.New("overlap-threshold must be a percentage above 0 and at most 100")
+	}
+	if syncConfig.MergeDelete && syncConfig.OverlapPolicy != overlapMerge {
+		return errors.New("merge-delete only applies to --overlap-policy merge")
+	}
+	return nil
+}
+
+// mergeHeartRate downloads the Garmin activity a workout overlaps and
+// converts the workout again with the heart rate it recorded. An activity
+// without heart rate leaves the workout as it was.
+func (u *uploader) mergeHeartRate(ctx context.Context, job *syncJob, activity connect.Activity) error {
+	if err := u.limit.Wait(ctx); err != nil {
+		return err
+	}
+	export := bytes.Buffer{}
+	err := u.garminClient.ExportActivity(activity.ID, &export, u.opts.Format)
+	if err != nil {
+		return errors.Wrapf(err, "failed to download garmin activity %d", activity.ID)
+	}
+	heartRate, err := garmin.ReadHeartRate(export.Bytes(), u.opts.Format)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read heart rate from garmin activity %d", activity.ID)
+	}
+	if len(heartRate) == 0 {
+		job.logger.Warn().Int("Garmin Activity ID", activity.ID).Msg("Overlapping garmin activity has no heart rate, uploading the peloton heart rate")
+		return nil
+	}
+	opts := job.opts
+	opts.HeartRate = heartRate
+	buf, data, err := garmin.ConvertWorkout(job.detail, opts)
+	if err != nil {
+		return errors.Wrap(err, "failed to convert peloton data with the merged heart rate")
+	}
+	job.file = buf.Bytes()
+	job.opts = opts
+	job.data = data
+	job.setName()
+	return nil
+}
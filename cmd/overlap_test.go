@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	connect "github.com/abrander/garmin-connect"
+	"github.com/mdordoy/peloton-to-garmin/garmin"
+	"github.com/mdordoy/peloton-to-garmin/peloton"
+)
+
+// watchActivity returns an activity a watch recorded from offset after
+// testStart, lasting minutes.
+func watchActivity(id int, name string, offset time.Duration, minutes int) connect.Activity {
+	activity := testActivity(id, name, offset)
+	activity.ElapsedDuration = float64(minutes * 60)
+	return activity
+}
+
+func TestOverlapCheckerFind(t *testing.T) {
+	keepSyncConfig(t)
+	tests := []struct {
+		name       string
+		threshold  float64
+		activities []connect.Activity
+		uploads    map[string]int
+		want       int
+	}{
+		{"below threshold", 50, []connect.Activity{watchActivity(1, "Cycling", 0, 8)}, nil, 0},
+		{"lower threshold", 30, []connect.Activity{watchActivity(1, "Cycling", 0, 8)}, nil, 1},
+		{"largest overlap", 30, []connect.Activity{watchActivity(1, "Cycling", 0, 8), watchActivity(2, "Cycling", 5*time.Minute, 30)}, nil, 2},
+		{"whole workout at 100", 100, []connect.Activity{watchActivity(1, "Cycling", -time.Minute, 30)}, nil, 1},
+		{"partly at 100", 100, []connect.Activity{watchActivity(1, "Cycling", time.Minute, 30)}, nil, 0},
+		{"started before the workout", 50, []connect.Activity{watchActivity(1, "Cycling", -10*time.Hour, 610)}, nil, 1},
+		{"recorded upload", 50, []connect.Activity{watchActivity(1, "Cycling", 0, 20)}, map[string]int{"other": 1}, 0},
+		{"named after the class", 50, []connect.Activity{watchActivity(1, "20 MIN RIDE", 0, 20)}, nil, 0},
+		{"given the activity name", 50, []connect.Activity{watchActivity(1, "Morning Ride", 0, 20)}, nil, 0},
+	}
+	for _, test := range tests {
+		syncConfig.OverlapThreshold = test.threshold
+		client := newFakeGarmin(test.activities...)
+		u := testUploader(t, client, testStore(t, test.uploads))
+		activity, _, ok := u.overlaps.find(testDetail("w", 120), "Morning Ride")
+		if ok != (test.want != 0) || activity.ID != test.want {
+			t.Errorf("%s: found activity %d, %v, want %d", test.name, activity.ID, ok, test.want)
+		}
+	}
+
+	// Nothing is checked once every workout has been synced.
+	checker, err := newOverlapChecker(context.Background(), newFakeGarmin(watchActivity(1, "Cycling", 0, 20)), testStore(t, map[string]int{"w": 2}), newRateLimiter(0), []peloton.WorkoutData{testWorkout("w", 0)})
+	if err != nil || checker != nil {
+		t.Fatalf("checker of synced workouts %v, %v, want none", checker, err)
+	}
+	if _, _, ok := checker.find(testDetail("w", 120), ""); ok {
+		t.Errorf("a nil checker found an overlap")
+	}
+}
+
+func TestUploadOverlapPolicy(t *testing.T) {
+	keepSyncConfig(t)
+	// The watch recorded a higher heart rate than Peloton.
+	watch, err := garmin.ConvertPelotonWorkout(testDetail("watch", 160), garmin.ConvertOptions{Format: connect.ActivityFormatFIT, Laps: garmin.LapsSingle, Location: time.UTC})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		policy      string
+		mergeDelete bool
+		threshold   float64
+		outcome     syncOutcome
+		uploads     int
+		deleted     []int
+		heartRate   int
+	}{
+		{overlapSkip, false, 50, outcomeOverlapping, 0, nil, 0},
+		{overlapUpload, false, 50, outcomeUploaded, 1, nil, 0},
+		{overlapReplace, false, 50, outcomeUploaded, 1, []int{1}, 0},
+		{overlapMerge, false, 50, outcomeUploaded, 1, nil, 160},
+		{overlapMerge, true, 50, outcomeUploaded, 1, []int{1}, 160},
+		// The watch covers 75% of the workout, below the threshold every
+		// policy uploads the workout alone.
+		{overlapSkip, false, 80, outcomeUploaded, 1, nil, 0},
+		{overlapReplace, false, 80, outcomeUploaded, 1, nil, 0},
+	}
+	for _, test := range tests {
+		syncConfig.OverlapPolicy = test.policy
+		syncConfig.MergeDelete = test.mergeDelete
+		syncConfig.OverlapThreshold = test.threshold
+		name := test.policy
+		if test.mergeDelete {
+			name += " with delete"
+		}
+		if test.threshold != 50 {
+			name += " below the threshold"
+		}
+
+		client := newFakeGarmin(watchActivity(1, "Indoor Cycling", 5*time.Minute, 30))
+		client.export = watch.Bytes()
+		store := testStore(t, nil)
+		job := testJob(t, testDetail("w", 120))
+		testUploader(t, client, store).upload(context.Background(), job)
+
+		if job.outcome != test.outcome || client.uploads != test.uploads {
+			t.Errorf("%s: outcome %d after %d uploads, want %d after %d", name, job.outcome, client.uploads, test.outcome, test.uploads)
+		}
+		if !reflect.DeepEqual(client.deleted, test.deleted) || job.replaced != (test.deleted != nil) {
+			t.Errorf("%s: deleted %v, replaced %v, want %v deleted", name, client.deleted, job.replaced, test.deleted)
+		}
+		entry, recorded := store.Get("w")
+		if recorded != (test.uploads > 0) || (recorded && entry.GarminActivityID != 101) {
+			t.Errorf("%s: sync state %+v, %v, want the upload recorded", name, entry, recorded)
+		}
+		merged := 0
+		if len(job.opts.HeartRate) > 0 {
+			merged = job.opts.HeartRate[0].HeartRate
+		}
+		if merged != test.heartRate {
+			t.Errorf("%s: merged heart rate %d, want %d", name, merged, test.heartRate)
+		}
+	}
+}
@@ -0,0 +1,603 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	connect "github.com/abrander/garmin-connect"
+	"github.com/mdordoy/peloton-to-garmin/garmin"
+	"github.com/mdordoy/peloton-to-garmin/logger"
+	"github.com/mdordoy/peloton-to-garmin/peloton"
+	"github.com/mdordoy/peloton-to-garmin/state"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// syncSummary counts the outcome of each workout in a sync run.
+type syncSummary struct {
+	Uploaded    int
+	Skipped     int
+	Unsupported int
+	Failed      int
+	Cancelled   int
+	Planned     int
+	// Overlapping counts workouts skipped because a Garmin device recorded
+	// them, Replaced the device activities replaced by an upload.
+	Overlapping int
+	Replaced    int
+	// Resynced counts workouts uploaded again by --replace.
+	Resynced int
+	// RunID is recorded with every workout uploaded by the run, so unsync
+	// can undo it.
+	RunID string
+}
+
+type syncOutcome int
+
+const (
+	outcomeUploaded syncOutcome = iota
+	outcomeSkipped
+	outcomeUnsupported
+	outcomeFailed
+	outcomeCancelled
+	// outcomePlanned marks a workout a dry run would upload.
+	outcomePlanned
+	// outcomeOverlapping marks a workout skipped because it overlaps an
+	// activity already in Garmin.
+	outcomeOverlapping
+	// outcomeResynced marks a workout that replaced the activity an earlier
+	// sync uploaded it as.
+	outcomeResynced
+)
+
+// syncJob carries one workout through the pipeline. Only one stage holds a job
+// at a time, so it needs no locking.
+type syncJob struct {
+	index   int
+	workout peloton.WorkoutData
+	detail  peloton.WorkoutDetail
+	file    []byte
+	// opts is how the workout was converted, including any heart rate
+	// merged into it.
+	opts garmin.ConvertOptions
+	// data is the template data of the converted workout.
+	data garmin.TemplateData
+	// name is the Garmin activity name rendered for the converted workout.
+	name    string
+	outcome syncOutcome
+	// reason explains why a workout was not uploaded.
+	reason string
+	// replaced is set once the Garmin activity the workout overlapped has
+	// been deleted.
+	replaced bool
+	// logger writes to logs, which are written out once every earlier
+	// workout has finished so the output reads in workout order.
+	logger zerolog.Logger
+	logs   *logBuffer
+}
+
+// setName renders the activity name of a job's converted workout, so it is
+// rendered once rather than every time it is looked up.
+func (job *syncJob) setName() {
+	var err error
+	job.name, err = activityName(job.data)
+	if err != nil {
+		job.logger.Warn().Err(err).Msg("Failed to render the activity name, using the class title")
+	}
+}
+
+// logBuffer holds the log events of a single job.
+type logBuffer struct {
+	events [][]byte
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.events = append(b.events, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func (b *logBuffer) flush(out io.Writer) {
+	for _, event := range b.events {
+		_, _ = out.Write(event)
+	}
+}
+
+// rateLimiter spaces out requests to a host so no more than perSecond are
+// started each second. A zero rate does not limit.
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(perSecond float64) *rateLimiter {
+	limiter := &rateLimiter{}
+	if perSecond > 0 {
+		limiter.interval = time.Duration(float64(time.Second) / perSecond)
+	}
+	return limiter
+}
+
+// Wait blocks until the next request may start or ctx is cancelled.
+func (r *rateLimiter) Wait(ctx context.Context) error {
+	if r.interval == 0 {
+		return ctx.Err()
+	}
+	r.mu.Lock()
+	now := time.Now()
+	if r.next.Before(now) {
+		r.next = now
+	}
+	wait := r.next.Sub(now)
+	r.next = r.next.Add(r.interval)
+	r.mu.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// stageFunc is the last stage of the pipeline, run for every workout that
+// was downloaded and converted. It must set the job outcome.
+type stageFunc func(ctx context.Context, job *syncJob)
+
+// syncWorkouts downloads, converts and uploads every workout that is not yet
+// recorded in the sync state, or every workout with --replace. Garmin is first
+// checked for activities overlapping the workouts, and a run that cannot check
+// fails unless the overlap policy uploads regardless and nothing is replaced.
+func syncWorkouts(ctx context.Context, logger zerolog.Logger, peloClient *peloton.Client, garminClient *garmin.Client, store *state.Store, opts garmin.ConvertOptions, workouts []peloton.WorkoutData) (syncSummary, error) {
+	if syncConfig.Replace {
+		opts.Created = time.Now()
+	}
+	u := &uploader{
+		garminClient: garminClient,
+		store:        store,
+		limit:        newRateLimiter(syncConfig.GarminRate),
+		opts:         opts,
+		runID:        state.NewRunID(time.Now()),
+	}
+	overlaps, err := newOverlapChecker(ctx, garminClient, store, u.limit, workouts)
+	if err != nil {
+		if ctx.Err() != nil {
+			return syncSummary{Cancelled: len(workouts)}, nil
+		}
+		if syncConfig.Replace {
+			return syncSummary{}, errors.Wrap(err, "failed to list the garmin activities to replace")
+		}
+		if syncConfig.OverlapPolicy != overlapUpload {
+			return syncSummary{}, errors.Wrap(err, "failed to check garmin for overlapping activities")
+		}
+		logger.Warn().Err(err).Msg("Failed to check garmin for overlapping activities, uploading without checking")
+	}
+	u.overlaps = overlaps
+
+	jobs := runPipeline(ctx, logger, peloClient, store, opts, workouts, u.upload)
+	summary := summarise(jobs)
+	summary.RunID = u.runID
+	return summary, nil
+}
+
+// runPipeline passes workouts through a pool of --fetch-workers, which
+// download and convert them, feeding a pool of --upload-workers running the
+// final stage. Peloton requests are rate limited. A failing workout does not
+// hold up the others, and once ctx is cancelled the remaining workouts are
+// left for the next run. The finished jobs are returned in workout order.
+func runPipeline(ctx context.Context, logger zerolog.Logger, peloClient *peloton.Client, store *state.Store, opts garmin.ConvertOptions, workouts []peloton.WorkoutData, final stageFunc) []*syncJob {
+	fetchQueue := make(chan *syncJob)
+	uploadQueue := make(chan *syncJob)
+	done := make(chan *syncJob)
+	pelotonLimit := newRateLimiter(syncConfig.PelotonRate)
+	opts.Athlete = loadAthlete(ctx, logger, peloClient, pelotonLimit, store, workouts)
+
+	go func() {
+		defer close(fetchQueue)
+		for i, workout := range workouts {
+			logs := &logBuffer{}
+			job := &syncJob{index: i, workout: workout, logger: logger.Output(logs), logs: logs}
+			if entry, ok := synced(store, workout.ID); ok {
+				job.logger.Info().Str("Title", entry.Title).Str("Workout ID", workout.ID).Int("Garmin Activity ID", entry.GarminActivityID).Msg("Workout already synced, skipping")
+				job.outcome = outcomeSkipped
+				job.reason = "already synced"
+				done <- job
+				continue
+			}
+			fetchQueue <- job
+		}
+	}()
+
+	fetchers := sync.WaitGroup{}
+	for i := 0; i < syncConfig.FetchWorkers; i++ {
+		fetchers.Add(1)
+		go func() {
+			defer fetchers.Done()
+			for job := range fetchQueue {
+				if fetchWorkout(ctx, job, peloClient, pelotonLimit, opts) {
+					uploadQueue <- job
+					continue
+				}
+				done <- job
+			}
+		}()
+	}
+	go func() {
+		fetchers.Wait()
+		close(uploadQueue)
+	}()
+
+	for i := 0; i < syncConfig.UploadWorkers; i++ {
+		go func() {
+			for job := range uploadQueue {
+				final(ctx, job)
+				done <- job
+			}
+		}()
+	}
+
+	return collectJobs(done, len(workouts))
+}
+
+// synced returns the sync state of a workout that is left alone because it
+// has already been synced, which with --replace is none.
+func synced(store *state.Store, workoutID string) (state.Entry, bool) {
+	entry, ok := store.Get(workoutID)
+	return entry, ok && !syncConfig.Replace
+}
+
+// loadAthlete downloads the Peloton profile training load and zones are
+// measured against, when any workout still needs converting. Workouts are
+// converted without them when the profile cannot be downloaded.
+func loadAthlete(ctx context.Context, logger zerolog.Logger, peloClient *peloton.Client, limit *rateLimiter, store *state.Store, workouts []peloton.WorkoutData) *garmin.Athlete {
+	pending := false
+	for _, workout := range workouts {
+		if _, ok := synced(store, workout.ID); !ok && garmin.Supported(workout.FitnessDiscipline) {
+			pending = true
+			break
+		}
+	}
+	if !pending || limit.Wait(ctx) != nil {
+		return nil
+	}
+	user, err := peloClient.GetUser()
+	if err != nil {
+		logger.Warn().Err(err).Msg("Failed to get the peloton profile, converting workouts without training load or zones")
+		return nil
+	}
+	return garmin.NewAthlete(user)
+}
+
+// collectJobs receives every finished job, writing out their logs in workout
+// order.
+func collectJobs(done <-chan *syncJob, count int) []*syncJob {
+	out := logOutput()
+	jobs := make([]*syncJob, 0, count)
+	pending := map[int]*syncJob{}
+	for received := 0; received < count; received++ {
+		job := <-done
+		pending[job.index] = job
+		for pending[len(jobs)] != nil {
+			job := pending[len(jobs)]
+			job.logs.flush(out)
+			delete(pending, len(jobs))
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs
+}
+
+// summarise counts the outcome of every job.
+func summarise(jobs []*syncJob) syncSummary {
+	summary := syncSummary{}
+	for _, job := range jobs {
+		switch job.outcome {
+		case outcomeUploaded:
+			summary.Uploaded++
+		case outcomeSkipped:
+			summary.Skipped++
+		case outcomeUnsupported:
+			summary.Unsupported++
+		case outcomeFailed:
+			summary.Failed++
+		case outcomeCancelled:
+			summary.Cancelled++
+		case outcomePlanned:
+			summary.Planned++
+		case outcomeOverlapping:
+			summary.Overlapping++
+		case outcomeResynced:
+			summary.Resynced++
+		}
+		if job.replaced {
+			summary.Replaced++
+		}
+	}
+	return summary
+}
+
+// logOutput returns the writer buffered job logs are written out to.
+func logOutput() io.Writer {
+	return logger.Writer(syncLogDestination(), syncConfig.PrettyLog)
+}
+
+// fetchWorkout downloads and converts a workout, reporting whether it is
+// ready to upload.
+func fetchWorkout(ctx context.Context, job *syncJob, peloClient *peloton.Client, limit *rateLimiter, opts garmin.ConvertOptions) bool {
+	if !garmin.Supported(job.workout.FitnessDiscipline) {
+		job.logger.Info().Str("Title", job.workout.Peloton.Ride.Title).Str("Workout ID", job.workout.ID).Str("Discipline", job.workout.FitnessDiscipline).Msg("Unsupported discipline, skipping")
+		job.outcome = outcomeUnsupported
+		job.reason = "unsupported discipline " + job.workout.FitnessDiscipline
+		return false
+	}
+	if limit.Wait(ctx) != nil {
+		job.outcome = outcomeCancelled
+		return false
+	}
+	workoutDetail, err := peloClient.GetWorkoutDetails(job.workout, syncConfig.DataGranularity)
+	if err != nil {
+		job.logger.Error().Err(err).Msgf("Failed to get workout with ID %s, skipping", job.workout.ID)
+		job.outcome = outcomeFailed
+		job.reason = err.Error()
+		return false
+	}
+	job.logger.Info().Str("Title", workoutDetail.Title).Str("Workout ID", workoutDetail.ID).Str("Workout Date", workoutDetail.StartTime.Format("Mon Jan 2 2006 15:04:05")).Msg("Found Peloton Workout")
+
+	buf, data, err := garmin.ConvertWorkout(workoutDetail, opts)
+	if err != nil {
+		job.logger.Error().Err(err).Str("Title", workoutDetail.Title).Str("Workout ID", workoutDetail.ID).Msg("Failed to convert peloton data to garmin data")
+		job.outcome = outcomeFailed
+		job.reason = err.Error()
+		return false
+	}
+	job.detail = workoutDetail
+	job.file = buf.Bytes()
+	job.opts = opts
+	job.data = data
+
+	// The playlist is a separate request, so it is only fetched when a
+	// template lists the music.
+	if templatesUseMusic {
+		if limit.Wait(ctx) != nil {
+			job.outcome = outcomeCancelled
+			return false
+		}
+		job.detail.Music, err = peloClient.GetPlaylist(workoutDetail.RideID)
+		if err != nil {
+			job.logger.Warn().Err(err).Str("Workout ID", workoutDetail.ID).Msg("Failed to get the class playlist")
+		}
+		job.data.Music = job.detail.Music
+	}
+	job.setName()
+	return true
+}
+
+// garminAPI is the part of the Garmin client the upload stage uses, so tests
+// can stand in for Garmin Connect.
+type garminAPI interface {
+	ActivitiesSince(since time.Time) ([]connect.Activity, error)
+	Upload(file []byte, format connect.ActivityFormat) (garmin.UploadResult, error)
+	UploadStatus(pending garmin.UploadResult) (garmin.UploadResult, error)
+	ActivityType(key string) (connect.ActivityType, error)
+	UpdateActivity(activityID int, update garmin.ActivityUpdate) error
+	ExportActivity(activityID int, w io.Writer, format connect.ActivityFormat) error
+	ActivityExists(activityID int) (bool, error)
+	DeleteActivity(activityID int) error
+	GearForActivity(activityID int) ([]connect.Gear, error)
+	GearLink(uuid string, activityID int) error
+	GearUnlink(uuid string, activityID int) error
+}
+
+// uploader is the final stage of a sync, uploading workouts to Garmin.
+type uploader struct {
+	garminClient garminAPI
+	store        *state.Store
+	limit        *rateLimiter
+	opts         garmin.ConvertOptions
+	overlaps     *overlapChecker
+	runID        string
+}
+
+// upload uploads a converted workout, records it in the sync state, names the
+// Garmin activity after the Peloton class and links it to the mapped gear.
+// Workouts overlapping an activity already in Garmin are handled by the
+// --overlap-policy, and with --replace the activity an earlier sync uploaded
+// is replaced.
+func (u *uploader) upload(ctx context.Context, job *syncJob) {
+	workoutDetail := job.detail
+	rLogger := job.logger.With().Str("Title", workoutDetail.Title).Str("Workout ID", workoutDetail.ID).Str("Workout Date", workoutDetail.StartTime.Format("Mon Jan 2 2006 15:04:05")).Logger()
+
+	previous, replacing := u.uploadedAs(workoutDetail, job.name)
+	overlap, fraction, overlaps := u.overlaps.find(workoutDetail, job.name)
+	if overlaps {
+		oLogger := rLogger.With().Int("Garmin Activity ID", overlap.ID).Str("Garmin Activity", overlap.ActivityName).Str("Overlap", fmt.Sprintf("%.0f%%", fraction*100)).Str("Policy", syncConfig.OverlapPolicy).Logger()
+		switch syncConfig.OverlapPolicy {
+		case overlapSkip:
+			oLogger.Info().Msg("Workout overlaps a garmin activity, skipping")
+			job.outcome = outcomeOverlapping
+			job.reason = fmt.Sprintf("overlaps garmin activity %d", overlap.ID)
+			return
+		case overlapReplace:
+			oLogger.Info().Msg("Workout overlaps a garmin activity, replacing it")
+		case overlapMerge:
+			oLogger.Info().Msg("Workout overlaps a garmin activity, merging its heart rate")
+			err := u.mergeHeartRate(ctx, job, overlap)
+			if ctx.Err() != nil {
+				job.outcome = outcomeCancelled
+				return
+			}
+			if err != nil {
+				oLogger.Error().Err(err).Msg("Failed to merge heart rate from the garmin activity")
+				job.outcome = outcomeFailed
+				job.reason = err.Error()
+				return
+			}
+		default:
+			oLogger.Info().Msg("Workout overlaps a garmin activity, uploading anyway")
+		}
+	}
+
+	if u.limit.Wait(ctx) != nil {
+		job.outcome = outcomeCancelled
+		return
+	}
+	result, err := u.garminClient.Upload(job.file, u.opts.Format)
+	if err != nil {
+		rLogger.Error().Err(err).Msg("Failed to upload activity to garmin")
+		job.outcome = outcomeFailed
+		job.reason = err.Error()
+		return
+	}
+	if result.Status == garmin.UploadPending {
+		rLogger.Debug().Int("Upload ID", result.UploadID).Msg("Garmin is processing the upload")
+		result = u.waitForUpload(ctx, result, rLogger)
+	}
+
+	entry := state.Entry{
+		WorkoutID:        workoutDetail.ID,
+		Title:            workoutDetail.Title,
+		WorkoutStart:     workoutDetail.StartTime,
+		GarminActivityID: result.ActivityID,
+		UploadedAt:       time.Now(),
+		ContentHash:      state.Hash(job.file),
+		Format:           u.opts.Format.Extension(),
+		RunID:            u.runID,
+	}
+	if replacing {
+		if u.resync(ctx, job, result, previous, entry, rLogger) && overlaps && u.deletesOverlap() {
+			u.replace(ctx, job, overlap, rLogger.With().Int("Garmin Activity ID", result.ActivityID).Logger())
+		}
+		return
+	}
+	switch result.Status {
+	case garmin.UploadDuplicate:
+		rLogger.Info().Int("Garmin Activity ID", result.ActivityID).Msg("Workout already uploaded to garmin")
+		recordSyncState(u.store, entry, rLogger)
+		job.outcome = outcomeSkipped
+		job.reason = "duplicate"
+		return
+	case garmin.UploadFailed:
+		rLogger.Error().Str("Reason", result.Message).Msg("Garmin rejected the activity")
+		job.outcome = outcomeFailed
+		job.reason = result.Message
+		return
+	case garmin.UploadPending:
+		// The activity ID is not known yet, so the workout is left out of the
+		// state. The next sync uploads it again and Garmin reports the
+		// activity it became as a duplicate.
+		rLogger.Warn().Int("Upload ID", result.UploadID).Msg("Workout uploaded but garmin is still processing it, it is checked again on the next sync")
+		job.outcome = outcomeSkipped
+		job.reason = "garmin is still processing the upload"
+		return
+	}
+	recordSyncState(u.store, entry, rLogger)
+	job.outcome = outcomeUploaded
+	rLogger = rLogger.With().Int("Garmin Activity ID", result.ActivityID).Logger()
+	if overlaps && u.deletesOverlap() {
+		u.replace(ctx, job, overlap, rLogger)
+	}
+
+	err = u.updateActivity(ctx, result.ActivityID, job, rLogger)
+	if err != nil {
+		rLogger.Warn().Err(err).Msg("Workout uploaded but failed to update the garmin activity")
+	}
+	err = u.linkGear(ctx, result.ActivityID, workoutDetail, rLogger)
+	if err != nil {
+		rLogger.Warn().Err(err).Msg("Workout uploaded but failed to link gear")
+	}
+}
+
+// updateActivity names the Garmin activity with the name template, describes
+// it with the description template and sets its activity type. A detail that
+// cannot be worked out is left out rather than failing the update.
+func (u *uploader) updateActivity(ctx context.Context, activityID int, job *syncJob, rLogger zerolog.Logger) error {
+	workoutDetail := job.detail
+	update := garmin.ActivityUpdate{Name: job.name}
+	if descriptionTemplate != nil {
+		description, err := garmin.RenderTemplate(descriptionTemplate, job.data)
+		if err != nil {
+			rLogger.Warn().Err(err).Msg("Failed to render the activity description")
+		}
+		update.Description = description
+	}
+	if key := garmin.ActivityTypeKey(workoutDetail.FitnessDiscipline); key != "" {
+		if u.limit.Wait(ctx) != nil {
+			return errors.New("sync was cancelled before the garmin activity was updated")
+		}
+		activityType, err := u.garminClient.ActivityType(key)
+		if err != nil {
+			rLogger.Warn().Err(err).Msg("Failed to find the garmin activity type")
+		} else {
+			update.Type = &activityType
+		}
+	}
+
+	if u.limit.Wait(ctx) != nil {
+		return errors.New("sync was cancelled before the garmin activity was updated")
+	}
+	err := u.garminClient.UpdateActivity(activityID, update)
+	if err != nil {
+		return err
+	}
+	rLogger.Info().Msgf("Workout uploaded and renamed to %s", job.name)
+	return nil
+}
+
+// Pending uploads are polled every uploadPollInterval until Garmin has
+// processed them or uploadPollTimeout passes.
+const (
+	uploadPollInterval = 2 * time.Second
+	uploadPollTimeout  = 2 * time.Minute
+)
+
+// waitForUpload polls a pending upload until Garmin has processed it. The
+// upload is returned still pending when polling fails, times out or the sync
+// is cancelled.
+func (u *uploader) waitForUpload(ctx context.Context, result garmin.UploadResult, rLogger zerolog.Logger) garmin.UploadResult {
+	deadline := time.Now().Add(uploadPollTimeout)
+	for result.Status == garmin.UploadPending && time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return result
+		case <-time.After(uploadPollInterval):
+		}
+		if u.limit.Wait(ctx) != nil {
+			return result
+		}
+		polled, err := u.garminClient.UploadStatus(result)
+		if err != nil {
+			rLogger.Warn().Err(err).Msg("Failed to check on the garmin upload")
+			return result
+		}
+		result = polled
+	}
+	return result
+}
+
+// deletesOverlap reports whether the Garmin activity a workout overlaps is
+// deleted once the workout is uploaded.
+func (u *uploader) deletesOverlap() bool {
+	return syncConfig.OverlapPolicy == overlapReplace || (syncConfig.OverlapPolicy == overlapMerge && syncConfig.MergeDelete)
+}
+
+// replace deletes the Garmin activity a workout overlapped, once the workout
+// has been uploaded in its place.
+func (u *uploader) replace(ctx context.Context, job *syncJob, activity connect.Activity, rLogger zerolog.Logger) {
+	aLogger := rLogger.With().Int("Garmin Activity ID", activity.ID).Str("Garmin Activity", activity.ActivityName).Logger()
+	if u.limit.Wait(ctx) != nil {
+		aLogger.Warn().Msg("Workout uploaded but sync was cancelled before the overlapping garmin activity was deleted")
+		return
+	}
+	err := u.garminClient.DeleteActivity(activity.ID)
+	if err != nil {
+		aLogger.Warn().Err(err).Msg("Workout uploaded but failed to delete the overlapping garmin activity")
+		return
+	}
+	job.replaced = true
+	aLogger.Info().Msg("Deleted the overlapping garmin activity")
+}
@@ -0,0 +1,194 @@
+package cmd
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	connect "github.com/abrander/garmin-connect"
+	"github.com/mdordoy/peloton-to-garmin/garmin"
+	"github.com/mdordoy/peloton-to-garmin/peloton"
+	"github.com/mdordoy/peloton-to-garmin/state"
+	"github.com/rs/zerolog"
+)
+
+// fakeGarmin stands in for Garmin Connect, keeping the activities it holds in
+// memory.
+type fakeGarmin struct {
+	mu         sync.Mutex
+	activities map[int]connect.Activity
+	nextID     int
+	uploads    int
+	deleted    []int
+	// export is the file ExportActivity downloads for every activity.
+	export []byte
+	// uploadErr and updateErr fail every upload and update, deleteErr
+	// fails deleting the activities it maps.
+	uploadErr error
+	updateErr error
+	deleteErr map[int]error
+}
+
+func newFakeGarmin(activities ...connect.Activity) *fakeGarmin {
+	f := &fakeGarmin{activities: map[int]connect.Activity{}, nextID: 100, deleteErr: map[int]error{}}
+	for _, activity := range activities {
+		f.activities[activity.ID] = activity
+	}
+	return f
+}
+
+// has reports whether the fake holds an activity.
+func (f *fakeGarmin) has(activityID int) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.activities[activityID]
+	return ok
+}
+
+func (f *fakeGarmin) ActivitiesSince(since time.Time) ([]connect.Activity, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	activities := []connect.Activity{}
+	for _, activity := range f.activities {
+		if !activity.StartGMT.Before(since) {
+			activities = append(activities, activity)
+		}
+	}
+	sort.Slice(activities, func(i, j int) bool { return activities[i].ID < activities[j].ID })
+	return activities, nil
+}
+
+func (f *fakeGarmin) Upload(file []byte, format connect.ActivityFormat) (garmin.UploadResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.uploadErr != nil {
+		return garmin.UploadResult{}, f.uploadErr
+	}
+	f.uploads++
+	f.nextID++
+	f.activities[f.nextID] = connect.Activity{ID: f.nextID, StartGMT: connect.Time{Time: testStart}}
+	return garmin.UploadResult{Status: garmin.UploadCreated, ActivityID: f.nextID}, nil
+}
+
+func (f *fakeGarmin) UploadStatus(pending garmin.UploadResult) (garmin.UploadResult, error) {
+	return pending, nil
+}
+
+func (f *fakeGarmin) ActivityType(key string) (connect.ActivityType, error) {
+	return connect.ActivityType{TypeKey: key}, nil
+}
+
+func (f *fakeGarmin) UpdateActivity(activityID int, update garmin.ActivityUpdate) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.updateErr != nil {
+		return f.updateErr
+	}
+	activity, ok := f.activities[activityID]
+	if !ok {
+		return connect.ErrNotFound
+	}
+	activity.ActivityName = update.Name
+	f.activities[activityID] = activity
+	return nil
+}
+
+func (f *fakeGarmin) ExportActivity(activityID int, w io.Writer, format connect.ActivityFormat) error {
+	_, err := w.Write(f.export)
+	return err
+}
+
+func (f *fakeGarmin) ActivityExists(activityID int) (bool, error) {
+	return f.has(activityID), nil
+}
+
+func (f *fakeGarmin) DeleteActivity(activityID int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.deleteErr[activityID]; err != nil {
+		return err
+	}
+	if _, ok := f.activities[activityID]; !ok {
+		return connect.ErrNotFound
+	}
+	delete(f.activities, activityID)
+	f.deleted = append(f.deleted, activityID)
+	return nil
+}
+
+func (f *fakeGarmin) GearForActivity(activityID int) ([]connect.Gear, error) {
+	return nil, nil
+}
+
+func (f *fakeGarmin) GearLink(uuid string, activityID int) error {
+	return nil
+}
+
+func (f *fakeGarmin) GearUnlink(uuid string, activityID int) error {
+	return nil
+}
+
+// keepSyncConfig restores the sync flags once a test that changes them ends.
+func keepSyncConfig(t *testing.T) {
+	saved := syncConfig
+	t.Cleanup(func() { syncConfig = saved })
+}
+
+// testDetail returns the details of the 20 minute ride testWorkout returns,
+// with a sample every minute and Peloton recording heartRate throughout.
+func testDetail(id string, heartRate float64) peloton.WorkoutDetail {
+	offsets, output, heartRates := []int{}, []float64{}, []float64{}
+	for offset := 0; offset <= 1200; offset += 60 {
+		offsets = append(offsets, offset)
+		output = append(output, 150)
+		heartRates = append(heartRates, heartRate)
+	}
+	return peloton.WorkoutDetail{
+		ID:                        id,
+		Title:                     "20 min Ride",
+		FitnessDiscipline:         "cycling",
+		DataGranularityInSeconds:  60,
+		StartTime:                 testStart,
+		EndTime:                   testStart.Add(20 * time.Minute),
+		SecondsSincePedalingStart: offsets,
+		Metrics: []peloton.WorkoutDetailMetrics{
+			{Slug: "output", DisplayUnit: "watts", Values: output},
+			{Slug: "heart_rate", DisplayUnit: "bpm", Values: heartRates},
+		},
+	}
+}
+
+// testJob returns a job holding a workout converted to FIT, ready to upload.
+func testJob(t *testing.T, workoutDetail peloton.WorkoutDetail) *syncJob {
+	t.Helper()
+	opts := garmin.ConvertOptions{Format: connect.ActivityFormatFIT, Laps: garmin.LapsSingle, Location: time.UTC}
+	buf, data, err := garmin.ConvertWorkout(workoutDetail, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := &syncJob{detail: workoutDetail, file: buf.Bytes(), opts: opts, data: data, logger: zerolog.Nop()}
+	job.setName()
+	return job
+}
+
+// testUploader returns an uploader to a fake Garmin, checking for overlaps
+// with the activities it holds.
+func testUploader(t *testing.T, client *fakeGarmin, store *state.Store) *uploader {
+	t.Helper()
+	u := &uploader{
+		garminClient: client,
+		store:        store,
+		limit:        newRateLimiter(0),
+		opts:         garmin.ConvertOptions{Format: connect.ActivityFormatFIT, Location: time.UTC},
+		runID:        "20240301T080000Z",
+	}
+	var err error
+	u.overlaps, err = newOverlapChecker(context.Background(), client, store, u.limit, []peloton.WorkoutData{testWorkout("w", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
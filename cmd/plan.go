@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mdordoy/peloton-to-garmin/garmin"
+	"github.com/mdordoy/peloton-to-garmin/peloton"
+	"github.com/mdordoy/peloton-to-garmin/state"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// Plan actions, describing what a sync would do with a workout.
+const (
+	planUpload      = "upload"
+	planReplace     = "replace"
+	planDuplicate   = "skip duplicate"
+	planUnsupported = "unsupported"
+	planFailed      = "failed"
+	planCancelled   = "cancelled"
+)
+
+// planEntry is a row of the dry run plan.
+type planEntry struct {
+	WorkoutID  string    `json:"workoutId"`
+	Date       time.Time `json:"date"`
+	Discipline string    `json:"discipline"`
+	Title      string    `json:"title"`
+	Action     string    `json:"action"`
+	Reason     string    `json:"reason,omitempty"`
+}
+
+// planWorkouts downloads and converts workouts like a sync, but records what
+// would be uploaded instead of calling Garmin.
+func planWorkouts(ctx context.Context, logger zerolog.Logger, peloClient *peloton.Client, store *state.Store, opts garmin.ConvertOptions, workouts []peloton.WorkoutData) []planEntry {
+	jobs := runPipeline(ctx, logger, peloClient, store, opts, workouts, func(ctx context.Context, job *syncJob) {
+		job.outcome = outcomePlanned
+	})
+
+	plan := make([]planEntry, 0, len(jobs))
+	for _, job := range jobs {
+		entry := planEntry{
+			WorkoutID:  job.workout.ID,
+			Date:       time.Unix(int64(job.workout.StartTime), 0).In(opts.Location),
+			Discipline: job.workout.FitnessDiscipline,
+			Title:      job.workout.Peloton.Ride.Title,
+			Reason:     job.reason,
+		}
+		switch job.outcome {
+		case outcomePlanned:
+			entry.Action = planUpload
+			if _, ok := store.Get(job.workout.ID); ok && syncConfig.Replace {
+				entry.Action = planReplace
+			}
+		case outcomeSkipped:
+			entry.Action = planDuplicate
+		case outcomeUnsupported:
+			entry.Action = planUnsupported
+		case outcomeCancelled:
+			entry.Action = planCancelled
+		default:
+			entry.Action = planFailed
+		}
+		plan = append(plan, entry)
+	}
+	return plan
+}
+
+// writePlan writes the plan as a table or as JSON.
+func writePlan(out io.Writer, plan []planEntry, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(plan)
+	case "table":
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "WORKOUT ID\tWORKOUT DATE\tDISCIPLINE\tTITLE\tACTION")
+		for _, entry := range plan {
+			action := entry.Action
+			if entry.Action == planFailed && entry.Reason != "" {
+				action = fmt.Sprintf("%s: %s", entry.Action, entry.Reason)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+				entry.WorkoutID,
+				entry.Date.Format("Mon Jan 2 2006 15:04:05"),
+				entry.Discipline,
+				entry.Title,
+				action,
+			)
+		}
+		return w.Flush()
+	}
+	return errors.New(fmt.Sprintf("unsupported output format %s, use table or json", format))
+}
@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	connect "github.com/abrander/garmin-connect"
+	"github.com/mdordoy/peloton-to-garmin/garmin"
+	"github.com/mdordoy/peloton-to-garmin/peloton"
+	"github.com/mdordoy/peloton-to-garmin/state"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// replaceTolerance is how far the start of a Garmin activity may be from the
+// start of a workout for --replace to take it as an earlier upload of it.
+const replaceTolerance = time.Minute
+
+// uploadedAs returns the Garmin activity an earlier sync uploaded a workout as,
+// when replacing. That is the activity recorded in the sync state or, failing
+// that, an activity named after the class or given the activity name that
+// started with the workout.
+func (u *uploader) uploadedAs(workoutDetail peloton.WorkoutDetail, name string) (connect.Activity, bool) {
+	if !syncConfig.Replace || u.overlaps == nil {
+		return connect.Activity{}, false
+	}
+	if entry, ok := u.store.Get(workoutDetail.ID); ok && entry.GarminActivityID != 0 {
+		for _, activity := range u.overlaps.activities {
+			if activity.ID == entry.GarminActivityID {
+				return activity, true
+			}
+		}
+	}
+	for _, activity := range u.overlaps.activities {
+		offset := activity.StartGMT.Sub(workoutDetail.StartTime)
+		if offset < -replaceTolerance || offset > replaceTolerance {
+			continue
+		}
+		if u.overlaps.uploaded[activity.ID] || strings.EqualFold(activity.ActivityName, workoutDetail.Title) || strings.EqualFold(activity.ActivityName, name) {
+			return activity, true
+		}
+	}
+	return connect.Activity{}, false
+}
+
+// resync finishes replacing the activity an earlier sync uploaded a workout
+// as, once the new file has been uploaded. The new activity is named,
+// described and linked to its gear before the old one is deleted, and any
+// failure deletes the new activity again, so the workout is never missing
+// from Garmin. It reports whether the old activity was replaced.
+func (u *uploader) resync(ctx context.Context, job *syncJob, result garmin.UploadResult, previous connect.Activity, entry state.Entry, rLogger zerolog.Logger) bool {
+	rLogger = rLogger.With().Int("Replacing Garmin Activity ID", previous.ID).Str("Replacing Garmin Activity", previous.ActivityName).Logger()
+	switch result.Status {
+	case garmin.UploadDuplicate:
+		rLogger.Error().Int("Garmin Activity ID", result.ActivityID).Msg("Garmin rejected the new activity as a duplicate, keeping the old activity")
+		job.outcome = outcomeFailed
+		job.reason = "garmin rejected the replacement as a duplicate"
+		return false
+	case garmin.UploadFailed:
+		rLogger.Error().Str("Reason", result.Message).Msg("Garmin rejected the new activity, keeping the old activity")
+		job.outcome = outcomeFailed
+		job.reason = result.Message
+		return false
+	case garmin.UploadPending:
+		rLogger.Error().Int("Upload ID", result.UploadID).Msg("Garmin is still processing the new activity, keeping the old activity, delete the new one in Garmin Connect once it appears")
+		job.outcome = outcomeFailed
+		job.reason = "garmin is still processing the replacement"
+		return false
+	}
+
+	rLogger = rLogger.With().Int("Garmin Activity ID", result.ActivityID).Logger()
+	err := u.updateActivity(ctx, result.ActivityID, job, rLogger)
+	if err == nil {
+		err = u.linkGear(ctx, result.ActivityID, job.detail, rLogger)
+	}
+	if err == nil {
+		err = u.deletePrevious(ctx, previous.ID)
+	}
+	if err != nil {
+		rLogger.Error().Err(err).Msg("Failed to replace the garmin activity, rolling back")
+		u.rollback(result.ActivityID, rLogger)
+		job.outcome = outcomeFailed
+		job.reason = err.Error()
+		return false
+	}
+	recordSyncState(u.store, entry, rLogger)
+	rLogger.Info().Msg("Replaced the garmin activity")
+	job.outcome = outcomeResynced
+	return true
+}
+
+// deletePrevious deletes the activity being replaced. A delete that failed
+// may still have gone through, so the activity is looked up before the
+// replacement is rolled back.
+func (u *uploader) deletePrevious(ctx context.Context, activityID int) error {
+	if u.limit.Wait(ctx) != nil {
+		return errors.New("sync was cancelled before the old garmin activity was deleted")
+	}
+	err := u.garminClient.DeleteActivity(activityID)
+	if err == nil || errors.Is(err, connect.ErrNotFound) {
+		return nil
+	}
+	_ = u.limit.Wait(context.Background())
+	exists, checkErr := u.garminClient.ActivityExists(activityID)
+	if checkErr == nil && !exists {
+		return nil
+	}
+	return err
+}
+
+// rollback deletes the activity uploaded to replace another, leaving the old
+// one in place. It runs even once the sync has been cancelled.
+func (u *uploader) rollback(activityID int, rLogger zerolog.Logger) {
+	_ = u.limit.Wait(context.Background())
+	err := u.garminClient.DeleteActivity(activityID)
+	if err != nil && !errors.Is(err, connect.ErrNotFound) {
+		rLogger.Error().Err(err).Msg("Failed to roll back, the workout is in garmin twice, delete the new activity in Garmin Connect")
+		return
+	}
+	rLogger.Info().Msg("Rolled back, deleted the new garmin activity and kept the old one")
+}
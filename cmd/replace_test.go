@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mdordoy/peloton-to-garmin/state"
+	"github.com/pkg/errors"
+)
+
+func TestResyncRollback(t *testing.T) {
+	keepSyncConfig(t)
+	syncConfig.Replace = true
+	syncConfig.OverlapPolicy = overlapUpload
+	syncConfig.OverlapThreshold = 50
+
+	original := state.Entry{WorkoutID: "w", Title: "20 min Ride", WorkoutStart: testStart, GarminActivityID: 1, ContentHash: "old", Format: "fit", RunID: "run1"}
+	tests := []struct {
+		name string
+		// recorded is whether the sync state holds the earlier upload.
+		recorded bool
+		fail     func(client *fakeGarmin)
+		outcome  syncOutcome
+		deleted  []int
+		// activity is the activity the state records afterwards.
+		activity int
+	}{
+		{"upload fails", true, func(client *fakeGarmin) { client.uploadErr = errors.New("upload failed") }, outcomeFailed, nil, 1},
+		{"naming fails", true, func(client *fakeGarmin) { client.updateErr = errors.New("update failed") }, outcomeFailed, []int{101}, 1},
+		{"deleting the original fails", true, func(client *fakeGarmin) { client.deleteErr[1] = errors.New("delete failed") }, outcomeFailed, []int{101}, 1},
+		{"replaced", true, nil, outcomeResynced, []int{1}, 101},
+		// An earlier upload missing from the state is found by its name
+		// and start.
+		{"unrecorded upload replaced", false, nil, outcomeResynced, []int{1}, 101},
+	}
+	for _, test := range tests {
+		client := newFakeGarmin(testActivity(1, "20 min Ride", 0))
+		if test.fail != nil {
+			test.fail(client)
+		}
+		store, err := state.Open(filepath.Join(t.TempDir(), "state.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.recorded {
+			store.Put(original)
+			if err := store.Save(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		job := testJob(t, testDetail("w", 120))
+		testUploader(t, client, store).upload(context.Background(), job)
+
+		if job.outcome != test.outcome {
+			t.Errorf("%s: outcome %d, want %d", test.name, job.outcome, test.outcome)
+		}
+		if !reflect.DeepEqual(client.deleted, test.deleted) {
+			t.Errorf("%s: deleted %v, want %v", test.name, client.deleted, test.deleted)
+		}
+		// The workout is in Garmin once, as the original activity or its
+		// replacement.
+		if client.has(1) == (test.activity != 1) || client.has(101) != (test.activity == 101) {
+			t.Errorf("%s: garmin holds activity 1 %v and 101 %v, want only %d", test.name, client.has(1), client.has(101), test.activity)
+		}
+
+		reopened, err := state.Open(store.Path())
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry, ok := reopened.Get("w")
+		switch {
+		case test.activity == 1 && !reflect.DeepEqual(entry, original):
+			t.Errorf("%s: saved state %+v, %v, want the original entry %+v", test.name, entry, ok, original)
+		case test.activity != 1 && (entry.GarminActivityID != test.activity || entry.RunID != "20240301T080000Z"):
+			t.Errorf("%s: saved state %+v, want activity %d recorded by this run", test.name, entry, test.activity)
+		}
+	}
+}
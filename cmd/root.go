@@ -1,11 +1,24 @@
 package cmd
 
 import (
+	"os"
+
+	"github.com/mdordoy/peloton-to-garmin/config"
+	"github.com/mdordoy/peloton-to-garmin/credentials"
 	"github.com/mdordoy/peloton-to-garmin/version"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
+var rootConfig struct {
+	ConfigFile string
+}
+
+// configFile is the loaded configuration file, nil when there is none.
+// Commands decode the structured sections they need from it.
+var configFile *config.File
+
 // RootCmd represents the base command when called without any subcommands
 var RootCmd = &cobra.Command{
 	Use:   "Root Command",
@@ -14,14 +27,91 @@ var RootCmd = &cobra.Command{
 
 	Version: version.GetVersion(),
 
-	RunE: rootCmd,
+	SilenceUsage:      true,
+	PersistentPreRunE: loadConfig,
+	RunE:              rootCmd,
 }
 
 func rootCmd(cmd *cobra.Command, args []string) error {
 	return errors.New("subcommand required")
 }
 
+// loadConfig fills any flags not given on the command line from PTG_*
+// environment variables and the configuration file.
+func loadConfig(cmd *cobra.Command, args []string) error {
+	file, err := loadConfigFile()
+	if err != nil {
+		return err
+	}
+	configFile = file
+	if file != nil {
+		err = file.CheckKeys(func(key string) bool {
+			return knownConfigKey(cmd.Root(), key)
+		})
+		if err != nil {
+			return err
+		}
+		err = checkConfigSecrets(cmd.Flags(), file)
+		if err != nil {
+			return err
+		}
+	}
+	return config.Apply(cmd.Flags(), file)
+}
+
+// knownConfigKey reports whether a config file key is a structured section
+// or a flag of root or any of its subcommands. One config file serves every
+// command, so a flag of another command is not a mistake.
+func knownConfigKey(root *cobra.Command, key string) bool {
+	if key == gearSection || key == nameTemplatesSection {
+		return true
+	}
+	commands := []*cobra.Command{root}
+	for len(commands) > 0 {
+		command := commands[0]
+		commands = append(commands[1:], command.Commands()...)
+		if command.Flags().Lookup(key) != nil || command.PersistentFlags().Lookup(key) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// checkConfigSecrets refuses to read secrets from a config file other users
+// can read.
+func checkConfigSecrets(flags *pflag.FlagSet, file *config.File) error {
+	var err error
+	flags.VisitAll(func(flag *pflag.Flag) {
+		if _, ok := flag.Annotations[secretAnnotation]; !ok || err != nil || !file.Has(flag.Name) {
+			return
+		}
+		err = credentials.CheckPermissions(file.Path)
+	})
+	return err
+}
+
+// loadConfigFile loads the file given by --config, or the default config file
+// when it exists. A nil file is returned when there is no config file.
+func loadConfigFile() (*config.File, error) {
+	path := rootConfig.ConfigFile
+	if path == "" {
+		path = os.Getenv(config.EnvPrefix + "CONFIG")
+	}
+	if path == "" {
+		defaultPath, err := config.DefaultPath()
+		if err != nil {
+			return nil, nil
+		}
+		if _, err := os.Stat(defaultPath); err != nil {
+			return nil, nil
+		}
+		path = defaultPath
+	}
+	return config.Load(path)
+}
+
 func init() {
 	RootCmd.SetVersionTemplate(`{{printf "%s" .Version}}
 `)
+	RootCmd.PersistentFlags().StringVar(&rootConfig.ConfigFile, "config", "", "Configuration file, defaults to peloton-to-garmin/config.yaml in your user config directory")
 }
@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mdordoy/peloton-to-garmin/config"
+	"github.com/spf13/pflag"
+)
+
+func TestKnownConfigKey(t *testing.T) {
+	tests := map[string]bool{
+		"garminPassword":     true,
+		"state-file":         true,
+		"interval":           true,
+		"older-than":         true,
+		"config":             true,
+		gearSection:          true,
+		nameTemplatesSection: true,
+		"garmin_pasword":     false,
+		"gaer":               false,
+	}
+	for key, want := range tests {
+		if got := knownConfigKey(RootCmd, key); got != want {
+			t.Errorf("knownConfigKey(%s) = %v, want %v", key, got, want)
+		}
+	}
+}
+
+func TestCheckConfigSecrets(t *testing.T) {
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.String("garminEmail", "", "")
+	flags.String("garminPassword", "", "")
+	_ = flags.SetAnnotation("garminPassword", secretAnnotation, []string{"true"})
+
+	tests := []struct {
+		name     string
+		contents string
+		mode     os.FileMode
+		wantErr  bool
+	}{
+		{"secret readable by others", "garminPassword: secret\n", 0644, true},
+		{"secret readable by the group", "garminPassword: secret\n", 0640, true},
+		{"secret readable by the owner", "garminPassword: secret\n", 0600, false},
+		{"no secret", "garminEmail: me@example.com\n", 0644, false},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		if err := ioutil.WriteFile(path, []byte(test.contents), test.mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(path, test.mode); err != nil {
+			t.Fatal(err)
+		}
+		file, err := config.Load(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = checkConfigSecrets(flags, file)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: checkConfigSecrets returned %v, want an error %v", test.name, err, test.wantErr)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mdordoy/peloton-to-garmin/state"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var stateConfig struct {
+	StateFile string
+	OlderThan time.Duration
+}
+
+var StateCmd = &cobra.Command{
+	Use:   "state",
+	Short: "Inspect and manage the record of workouts already synced to Garmin Connect",
+}
+
+var StateListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Lists the workouts recorded as synced",
+	Args:  cobra.NoArgs,
+	RunE:  stateListCmd,
+}
+
+var StateForgetCmd = &cobra.Command{
+	Use:   "forget <peloton workout id>...",
+	Short: "Removes workouts from the sync state so the next sync uploads them again",
+	Args:  cobra.MinimumNArgs(1),
+	RunE:  stateForgetCmd,
+}
+
+var StatePruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Removes entries that were uploaded before the --older-than cutoff",
+	Args:  cobra.NoArgs,
+	RunE:  statePruneCmd,
+}
+
+func stateListCmd(cmd *cobra.Command, args []string) error {
+	store, err := openStateStore(stateConfig.StateFile)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "WORKOUT ID\tWORKOUT DATE\tGARMIN ACTIVITY\tUPLOADED\tFORMAT\tRUN\tTITLE")
+	for _, entry := range store.List() {
+		activityID := "unknown"
+		if entry.GarminActivityID != 0 {
+			activityID = strconv.Itoa(entry.GarminActivityID)
+		}
+		runID := entry.RunID
+		if runID == "" {
+			runID = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			entry.WorkoutID,
+			entry.WorkoutStart.Format("Mon Jan 2 2006 15:04:05"),
+			activityID,
+			entry.UploadedAt.Format("Mon Jan 2 2006 15:04:05"),
+			entry.Format,
+			runID,
+			entry.Title,
+		)
+	}
+	return w.Flush()
+}
+
+func stateForgetCmd(cmd *cobra.Command, args []string) error {
+	store, err := openStateStore(stateConfig.StateFile)
+	if err != nil {
+		return err
+	}
+
+	for _, workoutID := range args {
+		if !store.Forget(workoutID) {
+			fmt.Fprintf(cmd.OutOrStdout(), "Workout %s is not in the sync state\n", workoutID)
+			continue
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "Forgot workout %s\n", workoutID)
+	}
+	return store.Save()
+}
+
+func statePruneCmd(cmd *cobra.Command, args []string) error {
+	if stateConfig.OlderThan <= 0 {
+		return errors.New("--older-than must be a positive duration")
+	}
+	store, err := openStateStore(stateConfig.StateFile)
+	if err != nil {
+		return err
+	}
+
+	pruned := store.Prune(time.Now().Add(-stateConfig.OlderThan))
+	for _, entry := range pruned {
+		fmt.Fprintf(cmd.OutOrStdout(), "Pruned workout %s (%s)\n", entry.WorkoutID, entry.Title)
+	}
+	fmt.Fprintf(cmd.OutOrStdout(), "Pruned %d entries\n", len(pruned))
+	return store.Save()
+}
+
+// openStateStore opens the sync state file at path.
+func openStateStore(path string) (*state.Store, error) {
+	if path == "" {
+		return nil, errors.New("no state file provided and no default location could be found")
+	}
+	store, err := state.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open sync state")
+	}
+	return store, nil
+}
+
+// defaultStatePath returns the default state file location for flag defaults.
+func defaultStatePath() string {
+	path, err := state.DefaultPath()
+	if err != nil {
+		return ""
+	}
+	return path
+}
+
+func init() {
+	RootCmd.AddCommand(StateCmd)
+	StateCmd.AddCommand(StateListCmd, StateForgetCmd, StatePruneCmd)
+	StateCmd.PersistentFlags().StringVar(&stateConfig.StateFile, "state-file", defaultStatePath(), "File recording which workouts have already been synced to Garmin")
+	StatePruneCmd.Flags().DurationVar(&stateConfig.OlderThan, "older-than", 0, "Remove entries uploaded longer ago than this duration, e.g. 2160h")
+}
@@ -0,0 +1,395 @@
+package cmd
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	connect "github.com/abrander/garmin-connect"
+	"github.com/mdordoy/peloton-to-garmin/garmin"
+	"github.com/mdordoy/peloton-to-garmin/logger"
+	"github.com/mdordoy/peloton-to-garmin/peloton"
+	"github.com/mdordoy/peloton-to-garmin/state"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+)
+
+var statusConfig struct {
+	Output      string
+	Tolerance   time.Duration
+	SyncMissing bool
+}
+
+// statusDefaultRange is how far back the report goes without --since.
+const statusDefaultRange = 30 * 24 * time.Hour
+
+// Statuses of the rows of the report.
+const (
+	statusMatched     = "matched"
+	statusMissing     = "missing"
+	statusUnsupported = "unsupported"
+	// statusOrphaned marks a Garmin activity the sync state records as the
+	// upload of a workout that it no longer matches.
+	statusOrphaned = "orphaned"
+)
+
+var StatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Compares your Peloton workouts with your Garmin Connect activities",
+	Long: `Lists the Peloton workouts and Garmin Connect activities over the same date
+range and matches them by start time and duration. Each workout is reported as
+matched, missing from Garmin or of an unsupported discipline, and Garmin
+activities a sync uploaded that match no workout as orphaned.`,
+	Args: cobra.NoArgs,
+	RunE: statusCmd,
+}
+
+// statusEntry is a row of the report, a Peloton workout or an orphaned
+// Garmin activity.
+type statusEntry struct {
+	Status           string    `json:"status"`
+	Date             time.Time `json:"date"`
+	WorkoutID        string    `json:"workoutId,omitempty"`
+	Discipline       string    `json:"discipline,omitempty"`
+	Title            string    `json:"title"`
+	DurationSeconds  int       `json:"durationSeconds"`
+	GarminActivityID int       `json:"garminActivityId,omitempty"`
+	GarminActivity   string    `json:"garminActivity,omitempty"`
+	// workout is the Peloton workout of the row, synced by --sync-missing.
+	workout peloton.WorkoutData
+}
+
+func statusCmd(cmd *cobra.Command, args []string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// The report is written to stdout, so it can be piped.
+	logger := logger.NewLoggerTo(os.Stderr, syncConfig.LogLevel, syncConfig.PrettyLog)
+
+	switch statusConfig.Output {
+	case "table", "json", "csv":
+	default:
+		return errors.New(fmt.Sprintf("unsupported output format %s, use table, json or csv", statusConfig.Output))
+	}
+	if statusConfig.Tolerance <= 0 {
+		return errors.New("match-tolerance must be positive")
+	}
+	opts, err := validateSyncConfig()
+	if err != nil {
+		return err
+	}
+	logFlags(logger, cmd.Flags())
+	query, err := statusQuery(opts.Location)
+	if err != nil {
+		return err
+	}
+	store, err := openStateStore(syncConfig.StateFile)
+	if err != nil {
+		return err
+	}
+
+	peloClient, err := newPelotonClient()
+	if err != nil {
+		return err
+	}
+	// Every workout in the date range is listed, so activities recorded for
+	// workouts the filters leave out are not taken for orphans.
+	dateRange := peloton.WorkoutQuery{Since: query.Since, Until: query.Until}
+	workouts, err := peloClient.ListWorkouts(dateRange)
+	if err != nil {
+		return errors.Wrap(err, "failed to get users workouts")
+	}
+	garminClient := garmin.NewClient(syncConfig.GarminEmail, syncConfig.GarminPassword, syncConfig.GarminSessionCache, logger)
+	activities, err := garminClient.ActivitiesSince(query.Since.Add(-statusConfig.Tolerance))
+	if err != nil {
+		return err
+	}
+	inRange := []connect.Activity{}
+	for _, activity := range activities {
+		if activity.StartGMT.Before(query.Until.Add(statusConfig.Tolerance)) {
+			inRange = append(inRange, activity)
+		}
+	}
+	logger.Debug().Int("Workouts", len(workouts)).Int("Activities", len(inRange)).Msg("Comparing peloton workouts with garmin activities")
+
+	report := reconcile(workouts, inRange, store, query, statusConfig.Tolerance, opts.Location)
+	err = writeStatus(cmd.OutOrStdout(), report, statusConfig.Output)
+	if err != nil {
+		return err
+	}
+	if !statusConfig.SyncMissing {
+		return nil
+	}
+	return syncMissing(ctx, logger, report, peloClient, garminClient, store, opts)
+}
+
+// statusQuery returns the date range of the report, the last 30 days unless
+// --since or --until are given.
+func statusQuery(location *time.Location) (peloton.WorkoutQuery, error) {
+	query := peloton.WorkoutQuery{
+		Since:       time.Now().Add(-statusDefaultRange),
+		Until:       time.Now(),
+		Disciplines: syncConfig.Disciplines,
+		Instructors: syncConfig.Instructors,
+		MinDuration: syncConfig.MinDuration,
+	}
+	var err error
+	if syncConfig.Since != "" {
+		query.Since, err = parseDate(syncConfig.Since, location, false)
+		if err != nil {
+			return query, errors.Wrap(err, "invalid --since")
+		}
+	}
+	if syncConfig.Until != "" {
+		query.Until, err = parseDate(syncConfig.Until, location, true)
+		if err != nil {
+			return query, errors.Wrap(err, "invalid --until")
+		}
+	}
+	if !query.Since.Before(query.Until) {
+		return query, errors.New("--since must be before --until")
+	}
+	return query, nil
+}
+
+// reconcile matches the Peloton workouts selected by query with Garmin
+// activities, newest first. A workout matches the activity the sync state
+// records it was uploaded as or, failing that, the activity starting closest
+// to it whose start and duration are both within tolerance of the workout's.
+// Unmatched activities recorded in the sync state are reported as orphaned.
+// Other activities are not, nor are those recorded for workouts the query
+// leaves out or that are still in progress.
+func reconcile(workouts []peloton.WorkoutData, activities []connect.Activity, store *state.Store, query peloton.WorkoutQuery, tolerance time.Duration, location *time.Location) []statusEntry {
+	byID := map[int]connect.Activity{}
+	for _, activity := range activities {
+		byID[activity.ID] = activity
+	}
+	used := map[int]bool{}
+	report := []statusEntry{}
+	pending := []int{}
+	// unreported holds the workouts left out of the report, whose recorded
+	// activities are not orphans.
+	unreported := map[string]bool{}
+
+	for _, workout := range workouts {
+		if !query.Matches(workout) {
+			unreported[workout.ID] = true
+			continue
+		}
+		// Workouts still in progress are reported once they finish.
+		if strings.EqualFold(workout.Status, "in_progress") || workout.EndTime == 0 {
+			unreported[workout.ID] = true
+			continue
+		}
+		entry := statusEntry{
+			Status:          statusMissing,
+			Date:            time.Unix(int64(workout.StartTime), 0).In(location),
+			WorkoutID:       workout.ID,
+			Discipline:      workout.FitnessDiscipline,
+			Title:           workout.Peloton.Ride.Title,
+			DurationSeconds: workout.EndTime - workout.StartTime,
+			workout:         workout,
+		}
+		if !garmin.Supported(workout.FitnessDiscipline) {
+			entry.Status = statusUnsupported
+			report = append(report, entry)
+			continue
+		}
+		if synced, ok := store.Get(workout.ID); ok {
+			if activity, ok := byID[synced.GarminActivityID]; ok && !used[activity.ID] {
+				entry = matchActivity(entry, activity)
+				used[activity.ID] = true
+				report = append(report, entry)
+				continue
+			}
+		}
+		report = append(report, entry)
+		pending = append(pending, len(report)-1)
+	}
+
+	// Workouts without a recorded activity are matched once every recorded
+	// activity has been claimed.
+	for _, i := range pending {
+		entry := report[i]
+		best, bestOffset := connect.Activity{}, time.Duration(math.MaxInt64)
+		for _, activity := range activities {
+			if used[activity.ID] {
+				continue
+			}
+			offset := absDuration(activity.StartGMT.Sub(entry.Date))
+			drift := absDuration(activityDuration(activity) - time.Duration(entry.DurationSeconds)*time.Second)
+			if offset > tolerance || drift > tolerance || offset >= bestOffset {
+				continue
+			}
+			best, bestOffset = activity, offset
+		}
+		if best.ID != 0 {
+			report[i] = matchActivity(entry, best)
+			used[best.ID] = true
+		}
+	}
+
+	uploaded := map[int]bool{}
+	for _, entry := range store.List() {
+		if entry.GarminActivityID == 0 || unreported[entry.WorkoutID] {
+			continue
+		}
+		uploaded[entry.GarminActivityID] = true
+	}
+	for _, activity := range activities {
+		if used[activity.ID] || !uploaded[activity.ID] {
+			continue
+		}
+		report = append(report, statusEntry{
+			Status:           statusOrphaned,
+			Date:             activity.StartGMT.In(location),
+			Title:            activity.ActivityName,
+			DurationSeconds:  int(activityDuration(activity).Seconds()),
+			GarminActivityID: activity.ID,
+			GarminActivity:   activity.ActivityName,
+		})
+	}
+
+	sort.SliceStable(report, func(i, j int) bool {
+		return report[i].Date.After(report[j].Date)
+	})
+	return report
+}
+
+// matchActivity marks a report entry as matching a Garmin activity.
+func matchActivity(entry statusEntry, activity connect.Activity) statusEntry {
+	entry.Status = statusMatched
+	entry.GarminActivityID = activity.ID
+	entry.GarminActivity = activity.ActivityName
+	return entry
+}
+
+// activityDuration returns how long a Garmin activity lasted, including
+// pauses like the Peloton workout duration.
+func activityDuration(activity connect.Activity) time.Duration {
+	seconds := math.Max(activity.ElapsedDuration, activity.Duration)
+	return time.Duration(seconds * float64(time.Second))
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// writeStatus writes the report as a table with a summary line, as JSON or as
+// CSV.
+func writeStatus(out io.Writer, report []statusEntry, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	case "csv":
+		w := csv.NewWriter(out)
+		_ = w.Write([]string{"status", "date", "workout_id", "discipline", "title", "duration_seconds", "garmin_activity_id", "garmin_activity"})
+		for _, entry := range report {
+			activityID := ""
+			if entry.GarminActivityID != 0 {
+				activityID = strconv.Itoa(entry.GarminActivityID)
+			}
+			_ = w.Write([]string{
+				entry.Status,
+				entry.Date.Format(time.RFC3339),
+				entry.WorkoutID,
+				entry.Discipline,
+				entry.Title,
+				strconv.Itoa(entry.DurationSeconds),
+				activityID,
+				entry.GarminActivity,
+			})
+		}
+		w.Flush()
+		return w.Error()
+	}
+
+	counts := map[string]int{}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STATUS\tWORKOUT DATE\tWORKOUT ID\tDISCIPLINE\tDURATION\tGARMIN ACTIVITY\tTITLE")
+	for _, entry := range report {
+		counts[entry.Status]++
+		workoutID, discipline, activityID := "-", "-", "-"
+		if entry.WorkoutID != "" {
+			workoutID, discipline = entry.WorkoutID, entry.Discipline
+		}
+		if entry.GarminActivityID != 0 {
+			activityID = strconv.Itoa(entry.GarminActivityID)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			entry.Status,
+			entry.Date.Format("Mon Jan 2 2006 15:04:05"),
+			workoutID,
+			discipline,
+			time.Duration(entry.DurationSeconds)*time.Second,
+			activityID,
+			entry.Title,
+		)
+	}
+	err := w.Flush()
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "\n%d matched, %d missing, %d unsupported, %d orphaned\n", counts[statusMatched], counts[statusMissing], counts[statusUnsupported], counts[statusOrphaned])
+	return err
+}
+
+// syncMissing syncs the workouts the report found missing from Garmin. Sync
+// state recorded for them is stale, as their activities are gone, so it is
+// forgotten first.
+func syncMissing(ctx context.Context, logger zerolog.Logger, report []statusEntry, peloClient *peloton.Client, garminClient *garmin.Client, store *state.Store, opts garmin.ConvertOptions) error {
+	missing := []peloton.WorkoutData{}
+	for _, entry := range report {
+		if entry.Status != statusMissing {
+			continue
+		}
+		if store.Forget(entry.WorkoutID) {
+			logger.Info().Str("Workout ID", entry.WorkoutID).Str("Title", entry.Title).Msg("Workout was synced but is missing from garmin, syncing it again")
+		}
+		missing = append(missing, entry.workout)
+	}
+	if len(missing) == 0 {
+		logger.Info().Msg("No workouts missing from garmin")
+		return nil
+	}
+	err := store.Save()
+	if err != nil {
+		return err
+	}
+
+	summary, err := syncWorkouts(ctx, logger, peloClient, garminClient, store, opts, missing)
+	if err != nil {
+		return err
+	}
+	if summary.Cancelled > 0 {
+		logger.Warn().Int("Cancelled", summary.Cancelled).Msg("Sync cancelled, remaining workouts will be synced on the next run")
+	}
+	logger.Info().Int("Uploaded", summary.Uploaded).Int("Skipped", summary.Skipped).Int("Overlapping", summary.Overlapping).Int("Replaced", summary.Replaced).Int("Failed", summary.Failed).Str("Run ID", summary.RunID).Msg("Missing workouts synced")
+	return nil
+}
+
+func init() {
+	RootCmd.AddCommand(StatusCmd)
+	addSyncFlags(StatusCmd)
+	StatusCmd.Flags().StringVar(&syncConfig.Since, "since", "", "Compare workouts started on or after this date (2006-01-02) or time (RFC 3339), defaults to 30 days ago")
+	StatusCmd.Flags().StringVar(&syncConfig.Until, "until", "", "Compare workouts started before the end of this date or before this time, defaults to now")
+	StatusCmd.Flags().StringVar(&statusConfig.Output, "output", "table", "Format of the report: table, json or csv")
+	StatusCmd.Flags().DurationVar(&statusConfig.Tolerance, "match-tolerance", 2*time.Minute, "How far the start time and duration of a Garmin activity may differ from a workout's for the two to match")
+	StatusCmd.Flags().BoolVar(&statusConfig.SyncMissing, "sync-missing", false, "Sync the workouts missing from Garmin after writing the report")
+}
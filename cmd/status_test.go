@@ -0,0 +1,171 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	connect "github.com/abrander/garmin-connect"
+	"github.com/mdordoy/peloton-to-garmin/peloton"
+	"github.com/mdordoy/peloton-to-garmin/state"
+)
+
+var testStart = time.Date(2024, 3, 1, 7, 0, 0, 0, time.UTC)
+
+// testWorkout returns a finished 20 minute ride starting minutes after
+// testStart.
+func testWorkout(id string, minutes int) peloton.WorkoutData {
+	start := testStart.Add(time.Duration(minutes) * time.Minute)
+	workout := peloton.WorkoutData{
+		ID:                id,
+		FitnessDiscipline: "cycling",
+		Status:            "COMPLETE",
+		StartTime:         int(start.Unix()),
+		EndTime:           int(start.Add(20 * time.Minute).Unix()),
+	}
+	workout.Peloton.Ride.Title = "20 min Ride"
+	return workout
+}
+
+// testActivity returns a 20 minute Garmin activity starting offset after
+// testStart.
+func testActivity(id int, name string, offset time.Duration) connect.Activity {
+	return connect.Activity{
+		ID:              id,
+		ActivityName:    name,
+		StartGMT:        connect.Time{Time: testStart.Add(offset)},
+		ElapsedDuration: (20 * time.Minute).Seconds(),
+	}
+}
+
+// testStore returns a sync state store recording each workout ID as uploaded
+// as the mapped Garmin activity.
+func testStore(t *testing.T, uploads map[string]int) *state.Store {
+	t.Helper()
+	store, err := state.Open(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for workoutID, activityID := range uploads {
+		store.Put(state.Entry{WorkoutID: workoutID, GarminActivityID: activityID, WorkoutStart: testStart})
+	}
+	return store
+}
+
+func TestReconcile(t *testing.T) {
+	running := testWorkout("run", 180)
+	running.FitnessDiscipline = "running"
+	inProgress := testWorkout("live", 120)
+	inProgress.Status = "IN_PROGRESS"
+	inProgress.EndTime = 0
+	yoga := testWorkout("yoga", 60)
+	yoga.FitnessDiscipline = "yoga"
+	unsupported := testWorkout("dance", 60)
+	unsupported.FitnessDiscipline = "dance"
+	long := testActivity(2, "Ride", 0)
+	long.ElapsedDuration = (40 * time.Minute).Seconds()
+
+	query := peloton.WorkoutQuery{Since: testStart.Add(-time.Hour), Until: testStart.Add(24 * time.Hour)}
+	cyclingOnly := query
+	cyclingOnly.Disciplines = []string{"cycling"}
+
+	tests := []struct {
+		name       string
+		workouts   []peloton.WorkoutData
+		activities []connect.Activity
+		uploads    map[string]int
+		query      peloton.WorkoutQuery
+		// want lists the status, workout ID and Garmin activity ID of
+		// each report row, newest first.
+		want []string
+	}{
+		{
+			name:       "recorded activity wins over a closer start",
+			workouts:   []peloton.WorkoutData{testWorkout("w", 0)},
+			activities: []connect.Activity{testActivity(1, "Ride", 0), testActivity(2, "Ride", 90*time.Second)},
+			uploads:    map[string]int{"w": 2},
+			query:      query,
+			want:       []string{"matched w 2"},
+		},
+		{
+			name:       "recorded activity is claimed before closest start matching",
+			workouts:   []peloton.WorkoutData{testWorkout("a", 0), testWorkout("b", 1)},
+			activities: []connect.Activity{testActivity(1, "Ride", 0), testActivity(2, "Ride", time.Minute)},
+			// Matching a by start first would take activity 1 from b.
+			uploads: map[string]int{"b": 1},
+			query:   query,
+			want:    []string{"matched b 1", "matched a 2"},
+		},
+		{
+			name:       "closest start within tolerance",
+			workouts:   []peloton.WorkoutData{testWorkout("w", 0)},
+			activities: []connect.Activity{testActivity(1, "Ride", time.Minute), testActivity(2, "Ride", -30*time.Second), testActivity(3, "Ride", 5*time.Minute)},
+			query:      query,
+			want:       []string{"matched w 2"},
+		},
+		{
+			name:       "duration beyond tolerance",
+			workouts:   []peloton.WorkoutData{testWorkout("w", 0)},
+			activities: []connect.Activity{long},
+			query:      query,
+			want:       []string{"missing w 0"},
+		},
+		{
+			name:       "recorded activity deleted from garmin",
+			workouts:   []peloton.WorkoutData{testWorkout("w", 0)},
+			activities: []connect.Activity{testActivity(3, "Ride", 30*time.Second)},
+			uploads:    map[string]int{"w": 2},
+			query:      query,
+			want:       []string{"matched w 3"},
+		},
+		{
+			name:       "unsupported discipline",
+			workouts:   []peloton.WorkoutData{unsupported},
+			activities: []connect.Activity{testActivity(1, "Dance", time.Hour)},
+			query:      query,
+			want:       []string{"unsupported dance 0"},
+		},
+		{
+			name:       "recorded activity of a workout gone from peloton",
+			activities: []connect.Activity{testActivity(1, "20 min Ride", 0)},
+			uploads:    map[string]int{"deleted": 1},
+			query:      query,
+			want:       []string{"orphaned  1"},
+		},
+		{
+			name:       "unrecorded activity named after a class",
+			workouts:   []peloton.WorkoutData{testWorkout("w", 0)},
+			activities: []connect.Activity{testActivity(1, "20 min Ride", 6*time.Hour)},
+			query:      query,
+			want:       []string{"missing w 0"},
+		},
+		{
+			name:       "recorded activity of a filtered workout",
+			workouts:   []peloton.WorkoutData{testWorkout("w", 0), running},
+			activities: []connect.Activity{testActivity(1, "Run", 3*time.Hour)},
+			uploads:    map[string]int{"run": 1},
+			query:      cyclingOnly,
+			want:       []string{"missing w 0"},
+		},
+		{
+			name:       "workout in progress",
+			workouts:   []peloton.WorkoutData{inProgress, yoga},
+			activities: []connect.Activity{testActivity(1, "20 min Ride", 2*time.Hour), testActivity(2, "Yoga", time.Hour)},
+			uploads:    map[string]int{"live": 1},
+			query:      query,
+			want:       []string{"matched yoga 2"},
+		},
+	}
+	for _, test := range tests {
+		report := reconcile(test.workouts, test.activities, testStore(t, test.uploads), test.query, 2*time.Minute, time.UTC)
+		got := []string{}
+		for _, entry := range report {
+			got = append(got, fmt.Sprintf("%s %s %d", entry.Status, entry.WorkoutID, entry.GarminActivityID))
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: report %q, want %q", test.name, got, test.want)
+		}
+	}
+}
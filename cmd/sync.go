@@ -2,13 +2,25 @@ package cmd
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"text/template"
+	"time"
 
 	connect "github.com/abrander/garmin-connect"
+	"github.com/mdordoy/peloton-to-garmin/credentials"
 	"github.com/mdordoy/peloton-to-garmin/garmin"
 	"github.com/mdordoy/peloton-to-garmin/logger"
 	"github.com/mdordoy/peloton-to-garmin/peloton"
+	"github.com/mdordoy/peloton-to-garmin/state"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 var syncConfig struct {
@@ -22,8 +34,58 @@ var syncConfig struct {
 	GarminEmail             string
 	GarminPassword          string
 	OutTCXFilePath          string
+	Format                  string
+	StateFile               string
+	PelotonPasswordFrom     string
+	GarminPasswordFrom      string
+	VaultIdentity           string
+	SessionCache            string
+	GarminSessionCache      string
+	Since                   string
+	Until                   string
+	WorkoutIDs              []string
+	Disciplines             []string
+	Instructors             []string
+	MinDuration             time.Duration
+	FetchWorkers            int
+	UploadWorkers           int
+	PelotonRate             float64
+	GarminRate              float64
+	Laps                    string
+	Timezone                string
+	DryRun                  bool
+	Output                  string
+	OverlapPolicy           string
+	OverlapThreshold        float64
+	MergeDelete             bool
+	Description             bool
+	DescriptionTemplate     string
+	NameTemplate            string
+	SyncWeight              bool
+	WeightTolerance         float64
+	Replace                 bool
 }
 
+// descriptionTemplate is the parsed --description-template, nil when
+// descriptions are disabled.
+var descriptionTemplate *template.Template
+
+// nameTemplatesSection is the config file section holding the per discipline
+// name templates.
+const nameTemplatesSection = "name-templates"
+
+// nameTemplates holds the parsed --name-template under the empty key and the
+// per discipline overrides from the name-templates config file section.
+var nameTemplates map[string]*template.Template
+
+// templatesUseMusic is set when a name or description template lists the
+// class playlist, which takes another request to fetch.
+var templatesUseMusic bool
+
+// secretAnnotation marks flags holding secrets, which are redacted from logs
+// and may only be read from config files other users cannot read.
+const secretAnnotation = "secret"
+
 var SyncCmd = &cobra.Command{
 	Use:   "sync",
 	Short: "Performs workout syncs from Peloton to Garmin Connect",
@@ -31,93 +93,439 @@ var SyncCmd = &cobra.Command{
 }
 
 func syncCmd(cmd *cobra.Command, args []string) error {
-	ctx := context.Background()
-	logger := logger.NewLogger(syncConfig.LogLevel, syncConfig.PrettyLog)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	logger := logger.NewLoggerTo(syncLogDestination(), syncConfig.LogLevel, syncConfig.PrettyLog)
 	_ = logger.WithContext(ctx)
 
-	if syncConfig.GarminEmail == "" {
-		logger.Fatal().Msg("Garmin email not provided, this is required")
-	}
-	if syncConfig.GarminPassword == "" {
-		logger.Fatal().Msg("Garmin password not provided, this is required")
+	opts, err := validateSyncConfig()
+	if err != nil {
+		return err
 	}
-	if syncConfig.PelotonUsername == "" {
-		logger.Fatal().Msg("Peloton username not provided, this is required")
+	if syncConfig.Output != "table" && syncConfig.Output != "json" {
+		return errors.New(fmt.Sprintf("unsupported output format %s, use table or json", syncConfig.Output))
 	}
-	if syncConfig.PelotonPassword == "" {
-		logger.Fatal().Msg("Peloton password not provided, this is required")
+	logFlags(logger, cmd.Flags())
+	query, err := workoutQuery()
+	if err != nil {
+		return err
 	}
-	peloClient, err := peloton.NewClient(syncConfig.PelotonUsername, syncConfig.PelotonPassword, syncConfig.PelotonAPIHost)
+	peloClient, err := newPelotonClient()
 	if err != nil {
-		logger.Fatal().Err(err).Msg("Failed to authenticate with Peloton")
+		return err
 	}
-	workouts, err := peloClient.GetWorkouts(syncConfig.PelotonWorkoutInstances)
+	workouts, err := selectWorkouts(peloClient, query)
 	if err != nil {
-		logger.Fatal().Err(err).Msg("Failed to get users workouts")
+		return errors.Wrap(err, "failed to get users workouts")
 	}
 
-	if len(workouts) == 0 {
+	if len(workouts) == 0 && !syncConfig.DryRun {
 		logger.Info().Msg("No workouts found")
-		return nil
+		// The weight is synced even when there are no workouts.
+		if !syncConfig.SyncWeight {
+			return nil
+		}
+	}
+
+	store, err := openStateStore(syncConfig.StateFile)
+	if err != nil {
+		return err
+	}
+
+	if syncConfig.DryRun {
+		if syncConfig.SyncWeight {
+			logger.Info().Msg("Weight is not synced in a dry run, use sync-weight --dry-run to check it")
+		}
+		plan := planWorkouts(ctx, logger, peloClient, store, opts, workouts)
+		return writePlan(cmd.OutOrStdout(), plan, syncConfig.Output)
 	}
 
-	workoutList := []peloton.WorkoutDetail{}
+	garminClient := garmin.NewClient(syncConfig.GarminEmail, syncConfig.GarminPassword, syncConfig.GarminSessionCache, logger)
+	summary, err := syncWorkouts(ctx, logger, peloClient, garminClient, store, opts, workouts)
+	if err != nil {
+		return err
+	}
+	if summary.Cancelled > 0 {
+		logger.Warn().Int("Cancelled", summary.Cancelled).Msg("Sync cancelled, remaining workouts will be synced on the next run")
+	}
+	logger.Info().Int("Uploaded", summary.Uploaded).Int("Skipped", summary.Skipped).Int("Unsupported", summary.Unsupported).Int("Overlapping", summary.Overlapping).Int("Replaced", summary.Replaced).Int("Resynced", summary.Resynced).Int("Failed", summary.Failed).Str("Run ID", summary.RunID).Msg("Peloton to Garmin Sync completed")
 
-	for _, workout := range workouts {
-		workoutDetails, err := peloClient.GetWorkoutDetails(workout, syncConfig.DataGranularity)
+	if syncConfig.SyncWeight {
+		err = syncWeight(ctx, logger, peloClient, garminClient, time.Now().In(opts.Location), false)
 		if err != nil {
-			logger.Error().Err(err).Msgf("Failed to get workout with ID %s, skipping", workout.ID)
-			continue
+			logger.Error().Err(err).Msg("Failed to sync weight")
 		}
-		logger.Info().Str("Title", workoutDetails.Title).Str("Workout ID", workoutDetails.ID).Str("Workout Date", workoutDetails.StartTime.Format("Mon Jan 2 2006 15:04:05")).Msg("Found Peloton Workout")
-		workoutList = append(workoutList, workoutDetails)
 	}
 
-	garminClient := garmin.NewClient(syncConfig.GarminEmail, syncConfig.GarminPassword, logger)
-	for _, workoutDetail := range workoutList {
-		buf, err := garmin.ParsePelotonWorkout(workoutDetail, syncConfig.OutTCXFilePath)
+	return nil
+}
+
+// selectWorkouts returns the workouts to sync, either those named with
+// --workout-id or the most recent ones matching the selection flags.
+func selectWorkouts(peloClient *peloton.Client, query peloton.WorkoutQuery) ([]peloton.WorkoutData, error) {
+	if len(syncConfig.WorkoutIDs) > 0 {
+		workouts := []peloton.WorkoutData{}
+		for _, id := range syncConfig.WorkoutIDs {
+			workout, err := peloClient.GetWorkout(id)
+			if err != nil {
+				return nil, err
+			}
+			workouts = append(workouts, workout)
+		}
+		return workouts, nil
+	}
+	return peloClient.ListWorkouts(query)
+}
+
+// workoutQuery builds the Peloton workout filter from the selection flags. The
+// workout count only applies when no --since date bounds the search.
+func workoutQuery() (peloton.WorkoutQuery, error) {
+	query := peloton.WorkoutQuery{
+		Disciplines: syncConfig.Disciplines,
+		Instructors: syncConfig.Instructors,
+		MinDuration: syncConfig.MinDuration,
+	}
+	location, err := syncLocation()
+	if err != nil {
+		return query, err
+	}
+	if syncConfig.Since != "" {
+		query.Since, err = parseDate(syncConfig.Since, location, false)
+		if err != nil {
+			return query, errors.Wrap(err, "invalid --since")
+		}
+	} else {
+		query.Limit = syncConfig.PelotonWorkoutInstances
+	}
+	if syncConfig.Until != "" {
+		query.Until, err = parseDate(syncConfig.Until, location, true)
 		if err != nil {
-			logger.Error().Err(err).Str("Title", workoutDetail.Title).Str("Workout ID", workoutDetail.ID).Msg("Failed to convert peloton data to garmin data")
-			continue
+			return query, errors.Wrap(err, "invalid --until")
 		}
+	}
+	if !query.Since.IsZero() && !query.Until.IsZero() && !query.Since.Before(query.Until) {
+		return query, errors.New("--since must be before --until")
+	}
+	return query, nil
+}
 
-		status, err := garminClient.ImportActivity(&buf, connect.ActivityFormatTCX)
-		rLogger := logger.With().Str("Title", workoutDetail.Title).Str("Workout ID", workoutDetail.ID).Str("Workout Date", workoutDetail.StartTime.Format("Mon Jan 2 2006 15:04:05")).Logger()
+// parseDate parses an RFC 3339 time or a YYYY-MM-DD date in location. When
+// endOfDay is set a bare date means the end of that day, so --until is inclusive.
+func parseDate(value string, location *time.Location, endOfDay bool) (time.Time, error) {
+	date, err := time.ParseInLocation("2006-01-02", value, location)
+	if err == nil {
+		if endOfDay {
+			date = date.AddDate(0, 0, 1)
+		}
+		return date, nil
+	}
+	date, err = time.Parse(time.RFC3339, value)
+	if err != nil {
+		return date, errors.New(fmt.Sprintf("%q is not a date (2006-01-02) or time (2006-01-02T15:04:05Z07:00)", value))
+	}
+	return date, nil
+}
+
+// newPelotonClient logs in to Peloton, reusing the cached session when there
+// is one.
+func newPelotonClient() (*peloton.Client, error) {
+	peloClient, err := peloton.NewClient(syncConfig.PelotonUsername, syncConfig.PelotonPassword, syncConfig.PelotonAPIHost, peloton.SessionCache(syncConfig.SessionCache))
+	authErr := &peloton.AuthError{}
+	if errors.As(err, &authErr) {
+		return nil, errors.Wrap(err, "Peloton login failed, check the username and password")
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to authenticate with Peloton")
+	}
+	return peloClient, nil
+}
+
+// validateSyncConfig ensures the settings needed to sync have been provided
+// and returns how workouts are converted for upload.
+func validateSyncConfig() (garmin.ConvertOptions, error) {
+	opts := garmin.ConvertOptions{OutToDisk: syncConfig.OutTCXFilePath}
+	// A dry run never contacts Garmin, so it can be used before Garmin
+	// credentials are set up.
+	err := validateLogins(!syncConfig.DryRun)
+	if err != nil {
+		return opts, err
+	}
+	if syncConfig.WeightTolerance < 0 {
+		return opts, errors.New("weight-tolerance must not be negative")
+	}
+	if syncConfig.DataGranularity < 1 {
+		return opts, errors.New("granularity must be at least 1 second")
+	}
+	if syncConfig.PelotonWorkoutInstances < 1 {
+		return opts, errors.New("workoutCount must be at least 1")
+	}
+	if syncConfig.FetchWorkers < 1 || syncConfig.UploadWorkers < 1 {
+		return opts, errors.New("fetch-workers and upload-workers must be at least 1")
+	}
+	if syncConfig.PelotonRate < 0 || syncConfig.GarminRate < 0 {
+		return opts, errors.New("peloton-rate and garmin-rate must not be negative")
+	}
+	err = validateOverlapConfig()
+	if err != nil {
+		return opts, err
+	}
+	err = parseTemplates()
+	if err != nil {
+		return opts, err
+	}
+	err = parseGearMappings()
+	if err != nil {
+		return opts, err
+	}
+	format, err := garmin.ParseFormat(syncConfig.Format)
+	if err != nil {
+		return opts, err
+	}
+	opts.Format = format
+	// Garmin takes a TCX file of a workout it already has as a duplicate,
+	// only a FIT file with a new creation time can replace an activity.
+	if syncConfig.Replace && format != connect.ActivityFormatFIT {
+		return opts, errors.New("replace needs --format fit, Garmin rejects a tcx upload of a workout it already has as a duplicate")
+	}
+	opts.Laps, err = garmin.ParseLapMode(syncConfig.Laps)
+	if err != nil {
+		return opts, err
+	}
+	opts.Location, err = syncLocation()
+	return opts, err
+}
+
+// parseTemplates parses the name and description templates, so mistakes are
+// reported before anything is synced.
+func parseTemplates() error {
+	descriptionTemplate = nil
+	if syncConfig.Description {
+		text := syncConfig.DescriptionTemplate
+		if text == "" {
+			text = garmin.DefaultDescriptionTemplate
+		}
+		tmpl, err := garmin.ParseTemplate("description", text)
 		if err != nil {
-			switch {
-			case strings.Contains(err.Error(), "Duplicate Activity"):
-				rLogger.Info().Msg("Workout already uploaded to garmin")
-			case strings.Contains(err.Error(), "202: Accepted"):
-				rLogger.Info().Msgf("Workout uploaded to garmin")
-			default:
-				rLogger.Error().Err(err).Msg("Failed to upload activity to garmin")
-			}
-			continue
+			return err
 		}
+		descriptionTemplate = tmpl
+	}
 
-		err = garminClient.RenameActivity(status, workoutDetail.Title)
+	tmpl, err := garmin.ParseTemplate("name", syncConfig.NameTemplate)
+	if err != nil {
+		return err
+	}
+	nameTemplates = map[string]*template.Template{"": tmpl}
+	overrides := map[string]string{}
+	err = configFile.Decode(nameTemplatesSection, &overrides)
+	if err != nil {
+		return err
+	}
+	for discipline, text := range overrides {
+		if !garmin.Supported(discipline) {
+			return errors.New(fmt.Sprintf("name-templates: unsupported discipline %s, use one of %s", discipline, strings.Join(garmin.SupportedDisciplines(), ", ")))
+		}
+		tmpl, err := garmin.ParseTemplate("name", text)
 		if err != nil {
-			rLogger.Warn().Err(err).Msgf("Workout uploaded but failed to rename garmin activity to %s", workoutDetail.Title)
-			continue
+			return errors.Wrapf(err, "name-templates: %s", discipline)
 		}
-		rLogger.Info().Msgf("Workout uploaded and renamed to %s", workoutDetail.Title)
+		nameTemplates[discipline] = tmpl
+	}
+
+	templatesUseMusic = descriptionTemplate != nil && garmin.UsesField(descriptionTemplate, "Music")
+	for _, tmpl := range nameTemplates {
+		templatesUseMusic = templatesUseMusic || garmin.UsesField(tmpl, "Music")
+	}
+	return nil
+}
+
+// activityName renders the Garmin activity name of a converted workout,
+// using the class title when the template renders nothing.
+func activityName(data garmin.TemplateData) (string, error) {
+	tmpl, ok := nameTemplates[data.Discipline]
+	if !ok {
+		tmpl = nameTemplates[""]
+	}
+	if tmpl == nil {
+		return data.Title, nil
+	}
+	name, err := garmin.RenderTemplate(tmpl, data)
+	if err != nil || name == "" {
+		return data.Title, err
+	}
+	return name, nil
+}
 
+// syncLogDestination returns where sync logs are written. Dry runs and status
+// --sync-missing log to stderr so the plan or report written to stdout can be
+// parsed.
+func syncLogDestination() io.Writer {
+	if syncConfig.DryRun || statusConfig.SyncMissing {
+		return os.Stderr
 	}
-	logger.Info().Msg("Peloton to Garmin Sync completed")
+	return os.Stdout
+}
 
+// syncLocation returns the time zone workouts took place in, from --timezone
+// or the host.
+func syncLocation() (*time.Location, error) {
+	if syncConfig.Timezone == "" {
+		return time.Local, nil
+	}
+	location, err := time.LoadLocation(syncConfig.Timezone)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid timezone, use an IANA name such as Europe/London")
+	}
+	return location, nil
+}
+
+// validateLogins resolves the password secret sources and checks the Peloton
+// credentials, and the Garmin ones when garmin is set, have been provided.
+func validateLogins(garmin bool) error {
+	err := resolveSecret(&syncConfig.PelotonPassword, syncConfig.PelotonPasswordFrom, "pelotonPassword")
+	if err != nil {
+		return err
+	}
+	err = resolveSecret(&syncConfig.GarminPassword, syncConfig.GarminPasswordFrom, "garminPassword")
+	if err != nil {
+		return err
+	}
+	if syncConfig.GarminEmail == "" && garmin {
+		return errors.New("Garmin email not provided, this is required")
+	}
+	if syncConfig.GarminPassword == "" && garmin {
+		return errors.New("Garmin password not provided, this is required")
+	}
+	if syncConfig.PelotonUsername == "" {
+		return errors.New("Peloton username not provided, this is required")
+	}
+	if syncConfig.PelotonPassword == "" {
+		return errors.New("Peloton password not provided, this is required")
+	}
 	return nil
 }
 
+// resolveSecret fills password from its secret source when one is configured.
+func resolveSecret(password *string, source, name string) error {
+	if source == "" {
+		return nil
+	}
+	if *password != "" {
+		return errors.New(fmt.Sprintf("set only one of %s and %sFrom", name, name))
+	}
+	provider, err := credentials.Parse(source, credentials.Options{VaultIdentity: syncConfig.VaultIdentity})
+	if err != nil {
+		return errors.Wrapf(err, "invalid %sFrom", name)
+	}
+	secret, err := provider.Secret()
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %s from %s", name, provider)
+	}
+	*password = secret
+	return nil
+}
+
+// logFlags logs the effective settings at debug level, redacting secrets.
+func logFlags(logger zerolog.Logger, flags *pflag.FlagSet) {
+	if logger.GetLevel() > zerolog.DebugLevel {
+		return
+	}
+	event := logger.Debug()
+	flags.VisitAll(func(flag *pflag.Flag) {
+		value := flag.Value.String()
+		if _, ok := flag.Annotations[secretAnnotation]; ok && value != "" {
+			value = "[REDACTED]"
+		}
+		event = event.Str(flag.Name, value)
+	})
+	event.Msg("Using configuration")
+}
+
+// recordSyncState stores a successful upload so later runs skip the workout.
+func recordSyncState(store *state.Store, entry state.Entry, logger zerolog.Logger) {
+	store.Put(entry)
+	err := store.Save()
+	if err != nil {
+		logger.Warn().Err(err).Str("State File", store.Path()).Msg("Workout uploaded but failed to save sync state")
+	}
+}
+
+// addPelotonFlags registers the flags needed to log in to Peloton.
+func addPelotonFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&syncConfig.PelotonPassword, "pelotonPassword", "", "peloton Password")
+	cmd.Flags().StringVar(&syncConfig.PelotonUsername, "pelotonUsername", "", "peloton Username")
+	cmd.Flags().StringVar(&syncConfig.PelotonAPIHost, "PelotonAPIHost", "api.onepeloton.com", "The Peloton API host")
+	cmd.Flags().StringVar(&syncConfig.SessionCache, "session-cache", defaultSessionPath(), "File caching the Peloton session between runs, empty to log in every time")
+	cmd.Flags().StringVar(&syncConfig.PelotonPasswordFrom, "pelotonPasswordFrom", "", "Read the Peloton password from env:NAME, file:PATH, cmd:COMMAND or vault:PATH#KEY")
+	cmd.Flags().StringVar(&syncConfig.VaultIdentity, "vaultIdentity", "", "age identity file used to decrypt vault:PATH#KEY secret sources")
+	_ = cmd.Flags().SetAnnotation("pelotonPassword", secretAnnotation, []string{"true"})
+}
+
+// addGarminFlags registers the flags needed to log in to Garmin Connect.
+func addGarminFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&syncConfig.GarminPassword, "garminPassword", "", "Garmin Password")
+	cmd.Flags().StringVar(&syncConfig.GarminEmail, "garminEmail", "", "Garmin Email")
+	cmd.Flags().StringVar(&syncConfig.GarminSessionCache, "garmin-session-cache", defaultGarminSessionPath(), "File caching the Garmin Connect session between runs, empty to log in every time")
+	cmd.Flags().StringVar(&syncConfig.GarminPasswordFrom, "garminPasswordFrom", "", "Read the Garmin password from env:NAME, file:PATH, cmd:COMMAND or vault:PATH#KEY")
+	_ = cmd.Flags().SetAnnotation("garminPassword", secretAnnotation, []string{"true"})
+}
+
+// addSyncFlags registers the flags shared by every command that syncs workouts.
+func addSyncFlags(cmd *cobra.Command) {
+	addPelotonFlags(cmd)
+	addGarminFlags(cmd)
+	cmd.Flags().BoolVar(&syncConfig.PrettyLog, "PrettyLogging", true, "Use true for human readable log output")
+	cmd.Flags().StringVar(&syncConfig.LogLevel, "loglevel", "info", "Log Level: trace, debug, info, warn,error")
+	cmd.Flags().IntVar(&syncConfig.DataGranularity, "granularity", 1, "Data granularity from Peloton, default every 1 second")
+	cmd.Flags().IntVar(&syncConfig.PelotonWorkoutInstances, "workoutCount", 30, "Number of previous workouts you want to pull from Peloton")
+	cmd.Flags().StringVar(&syncConfig.OutTCXFilePath, "writeTCXToDisk", "", "If you provide an absolute path, the cli will write the tcx or fit file out to disk")
+	cmd.Flags().StringVar(&syncConfig.StateFile, "state-file", defaultStatePath(), "File recording which workouts have already been synced to Garmin")
+	cmd.Flags().StringVar(&syncConfig.Format, "format", "tcx", "Activity file format uploaded to Garmin: fit or tcx")
+	cmd.Flags().StringVar(&syncConfig.Laps, "laps", "segments", "Split activities into laps by class segments, distance splits or a single lap: segments, splits or single")
+	cmd.Flags().StringVar(&syncConfig.Timezone, "timezone", "", "IANA time zone workouts took place in, e.g. America/New_York, defaults to the host time zone")
+	cmd.Flags().StringSliceVar(&syncConfig.Disciplines, "discipline", nil, "Only sync workouts of these Peloton disciplines, e.g. cycling,running")
+	cmd.Flags().StringSliceVar(&syncConfig.Instructors, "instructor", nil, "Only sync classes taught by these instructors")
+	cmd.Flags().DurationVar(&syncConfig.MinDuration, "min-duration", 0, "Skip workouts shorter than this duration, e.g. 10m")
+	cmd.Flags().IntVar(&syncConfig.FetchWorkers, "fetch-workers", 4, "Number of workouts downloaded from Peloton at the same time")
+	cmd.Flags().IntVar(&syncConfig.UploadWorkers, "upload-workers", 2, "Number of workouts uploaded to Garmin at the same time")
+	cmd.Flags().Float64Var(&syncConfig.PelotonRate, "peloton-rate", 5, "Maximum Peloton requests started per second, 0 for no limit")
+	cmd.Flags().Float64Var(&syncConfig.GarminRate, "garmin-rate", 1, "Maximum Garmin requests started per second, 0 for no limit")
+	cmd.Flags().StringVar(&syncConfig.OverlapPolicy, "overlap-policy", overlapUpload, "What to do with workouts a Garmin device also recorded: skip, upload, replace the Garmin activity or merge its heart rate")
+	cmd.Flags().Float64Var(&syncConfig.OverlapThreshold, "overlap-threshold", 50, "Percentage of a workout a Garmin activity must cover to count as overlapping")
+	cmd.Flags().BoolVar(&syncConfig.MergeDelete, "merge-delete", false, "Delete the Garmin activity heart rate was merged from once the workout is uploaded")
+	cmd.Flags().StringVar(&syncConfig.NameTemplate, "name-template", garmin.DefaultNameTemplate, "Go text/template for the Garmin activity name, override it per discipline in the name-templates config file section")
+	cmd.Flags().BoolVar(&syncConfig.Description, "description", true, "Set the Garmin activity description from --description-template")
+	cmd.Flags().StringVar(&syncConfig.DescriptionTemplate, "description-template", "", "Go text/template for the Garmin activity description, empty for the built in template")
+	cmd.Flags().BoolVar(&syncConfig.SyncWeight, "sync-weight", false, "Also add the Peloton profile weight to Garmin Connect when it changed, see the sync-weight command")
+	addWeightToleranceFlag(cmd)
+}
+
+// defaultSessionPath returns the default Peloton session cache for flag defaults.
+func defaultSessionPath() string {
+	path, err := peloton.DefaultSessionPath()
+	if err != nil {
+		return ""
+	}
+	return path
+}
+
+// defaultGarminSessionPath returns the default Garmin session cache for flag
+// defaults.
+func defaultGarminSessionPath() string {
+	path, err := garmin.DefaultSessionPath()
+	if err != nil {
+		return ""
+	}
+	return path
+}
+
 func init() {
 	RootCmd.AddCommand(SyncCmd)
-	SyncCmd.Flags().BoolVar(&syncConfig.PrettyLog, "PrettyLogging", true, "Use true for human readable log output")
-	SyncCmd.Flags().StringVar(&syncConfig.LogLevel, "loglevel", "info", "Log Level: trace, debug, info, warn,error")
-	SyncCmd.Flags().StringVar(&syncConfig.PelotonPassword, "pelotonPassword", "", "peloton Password")
-	SyncCmd.Flags().StringVar(&syncConfig.PelotonUsername, "pelotonUsername", "", "peloton Username")
-	SyncCmd.Flags().StringVar(&syncConfig.PelotonAPIHost, "PelotonAPIHost", "api.onepeloton.com", "The Peloton API host")
-	SyncCmd.Flags().IntVar(&syncConfig.DataGranularity, "granularity", 1, "Data granularity from Peloton, default every 1 second")
-	SyncCmd.Flags().IntVar(&syncConfig.PelotonWorkoutInstances, "workoutCount", 30, "Number of previous workouts you want to pull from Peloton")
-	SyncCmd.Flags().StringVar(&syncConfig.GarminPassword, "garminPassword", "", "Garmin Password")
-	SyncCmd.Flags().StringVar(&syncConfig.GarminEmail, "garminEmail", "", "Garmin Email")
-	SyncCmd.Flags().StringVar(&syncConfig.OutTCXFilePath, "writeTCXToDisk", "", "If you provide an absolute path, the cli will write the tcx file out to disk")
+	addSyncFlags(SyncCmd)
+	SyncCmd.Flags().StringVar(&syncConfig.Since, "since", "", "Only sync workouts started on or after this date (2006-01-02) or time (RFC 3339), ignores workoutCount")
+	SyncCmd.Flags().StringVar(&syncConfig.Until, "until", "", "Only sync workouts started before the end of this date or before this time")
+	SyncCmd.Flags().BoolVar(&syncConfig.DryRun, "dry-run", false, "Fetch and convert workouts and print what would be uploaded without contacting Garmin")
+	SyncCmd.Flags().StringVar(&syncConfig.Output, "output", "table", "Format of the dry run plan: table or json")
+	SyncCmd.Flags().StringArrayVar(&syncConfig.WorkoutIDs, "workout-id", nil, "Sync only this Peloton workout, repeat to sync several")
+	SyncCmd.Flags().BoolVar(&syncConfig.Replace, "replace", false, "Upload already synced workouts again, replacing the Garmin activities earlier syncs uploaded them as")
 }
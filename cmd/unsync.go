@@ -0,0 +1,263 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	connect "github.com/abrander/garmin-connect"
+	"github.com/mdordoy/peloton-to-garmin/garmin"
+	"github.com/mdordoy/peloton-to-garmin/logger"
+	"github.com/mdordoy/peloton-to-garmin/state"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var unsyncConfig struct {
+	Since       string
+	Until       string
+	RunID       string
+	ActivityIDs []int
+	Force       bool
+	DryRun      bool
+	Yes         bool
+}
+
+var UnsyncCmd = &cobra.Command{
+	Use:   "unsync [peloton workout id]...",
+	Short: "Deletes synced workouts from Garmin Connect so they can be synced again",
+	Long: `Deletes the Garmin activities synced workouts were uploaded as and removes
+them from the sync state, so the next sync uploads them again. Select the
+workouts by Peloton workout ID, by workout date with --since and --until, or by
+the --run-id logged at the end of a sync.`,
+	RunE: unsyncCmd,
+}
+
+// unsyncTarget is a Garmin activity to delete. Entry is empty for activities
+// given with --activity-id that are not in the sync state.
+type unsyncTarget struct {
+	ActivityID int
+	Entry      state.Entry
+	Mapped     bool
+}
+
+func unsyncCmd(cmd *cobra.Command, args []string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	out := cmd.OutOrStdout()
+
+	store, err := openStateStore(syncConfig.StateFile)
+	if err != nil {
+		return err
+	}
+	targets, err := unsyncTargets(store, args, out)
+	if err != nil {
+		return err
+	}
+	if len(targets) == 0 {
+		fmt.Fprintln(out, "No synced workouts match")
+		return nil
+	}
+	writeUnsyncTargets(out, targets)
+
+	if unsyncConfig.DryRun {
+		fmt.Fprintf(out, "Dry run, would delete %d garmin activities\n", len(targets))
+		return nil
+	}
+	if !unsyncConfig.Yes && !confirm(cmd.InOrStdin(), out, fmt.Sprintf("Delete %d garmin activities?", len(targets))) {
+		return errors.New("unsync cancelled")
+	}
+
+	err = resolveSecret(&syncConfig.GarminPassword, syncConfig.GarminPasswordFrom, "garminPassword")
+	if err != nil {
+		return err
+	}
+	if syncConfig.GarminEmail == "" {
+		return errors.New("Garmin email not provided, this is required")
+	}
+	if syncConfig.GarminPassword == "" {
+		return errors.New("Garmin password not provided, this is required")
+	}
+	logger := logger.NewLogger(syncConfig.LogLevel, syncConfig.PrettyLog)
+	garminClient := garmin.NewClient(syncConfig.GarminEmail, syncConfig.GarminPassword, syncConfig.GarminSessionCache, logger)
+	limit := newRateLimiter(syncConfig.GarminRate)
+
+	deleted, failed := 0, 0
+	for _, target := range targets {
+		if limit.Wait(ctx) != nil {
+			break
+		}
+		err := garminClient.DeleteActivity(target.ActivityID)
+		if err != nil && !errors.Is(err, connect.ErrNotFound) {
+			fmt.Fprintf(out, "Failed to delete garmin activity %d: %s\n", target.ActivityID, err)
+			failed++
+			continue
+		}
+		if err != nil {
+			fmt.Fprintf(out, "Garmin activity %d was already deleted\n", target.ActivityID)
+		} else {
+			fmt.Fprintf(out, "Deleted garmin activity %d\n", target.ActivityID)
+		}
+		deleted++
+		if target.Mapped {
+			store.Forget(target.Entry.WorkoutID)
+		}
+	}
+	err = store.Save()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Deleted %d garmin activities, the next sync uploads their workouts again\n", deleted)
+	if ctx.Err() != nil {
+		return errors.New("unsync cancelled, the remaining activities were not deleted")
+	}
+	if failed > 0 {
+		return errors.New(fmt.Sprintf("failed to delete %d garmin activities", failed))
+	}
+	return nil
+}
+
+// unsyncTargets selects the activities to delete from the sync state.
+// Workouts without a recorded Garmin activity are reported and left out, and
+// --activity-id values missing from the state are refused without --force.
+func unsyncTargets(store *state.Store, workoutIDs []string, out io.Writer) ([]unsyncTarget, error) {
+	selections := 0
+	for _, selected := range []bool{len(workoutIDs) > 0, unsyncConfig.Since != "" || unsyncConfig.Until != "", unsyncConfig.RunID != "", len(unsyncConfig.ActivityIDs) > 0} {
+		if selected {
+			selections++
+		}
+	}
+	if selections != 1 {
+		return nil, errors.New("select workouts with either workout IDs, --since/--until, --run-id or --activity-id")
+	}
+
+	entries := []state.Entry{}
+	switch {
+	case len(workoutIDs) > 0:
+		for _, id := range workoutIDs {
+			entry, ok := store.Get(id)
+			if !ok {
+				fmt.Fprintf(out, "Workout %s is not in the sync state, skipping\n", id)
+				continue
+			}
+			entries = append(entries, entry)
+		}
+	case unsyncConfig.RunID != "":
+		for _, entry := range store.List() {
+			if entry.RunID == unsyncConfig.RunID {
+				entries = append(entries, entry)
+			}
+		}
+	case len(unsyncConfig.ActivityIDs) > 0:
+		return activityTargets(store)
+	default:
+		location, err := syncLocation()
+		if err != nil {
+			return nil, err
+		}
+		since, until := time.Time{}, time.Time{}
+		if unsyncConfig.Since != "" {
+			since, err = parseDate(unsyncConfig.Since, location, false)
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid --since")
+			}
+		}
+		if unsyncConfig.Until != "" {
+			until, err = parseDate(unsyncConfig.Until, location, true)
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid --until")
+			}
+		}
+		for _, entry := range store.List() {
+			if entry.WorkoutStart.Before(since) || (!until.IsZero() && !entry.WorkoutStart.Before(until)) {
+				continue
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	targets := []unsyncTarget{}
+	for _, entry := range entries {
+		if entry.GarminActivityID == 0 {
+			fmt.Fprintf(out, "Workout %s has no recorded garmin activity, delete it in Garmin Connect and run state forget %s\n", entry.WorkoutID, entry.WorkoutID)
+			continue
+		}
+		targets = append(targets, unsyncTarget{ActivityID: entry.GarminActivityID, Entry: entry, Mapped: true})
+	}
+	return targets, nil
+}
+
+// activityTargets returns the --activity-id activities, which must have been
+// uploaded by a sync unless --force is given.
+func activityTargets(store *state.Store) ([]unsyncTarget, error) {
+	mapped := map[int]state.Entry{}
+	for _, entry := range store.List() {
+		if entry.GarminActivityID != 0 {
+			mapped[entry.GarminActivityID] = entry
+		}
+	}
+	targets := []unsyncTarget{}
+	for _, id := range unsyncConfig.ActivityIDs {
+		entry, ok := mapped[id]
+		if !ok && !unsyncConfig.Force {
+			return nil, errors.New(fmt.Sprintf("garmin activity %d was not uploaded by a sync, use --force to delete it anyway", id))
+		}
+		targets = append(targets, unsyncTarget{ActivityID: id, Entry: entry, Mapped: ok})
+	}
+	return targets, nil
+}
+
+func writeUnsyncTargets(out io.Writer, targets []unsyncTarget) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "GARMIN ACTIVITY\tWORKOUT ID\tWORKOUT DATE\tRUN\tTITLE")
+	for _, target := range targets {
+		if !target.Mapped {
+			fmt.Fprintf(w, "%d\t-\t-\t-\tnot in the sync state\n", target.ActivityID)
+			continue
+		}
+		runID := target.Entry.RunID
+		if runID == "" {
+			runID = "-"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n",
+			target.ActivityID,
+			target.Entry.WorkoutID,
+			target.Entry.WorkoutStart.Format("Mon Jan 2 2006 15:04:05"),
+			runID,
+			target.Entry.Title,
+		)
+	}
+	_ = w.Flush()
+}
+
+// confirm asks a yes or no question, anything but yes is taken as no.
+func confirm(in io.Reader, out io.Writer, question string) bool {
+	fmt.Fprintf(out, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func init() {
+	RootCmd.AddCommand(UnsyncCmd)
+	addGarminFlags(UnsyncCmd)
+	UnsyncCmd.Flags().BoolVar(&syncConfig.PrettyLog, "PrettyLogging", true, "Use true for human readable log output")
+	UnsyncCmd.Flags().StringVar(&syncConfig.LogLevel, "loglevel", "info", "Log Level: trace, debug, info, warn,error")
+	UnsyncCmd.Flags().StringVar(&syncConfig.StateFile, "state-file", defaultStatePath(), "File recording which workouts have already been synced to Garmin")
+	UnsyncCmd.Flags().StringVar(&syncConfig.Timezone, "timezone", "", "IANA time zone --since and --until dates are in, defaults to the host time zone")
+	UnsyncCmd.Flags().Float64Var(&syncConfig.GarminRate, "garmin-rate", 1, "Maximum Garmin requests started per second, 0 for no limit")
+	UnsyncCmd.Flags().StringVar(&unsyncConfig.Since, "since", "", "Unsync workouts started on or after this date (2006-01-02) or time (RFC 3339)")
+	UnsyncCmd.Flags().StringVar(&unsyncConfig.Until, "until", "", "Unsync workouts started before the end of this date or before this time")
+	UnsyncCmd.Flags().StringVar(&unsyncConfig.RunID, "run-id", "", "Unsync the workouts uploaded by this sync run, as logged when the sync completed")
+	UnsyncCmd.Flags().IntSliceVar(&unsyncConfig.ActivityIDs, "activity-id", nil, "Delete these Garmin activities, which must have been uploaded by a sync unless --force is given")
+	UnsyncCmd.Flags().BoolVar(&unsyncConfig.Force, "force", false, "Allow deleting --activity-id activities that are not in the sync state")
+	UnsyncCmd.Flags().BoolVar(&unsyncConfig.DryRun, "dry-run", false, "Print the activities that would be deleted without deleting them")
+	UnsyncCmd.Flags().BoolVarP(&unsyncConfig.Yes, "yes", "y", false, "Delete without asking for confirmation")
+}
@@ -0,0 +1,216 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mdordoy/peloton-to-garmin/state"
+	"github.com/spf13/cobra"
+)
+
+// unsyncStore returns a saved sync state of four workouts, one of which has
+// no recorded Garmin activity.
+func unsyncStore(t *testing.T) *state.Store {
+	t.Helper()
+	store, err := state.Open(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := 24 * time.Hour
+	for _, entry := range []state.Entry{
+		{WorkoutID: "a", WorkoutStart: testStart, GarminActivityID: 11, RunID: "run1"},
+		{WorkoutID: "b", WorkoutStart: testStart.Add(day), GarminActivityID: 12, RunID: "run2"},
+		{WorkoutID: "c", WorkoutStart: testStart.Add(day + 16*time.Hour), RunID: "run2"},
+		{WorkoutID: "d", WorkoutStart: testStart.Add(2 * day), GarminActivityID: 14, RunID: "run2"},
+	} {
+		store.Put(entry)
+	}
+	if err := store.Save(); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// keepUnsyncConfig restores the unsync and sync flags once a test ends and
+// reads dates in UTC until then.
+func keepUnsyncConfig(t *testing.T) {
+	saved := unsyncConfig
+	t.Cleanup(func() { unsyncConfig = saved })
+	keepSyncConfig(t)
+	syncConfig.Timezone = "UTC"
+}
+
+func TestUnsyncTargets(t *testing.T) {
+	keepUnsyncConfig(t)
+	defaults := unsyncConfig
+	tests := []struct {
+		name       string
+		workoutIDs []string
+		config     func()
+		// want lists the activities to delete, with a star after those
+		// missing from the sync state.
+		want   []string
+		output []string
+	}{
+		{
+			name:       "workout ids",
+			workoutIDs: []string{"a", "missing", "c"},
+			want:       []string{"11"},
+			output:     []string{"Workout missing is not in the sync state", "Workout c has no recorded garmin activity"},
+		},
+		{
+			name:   "date range",
+			config: func() { unsyncConfig.Since, unsyncConfig.Until = "2024-03-02", "2024-03-02" },
+			want:   []string{"12"},
+			output: []string{"Workout c has no recorded garmin activity"},
+		},
+		{
+			name:   "since",
+			config: func() { unsyncConfig.Since = "2024-03-02" },
+			want:   []string{"12", "14"},
+		},
+		{
+			name:   "until a time",
+			config: func() { unsyncConfig.Until = "2024-03-02T07:00:00Z" },
+			want:   []string{"11"},
+		},
+		{
+			name:   "run id",
+			config: func() { unsyncConfig.RunID = "run2" },
+			want:   []string{"12", "14"},
+		},
+		{
+			name:   "recorded activity ids",
+			config: func() { unsyncConfig.ActivityIDs = []int{14, 11} },
+			want:   []string{"14", "11"},
+		},
+		{
+			name: "unrecorded activity id with force",
+			config: func() {
+				unsyncConfig.ActivityIDs = []int{12, 99}
+				unsyncConfig.Force = true
+			},
+			want: []string{"12", "99*"},
+		},
+	}
+	for _, test := range tests {
+		unsyncConfig = defaults
+		if test.config != nil {
+			test.config()
+		}
+		out := bytes.Buffer{}
+		targets, err := unsyncTargets(unsyncStore(t), test.workoutIDs, &out)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		got := []string{}
+		for _, target := range targets {
+			if !target.Mapped {
+				got = append(got, fmt.Sprintf("%d*", target.ActivityID))
+				continue
+			}
+			if target.Entry.GarminActivityID != target.ActivityID {
+				t.Errorf("%s: target %d carries the entry of activity %d", test.name, target.ActivityID, target.Entry.GarminActivityID)
+			}
+			got = append(got, fmt.Sprint(target.ActivityID))
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: targets %v, want %v", test.name, got, test.want)
+		}
+		for _, line := range test.output {
+			if !strings.Contains(out.String(), line) {
+				t.Errorf("%s: output %q does not report %q", test.name, out.String(), line)
+			}
+		}
+	}
+}
+
+func TestUnsyncTargetsRefused(t *testing.T) {
+	keepUnsyncConfig(t)
+	defaults := unsyncConfig
+	tests := []struct {
+		name       string
+		workoutIDs []string
+		config     func()
+		want       string
+	}{
+		{
+			name:   "unrecorded activity id",
+			config: func() { unsyncConfig.ActivityIDs = []int{12, 99} },
+			want:   "garmin activity 99 was not uploaded by a sync, use --force",
+		},
+		{
+			name: "nothing selected",
+			want: "select workouts with either",
+		},
+		{
+			name:       "two selections",
+			workoutIDs: []string{"a"},
+			config:     func() { unsyncConfig.RunID = "run1" },
+			want:       "select workouts with either",
+		},
+		{
+			name:   "invalid date",
+			config: func() { unsyncConfig.Since = "yesterday" },
+			want:   "invalid --since",
+		},
+	}
+	for _, test := range tests {
+		unsyncConfig = defaults
+		if test.config != nil {
+			test.config()
+		}
+		targets, err := unsyncTargets(unsyncStore(t), test.workoutIDs, &bytes.Buffer{})
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: targets %+v, %v, want an error containing %q", test.name, targets, err, test.want)
+		}
+	}
+}
+
+func TestUnsyncDryRun(t *testing.T) {
+	keepUnsyncConfig(t)
+	store := unsyncStore(t)
+	syncConfig.StateFile = store.Path()
+	unsyncConfig.RunID = "run2"
+	unsyncConfig.DryRun = true
+
+	// The dry run returns before logging in to Garmin, which fails without
+	// credentials.
+	syncConfig.GarminEmail, syncConfig.GarminPassword, syncConfig.GarminPasswordFrom = "", "", ""
+	out := bytes.Buffer{}
+	cmd := &cobra.Command{}
+	cmd.SetOut(&out)
+	if err := unsyncCmd(cmd, nil); err != nil {
+		t.Fatal(err)
+	}
+	rows := map[string]string{}
+	for _, line := range strings.Split(out.String(), "\n") {
+		if fields := strings.Fields(line); len(fields) > 1 {
+			rows[fields[0]] = fields[1]
+		}
+	}
+	if rows["12"] != "b" || rows["14"] != "d" || !strings.Contains(out.String(), "Dry run, would delete 2 garmin activities") {
+		t.Errorf("dry run output %q does not list activities 12 and 14", out.String())
+	}
+
+	// Declining to delete leaves the state alone as well.
+	unsyncConfig.DryRun = false
+	cmd.SetIn(strings.NewReader("n\n"))
+	if err := unsyncCmd(cmd, nil); err == nil || !strings.Contains(err.Error(), "unsync cancelled") {
+		t.Errorf("declining returned %v, want unsync cancelled", err)
+	}
+
+	reopened, err := state.Open(store.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reopened.List(), store.List()) {
+		t.Errorf("the sync state changed to %+v", reopened.List())
+	}
+}
@@ -0,0 +1,254 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mdordoy/peloton-to-garmin/garmin"
+	"github.com/mdordoy/peloton-to-garmin/logger"
+	"github.com/mdordoy/peloton-to-garmin/peloton"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// watchGracePeriod is subtracted from the poll time when moving the cutoff
+// forward, so workouts that show up in the Peloton API late are not missed.
+// Workouts seen twice are skipped by the sync state.
+const watchGracePeriod = 5 * time.Minute
+
+var errSyncFailures = errors.New("one or more workouts failed to sync")
+
+var watchConfig struct {
+	Interval       time.Duration
+	Jitter         float64
+	MaxBackoff     time.Duration
+	Lookback       time.Duration
+	HealthAddr     string
+	UnhealthyAfter int
+}
+
+var WatchCmd = &cobra.Command{
+	Use:   "watch",
+	Short: "Continuously polls Peloton and syncs newly finished workouts to Garmin Connect",
+	RunE:  watchCmd,
+}
+
+// watchHealth tracks the outcome of recent polls for the health endpoint.
+type watchHealth struct {
+	mu                  sync.Mutex
+	started             time.Time
+	lastPoll            time.Time
+	lastSuccess         time.Time
+	lastError           string
+	consecutiveFailures int
+	unhealthyAfter      int
+}
+
+func (h *watchHealth) record(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastPoll = time.Now()
+	if err != nil {
+		h.lastError = err.Error()
+		h.consecutiveFailures++
+		return
+	}
+	h.lastSuccess = h.lastPoll
+	h.lastError = ""
+	h.consecutiveFailures = 0
+}
+
+func (h *watchHealth) failures() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.consecutiveFailures
+}
+
+func (h *watchHealth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	status := struct {
+		Status              string    `json:"status"`
+		Started             time.Time `json:"started"`
+		LastPoll            time.Time `json:"lastPoll,omitempty"`
+		LastSuccess         time.Time `json:"lastSuccess,omitempty"`
+		LastError           string    `json:"lastError,omitempty"`
+		ConsecutiveFailures int       `json:"consecutiveFailures"`
+	}{
+		Status:              "ok",
+		Started:             h.started,
+		LastPoll:            h.lastPoll,
+		LastSuccess:         h.lastSuccess,
+		LastError:           h.lastError,
+		ConsecutiveFailures: h.consecutiveFailures,
+	}
+	healthy := h.unhealthyAfter <= 0 || h.consecutiveFailures < h.unhealthyAfter
+	h.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !healthy {
+		status.Status = "failing"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(status)
+}
+
+func watchCmd(cmd *cobra.Command, args []string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	logger := logger.NewLogger(syncConfig.LogLevel, syncConfig.PrettyLog)
+	_ = logger.WithContext(ctx)
+
+	opts, err := validateSyncConfig()
+	if err != nil {
+		return err
+	}
+	logFlags(logger, cmd.Flags())
+	if watchConfig.Interval <= 0 {
+		return errors.New("interval must be a positive duration")
+	}
+	if watchConfig.Jitter < 0 || watchConfig.Jitter >= 1 {
+		return errors.New("jitter must be at least 0 and less than 1")
+	}
+	store, err := openStateStore(syncConfig.StateFile)
+	if err != nil {
+		return err
+	}
+	peloClient, err := newPelotonClient()
+	if err != nil {
+		return err
+	}
+	garminClient := garmin.NewClient(syncConfig.GarminEmail, syncConfig.GarminPassword, syncConfig.GarminSessionCache, logger)
+
+	health := &watchHealth{started: time.Now(), unhealthyAfter: watchConfig.UnhealthyAfter}
+	// serveErr reports the health endpoint stopping, which ends the watch
+	// rather than leaving it running unobserved.
+	var serveErr chan error
+	if watchConfig.HealthAddr != "" {
+		listener, err := net.Listen("tcp", watchConfig.HealthAddr)
+		if err != nil {
+			return errors.Wrap(err, "failed to serve the health endpoint")
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/healthz", health)
+		server := &http.Server{Handler: mux}
+		serveErr = make(chan error, 1)
+		go func() {
+			serveErr <- server.Serve(listener)
+		}()
+		defer func() {
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_ = server.Shutdown(shutdownCtx)
+		}()
+		logger.Info().Str("Address", watchConfig.HealthAddr).Msg("Serving health endpoint on /healthz")
+	}
+
+	cutoff := time.Now().Add(-watchConfig.Lookback)
+	logger.Info().Dur("Interval", watchConfig.Interval).Str("Since", cutoff.Format("Mon Jan 2 2006 15:04:05")).Msg("Watching Peloton for new workouts")
+	weightDue := syncConfig.SyncWeight
+	for {
+		pollStart := time.Now()
+		workouts, err := peloClient.ListWorkouts(peloton.WorkoutQuery{
+			Limit:       syncConfig.PelotonWorkoutInstances,
+			Disciplines: syncConfig.Disciplines,
+			Instructors: syncConfig.Instructors,
+			MinDuration: syncConfig.MinDuration,
+		})
+		if err != nil {
+			logger.Error().Err(err).Msg("Failed to get users workouts")
+		} else {
+			finished := finishedSince(workouts, cutoff)
+			logger.Debug().Int("Workouts", len(finished)).Msg("Polled Peloton")
+			summary, syncErr := syncWorkouts(ctx, logger, peloClient, garminClient, store, opts, finished)
+			if summary.Uploaded > 0 || summary.Failed > 0 || summary.Overlapping > 0 {
+				logger.Info().Int("Uploaded", summary.Uploaded).Int("Skipped", summary.Skipped).Int("Overlapping", summary.Overlapping).Int("Replaced", summary.Replaced).Int("Failed", summary.Failed).Str("Run ID", summary.RunID).Msg("Sync completed")
+			}
+			// The weight is checked when watching starts and whenever a
+			// workout was uploaded, rather than on every poll. A failed
+			// check is retried on the next poll.
+			if weightDue || (syncConfig.SyncWeight && summary.Uploaded > 0) {
+				weightErr := syncWeight(ctx, logger, peloClient, garminClient, time.Now().In(opts.Location), false)
+				weightDue = weightErr != nil
+				if weightErr != nil {
+					logger.Error().Err(weightErr).Msg("Failed to sync weight")
+				}
+			}
+			// Keep the cutoff where it was while workouts are failing so they
+			// are retried on the next poll.
+			if syncErr != nil {
+				logger.Error().Err(syncErr).Msg("Failed to sync workouts")
+				err = syncErr
+			} else if summary.Failed > 0 {
+				err = errSyncFailures
+			} else {
+				cutoff = pollStart.Add(-watchGracePeriod)
+			}
+		}
+		health.record(err)
+
+		delay := nextPollDelay(watchConfig.Interval, watchConfig.Jitter, health.failures(), watchConfig.MaxBackoff)
+		if err != nil {
+			logger.Warn().Dur("Retry In", delay).Msg("Poll failed, backing off")
+		}
+		select {
+		case <-ctx.Done():
+			logger.Info().Msg("Shutting down watch")
+			return nil
+		case err := <-serveErr:
+			return errors.Wrap(err, "health endpoint stopped")
+		case <-time.After(delay):
+		}
+	}
+}
+
+// finishedSince returns the workouts that finished at or after since, ignoring
+// any that are still in progress.
+func finishedSince(workouts []peloton.WorkoutData, since time.Time) []peloton.WorkoutData {
+	finished := []peloton.WorkoutData{}
+	for _, workout := range workouts {
+		if strings.EqualFold(workout.Status, "in_progress") || workout.EndTime == 0 {
+			continue
+		}
+		if time.Unix(int64(workout.EndTime), 0).Before(since) {
+			continue
+		}
+		finished = append(finished, workout)
+	}
+	return finished
+}
+
+// nextPollDelay doubles the interval for every consecutive failure, up to
+// maxBackoff, and spreads polls by up to jitter of the delay either way.
+func nextPollDelay(interval time.Duration, jitter float64, failures int, maxBackoff time.Duration) time.Duration {
+	delay := interval
+	for i := 0; i < failures && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if failures > 0 && maxBackoff > interval && delay > maxBackoff {
+		delay = maxBackoff
+	}
+	if jitter > 0 {
+		delay += time.Duration((rand.Float64()*2 - 1) * jitter * float64(delay))
+	}
+	return delay
+}
+
+func init() {
+	RootCmd.AddCommand(WatchCmd)
+	addSyncFlags(WatchCmd)
+	WatchCmd.Flags().DurationVar(&watchConfig.Interval, "interval", 15*time.Minute, "How often to poll Peloton for new workouts")
+	WatchCmd.Flags().Float64Var(&watchConfig.Jitter, "jitter", 0.1, "Fraction of the interval to randomly add or remove from each poll")
+	WatchCmd.Flags().DurationVar(&watchConfig.MaxBackoff, "max-backoff", time.Hour, "Longest delay between polls while errors keep occurring")
+	WatchCmd.Flags().DurationVar(&watchConfig.Lookback, "lookback", 24*time.Hour, "On start up, sync workouts finished within this duration")
+	WatchCmd.Flags().StringVar(&watchConfig.HealthAddr, "health-addr", ":8080", "Address to serve the /healthz endpoint on, empty to disable")
+	WatchCmd.Flags().IntVar(&watchConfig.UnhealthyAfter, "unhealthy-after", 3, "Consecutive failed polls before /healthz reports unhealthy")
+}
@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/mdordoy/peloton-to-garmin/garmin"
+	"github.com/mdordoy/peloton-to-garmin/logger"
+	"github.com/mdordoy/peloton-to-garmin/peloton"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+)
+
+var SyncWeightCmd = &cobra.Command{
+	Use:   "sync-weight",
+	Short: "Adds the Peloton profile weight to Garmin Connect as a weigh-in when it changed",
+	Args:  cobra.NoArgs,
+	RunE:  syncWeightCmd,
+}
+
+func syncWeightCmd(cmd *cobra.Command, args []string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	logger := logger.NewLogger(syncConfig.LogLevel, syncConfig.PrettyLog)
+
+	// Garmin is read even in a dry run, to show what would change.
+	err := validateLogins(true)
+	if err != nil {
+		return err
+	}
+	if syncConfig.WeightTolerance < 0 {
+		return errors.New("weight-tolerance must not be negative")
+	}
+	location, err := syncLocation()
+	if err != nil {
+		return err
+	}
+	peloClient, err := newPelotonClient()
+	if err != nil {
+		return err
+	}
+	garminClient := garmin.NewClient(syncConfig.GarminEmail, syncConfig.GarminPassword, syncConfig.GarminSessionCache, logger)
+	return syncWeight(ctx, logger, peloClient, garminClient, time.Now().In(location), syncConfig.DryRun)
+}
+
+// syncWeight adds the Peloton profile weight to Garmin as a weigh-in on the
+// day of now. Nothing is added when the weight is within --weight-tolerance
+// of the latest Garmin weigh-in, or when Garmin already has a weigh-in that
+// day, so entries from a scale are never replaced.
+func syncWeight(ctx context.Context, logger zerolog.Logger, peloClient *peloton.Client, garminClient *garmin.Client, now time.Time, dryRun bool) error {
+	if ctx.Err() != nil {
+		return nil
+	}
+	user, err := peloClient.GetUser()
+	if err != nil {
+		return err
+	}
+	if user.Weight <= 0 {
+		logger.Info().Msg("No weight in the peloton profile, skipping weight sync")
+		return nil
+	}
+	grams := user.Weight * garmin.GramsPerPound
+	wLogger := logger.With().Str("Peloton Weight", formatKilograms(grams)).Logger()
+
+	latest, ok, err := garminClient.LatestWeight(now)
+	if err != nil {
+		return err
+	}
+	if ok {
+		wLogger = wLogger.With().Str("Garmin Weight", formatKilograms(latest.Weight)).Str("Garmin Weigh-in", latest.Date.String()).Logger()
+		if math.Abs(grams-latest.Weight) <= syncConfig.WeightTolerance*1000 {
+			wLogger.Info().Msg("Weight unchanged, skipping weight sync")
+			return nil
+		}
+	}
+	sameDay, err := garminClient.HasWeightOn(now)
+	if err != nil {
+		return err
+	}
+	if sameDay {
+		wLogger.Info().Msg("Garmin already has a weigh-in today, skipping weight sync")
+		return nil
+	}
+
+	if dryRun {
+		wLogger.Info().Msg("Dry run, would add a garmin weigh-in")
+		return nil
+	}
+	err = garminClient.AddWeight(now, grams)
+	if err != nil {
+		return err
+	}
+	wLogger.Info().Msg("Added garmin weigh-in")
+	return nil
+}
+
+// formatKilograms formats a weight in grams as kilograms.
+func formatKilograms(grams float64) string {
+	return fmt.Sprintf("%.1f kg", grams/1000)
+}
+
+// addWeightToleranceFlag registers --weight-tolerance, shared by sync-weight
+// and the --sync-weight step of sync and watch.
+func addWeightToleranceFlag(cmd *cobra.Command) {
+	cmd.Flags().Float64Var(&syncConfig.WeightTolerance, "weight-tolerance", 0.5, "Kilograms the Peloton weight must differ from the latest Garmin weigh-in by before a new weigh-in is added")
+}
+
+func init() {
+	RootCmd.AddCommand(SyncWeightCmd)
+	addPelotonFlags(SyncWeightCmd)
+	addGarminFlags(SyncWeightCmd)
+	addWeightToleranceFlag(SyncWeightCmd)
+	SyncWeightCmd.Flags().BoolVar(&syncConfig.PrettyLog, "PrettyLogging", true, "Use true for human readable log output")
+	SyncWeightCmd.Flags().StringVar(&syncConfig.LogLevel, "loglevel", "info", "Log Level: trace, debug, info, warn,error")
+	SyncWeightCmd.Flags().StringVar(&syncConfig.Timezone, "timezone", "", "IANA time zone the weigh-in date is taken in, defaults to the host time zone")
+	SyncWeightCmd.Flags().BoolVar(&syncConfig.DryRun, "dry-run", false, "Compare the weights and print what would be added without changing Garmin")
+}
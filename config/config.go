@@ -0,0 +1,225 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix is prepended to a flag name to form the environment variable
+// that overrides it.
+const EnvPrefix = "PTG_"
+
+// File is a parsed configuration file. Top level scalar and list values are
+// keyed by the flag they set, mappings and lists of mappings hold structured
+// settings that have no flag equivalent.
+type File struct {
+	Path     string
+	values   map[string][]string
+	sections map[string]*yaml.Node
+}
+
+// DefaultPath returns the configuration file location inside the users config
+// directory, which honours XDG_CONFIG_HOME.
+func DefaultPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to find user config directory")
+	}
+	return filepath.Join(dir, "peloton-to-garmin", "config.yaml"), nil
+}
+
+// Load parses the YAML configuration file at path.
+func Load(path string) (*File, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read config file")
+	}
+
+	doc := yaml.Node{}
+	err = yaml.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse config file %s", path)
+	}
+
+	file := &File{
+		Path:     path,
+		values:   map[string][]string{},
+		sections: map[string]*yaml.Node{},
+	}
+	// An empty or fully commented out file has no document content.
+	if len(doc.Content) == 0 {
+		return file, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, errors.New(fmt.Sprintf("config file %s must contain a mapping of settings", path))
+	}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, node := root.Content[i].Value, root.Content[i+1]
+		switch node.Kind {
+		case yaml.ScalarNode:
+			file.values[key] = []string{node.Value}
+		case yaml.SequenceNode:
+			// A list of mappings is a structured section, like a mapping.
+			if len(node.Content) > 0 && node.Content[0].Kind == yaml.MappingNode {
+				file.sections[key] = node
+				continue
+			}
+			values := []string{}
+			for _, item := range node.Content {
+				if item.Kind != yaml.ScalarNode {
+					return nil, errors.New(fmt.Sprintf("config key %s must be a list of values", key))
+				}
+				values = append(values, item.Value)
+			}
+			file.values[key] = values
+		case yaml.MappingNode:
+			file.sections[key] = node
+		}
+	}
+
+	return file, nil
+}
+
+// CheckKeys returns an error naming every setting in the configuration file
+// that known does not recognise, as a misspelt setting would otherwise be
+// silently ignored.
+func (f *File) CheckKeys(known func(key string) bool) error {
+	unknown := []string{}
+	for key := range f.values {
+		if !known(key) {
+			unknown = append(unknown, key)
+		}
+	}
+	for key := range f.sections {
+		if !known(key) {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	sort.Strings(unknown)
+	return errors.New(fmt.Sprintf("unknown settings in config file %s: %s", f.Path, strings.Join(unknown, ", ")))
+}
+
+// Has reports whether the configuration file sets the flag key.
+func (f *File) Has(key string) bool {
+	_, ok := f.values[key]
+	return ok
+}
+
+// Decode decodes a structured section of the configuration file into out,
+// rejecting fields out does not have. Missing sections leave out untouched.
+func (f *File) Decode(section string, out interface{}) error {
+	if f == nil {
+		return nil
+	}
+	node, ok := f.sections[section]
+	if !ok {
+		return nil
+	}
+	// Only a decoder can reject unknown fields, so the section is encoded
+	// again to decode it with one.
+	data, err := yaml.Marshal(node)
+	if err != nil {
+		return errors.Wrapf(err, "failed to decode %s section of config file %s", section, f.Path)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err = decoder.Decode(out)
+	if err != nil {
+		return errors.Wrapf(err, "failed to decode %s section of config file %s", section, f.Path)
+	}
+	return nil
+}
+
+// Apply fills every flag that was not set on the command line, first from its
+// PTG_* environment variable and then from the configuration file. This gives
+// a precedence of flags, environment, config file and finally flag defaults.
+// file may be nil when no configuration file is in use.
+func Apply(flags *pflag.FlagSet, file *File) error {
+	var applyErr error
+	flags.VisitAll(func(flag *pflag.Flag) {
+		if applyErr != nil || flag.Changed {
+			return
+		}
+
+		if value, ok := os.LookupEnv(EnvName(flag.Name)); ok {
+			err := flag.Value.Set(value)
+			if err != nil {
+				applyErr = errors.Wrapf(err, "invalid value for %s", EnvName(flag.Name))
+			}
+			return
+		}
+
+		if file == nil {
+			return
+		}
+		values, ok := file.values[flag.Name]
+		if !ok {
+			return
+		}
+		for _, value := range values {
+			err := flag.Value.Set(value)
+			if err != nil {
+				applyErr = errors.Wrapf(err, "invalid value for %s in config file %s", flag.Name, file.Path)
+				return
+			}
+		}
+	})
+	return applyErr
+}
+
+// EnvName returns the environment variable for a flag, for example
+// pelotonUsername becomes PTG_PELOTON_USERNAME and state-file PTG_STATE_FILE.
+func EnvName(flag string) string {
+	runes := []rune(flag)
+	name := strings.Builder{}
+	for i, r := range runes {
+		if r == '-' {
+			name.WriteRune('_')
+			continue
+		}
+		if i > 0 && unicode.IsUpper(r) {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				name.WriteRune('_')
+			}
+		}
+		name.WriteRune(unicode.ToUpper(r))
+	}
+	return EnvPrefix + name.String()
+}
+
+// WriteFile writes data to path with permissions only the current user can
+// read, refusing to replace an existing file unless force is set.
+func WriteFile(path string, data []byte, force bool) error {
+	if !force {
+		_, err := os.Stat(path)
+		if err == nil {
+			return errors.New(fmt.Sprintf("%s already exists, use --force to overwrite it", path))
+		}
+	}
+
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return errors.Wrap(err, "failed to create config directory")
+	}
+	err = ioutil.WriteFile(path, data, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to write config file")
+	}
+	return nil
+}
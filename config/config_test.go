@@ -0,0 +1,217 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+func TestEnvName(t *testing.T) {
+	tests := []struct {
+		flag string
+		want string
+	}{
+		{"pelotonUsername", "PTG_PELOTON_USERNAME"},
+		{"garminPasswordFrom", "PTG_GARMIN_PASSWORD_FROM"},
+		{"state-file", "PTG_STATE_FILE"},
+		{"upload-workers", "PTG_UPLOAD_WORKERS"},
+		{"since", "PTG_SINCE"},
+		{"workoutCount", "PTG_WORKOUT_COUNT"},
+		{"writeTCXToDisk", "PTG_WRITE_TCX_TO_DISK"},
+		{"PelotonAPIHost", "PTG_PELOTON_API_HOST"},
+		{"PrettyLogging", "PTG_PRETTY_LOGGING"},
+		{"max2Retries", "PTG_MAX2_RETRIES"},
+	}
+	for _, test := range tests {
+		if got := EnvName(test.flag); got != test.want {
+			t.Errorf("EnvName(%q) = %s, want %s", test.flag, got, test.want)
+		}
+	}
+}
+
+// writeConfig writes a config file to a temporary directory and loads it.
+func writeConfig(t *testing.T, contents string) *File {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	file, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestApplyPrecedence(t *testing.T) {
+	file := writeConfig(t, `
+flag: file
+env: file
+file: file
+disciplines:
+  - cycling
+  - running
+`)
+	t.Setenv("PTG_FLAG", "env")
+	t.Setenv("PTG_ENV", "env")
+
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	values := map[string]*string{}
+	for _, name := range []string{"flag", "env", "file", "default"} {
+		values[name] = flags.String(name, "default", "")
+	}
+	disciplines := flags.StringSlice("disciplines", []string{"yoga"}, "")
+	if err := flags.Parse([]string{"--flag", "flag"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Apply(flags, file); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"flag": "flag", "env": "env", "file": "file", "default": "default"}
+	for name, value := range values {
+		if *value != want[name] {
+			t.Errorf("%s = %s, want %s", name, *value, want[name])
+		}
+	}
+	if !reflect.DeepEqual(*disciplines, []string{"cycling", "running"}) {
+		t.Errorf("disciplines = %v, want the config file list", *disciplines)
+	}
+}
+
+func TestApplyWithoutFile(t *testing.T) {
+	t.Setenv("PTG_WORKERS", "4")
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	workers := flags.Int("workers", 2, "")
+	other := flags.Int("other", 1, "")
+	if err := Apply(flags, nil); err != nil {
+		t.Fatal(err)
+	}
+	if *workers != 4 || *other != 1 {
+		t.Errorf("workers %d and other %d, want 4 and 1", *workers, *other)
+	}
+
+	t.Setenv("PTG_WORKERS", "four")
+	if err := Apply(flags, nil); err == nil || !strings.Contains(err.Error(), "PTG_WORKERS") {
+		t.Errorf("applying an invalid environment value returned %v, want an error naming PTG_WORKERS", err)
+	}
+}
+
+func TestApplyInvalidFileValue(t *testing.T) {
+	file := writeConfig(t, "workers: many\n")
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.Int("workers", 2, "")
+	if err := Apply(flags, file); err == nil || !strings.Contains(err.Error(), "workers") {
+		t.Errorf("applying an invalid config file value returned %v, want an error naming workers", err)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	file := writeConfig(t, `
+# A comment.
+garminEmail: me@example.com
+disciplines: [cycling, running]
+name-templates:
+  cycling: "{{.Title}}"
+gear:
+  - discipline: cycling
+    gear: abc
+`)
+	if !file.Has("garminEmail") || !file.Has("disciplines") || file.Has("garminPassword") {
+		t.Errorf("Has reports the wrong settings for %+v", file.values)
+	}
+	if file.Has("gear") || file.Has("name-templates") {
+		t.Errorf("sections are reported as flag settings")
+	}
+
+	templates := map[string]string{}
+	if err := file.Decode("name-templates", &templates); err != nil {
+		t.Fatal(err)
+	}
+	if templates["cycling"] != "{{.Title}}" {
+		t.Errorf("name-templates = %v", templates)
+	}
+	type gear struct {
+		Discipline string `yaml:"discipline"`
+		Gear       string `yaml:"gear"`
+	}
+	mappings := []gear{}
+	if err := file.Decode("gear", &mappings); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(mappings, []gear{{Discipline: "cycling", Gear: "abc"}}) {
+		t.Errorf("gear = %+v", mappings)
+	}
+	// A missing section leaves the value as it was.
+	missing := map[string]string{"kept": "yes"}
+	if err := file.Decode("missing", &missing); err != nil || missing["kept"] != "yes" {
+		t.Errorf("decoding a missing section gave %v, %v", missing, err)
+	}
+}
+
+func TestLoadEmptyAndInvalid(t *testing.T) {
+	file := writeConfig(t, "# Nothing set yet.\n")
+	if len(file.values) != 0 || len(file.sections) != 0 {
+		t.Errorf("empty config file has settings %+v", file)
+	}
+
+	tests := map[string]string{
+		"not a mapping":       "- cycling\n",
+		"list of mappings":    "disciplines:\n  - [cycling]\n",
+		"invalid yaml":        "garminEmail: [\n",
+		"missing config file": "",
+	}
+	for name, contents := range tests {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		if contents != "" {
+			if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := Load(path); err == nil {
+			t.Errorf("%s: loading succeeded, want an error", name)
+		}
+	}
+}
+
+func TestDecodeUnknownField(t *testing.T) {
+	file := writeConfig(t, `
+gear:
+  - discipline: cycling
+    gaer: abc
+`)
+	mappings := []struct {
+		Discipline string `yaml:"discipline"`
+		Gear       string `yaml:"gear"`
+	}{}
+	if err := file.Decode("gear", &mappings); err == nil || !strings.Contains(err.Error(), "gaer") {
+		t.Errorf("decoding an unknown field returned %v, want an error naming gaer", err)
+	}
+}
+
+func TestCheckKeys(t *testing.T) {
+	file := writeConfig(t, `
+garminEmail: me@example.com
+garmin_pasword: secret
+gear:
+  - gear: abc
+gaer:
+  - gear: abc
+`)
+	known := func(key string) bool {
+		return key == "garminEmail" || key == "garminPassword" || key == "gear"
+	}
+	err := file.CheckKeys(known)
+	if err == nil || !strings.Contains(err.Error(), "gaer, garmin_pasword") {
+		t.Errorf("CheckKeys returned %v, want an error naming gaer and garmin_pasword", err)
+	}
+
+	file = writeConfig(t, "garminEmail: me@example.com\n")
+	if err := file.CheckKeys(known); err != nil {
+		t.Errorf("CheckKeys of known settings returned %v", err)
+	}
+}
@@ -0,0 +1,204 @@
+package credentials
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// Provider supplies a secret such as a password. String describes where the
+// secret comes from and never includes the secret itself, so it is safe to log.
+type Provider interface {
+	Secret() (string, error)
+	String() string
+}
+
+// Options configures how providers are built from a spec.
+type Options struct {
+	// VaultIdentity is the age identity file used to decrypt age vaults.
+	VaultIdentity string
+}
+
+// Parse builds a provider from a spec of the form scheme:value. Supported
+// schemes are:
+//
+//	env:NAME             the environment variable NAME
+//	file:PATH            the contents of PATH, which only its owner may access
+//	cmd:COMMAND          the output of COMMAND, for example "pass show peloton"
+//	vault:PATH#KEY       KEY from an age (.age) or GPG (.gpg, .asc) encrypted
+//	                     YAML or JSON file of key value pairs
+func Parse(spec string, opts Options) (Provider, error) {
+	scheme, value := splitSpec(spec)
+	if value == "" {
+		return nil, errors.New(fmt.Sprintf("invalid secret source %q, expected scheme:value", scheme))
+	}
+
+	switch scheme {
+	case "env":
+		return EnvProvider{Name: value}, nil
+	case "file":
+		return FileProvider{Path: value}, nil
+	case "cmd":
+		return CommandProvider{Command: value}, nil
+	case "vault":
+		hash := strings.LastIndex(value, "#")
+		if hash < 1 || hash == len(value)-1 {
+			return nil, errors.New(fmt.Sprintf("invalid vault secret source %q, expected vault:PATH#KEY", value))
+		}
+		return VaultProvider{Path: value[:hash], Key: value[hash+1:], Identity: opts.VaultIdentity}, nil
+	}
+	return nil, errors.New(fmt.Sprintf("unsupported secret source %q, use env, file, cmd or vault", scheme))
+}
+
+func splitSpec(spec string) (string, string) {
+	colon := strings.Index(spec, ":")
+	if colon < 0 {
+		return spec, ""
+	}
+	return spec[:colon], spec[colon+1:]
+}
+
+// EnvProvider reads a secret from an environment variable.
+type EnvProvider struct {
+	Name string
+}
+
+func (p EnvProvider) Secret() (string, error) {
+	secret, ok := os.LookupEnv(p.Name)
+	if !ok || secret == "" {
+		return "", errors.New(fmt.Sprintf("environment variable %s is not set", p.Name))
+	}
+	return secret, nil
+}
+
+func (p EnvProvider) String() string {
+	return "environment variable " + p.Name
+}
+
+// FileProvider reads a secret from a file that only its owner can read.
+type FileProvider struct {
+	Path string
+}
+
+func (p FileProvider) Secret() (string, error) {
+	err := CheckPermissions(p.Path)
+	if err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadFile(p.Path)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read secret file")
+	}
+	return nonEmpty(strings.TrimRight(string(data), "\r\n"), p)
+}
+
+func (p FileProvider) String() string {
+	return "file " + p.Path
+}
+
+// CommandProvider runs a command and uses its output as the secret, which
+// suits password managers such as pass or the 1Password CLI.
+type CommandProvider struct {
+	Command string
+}
+
+func (p CommandProvider) Secret() (string, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", p.Command)
+	} else {
+		cmd = exec.Command("sh", "-c", p.Command)
+	}
+	// The output of a failed command is left out of the error, as it may
+	// hold the secret and errors end up in logs.
+	out, err := cmd.Output()
+	if err != nil {
+		return "", errors.Wrap(err, "secret command failed")
+	}
+	return nonEmpty(strings.TrimRight(string(out), "\r\n"), p)
+}
+
+func (p CommandProvider) String() string {
+	return "command " + p.Command
+}
+
+// VaultProvider reads a key from an encrypted file of key value pairs. Files
+// ending in .age are decrypted with the age CLI, .gpg and .asc with gpg.
+type VaultProvider struct {
+	Path     string
+	Key      string
+	Identity string
+}
+
+func (p VaultProvider) Secret() (string, error) {
+	err := CheckPermissions(p.Path)
+	if err != nil {
+		return "", err
+	}
+
+	var cmd *exec.Cmd
+	switch strings.ToLower(filepath.Ext(p.Path)) {
+	case ".age":
+		if p.Identity == "" {
+			return "", errors.New("an age identity file is required to decrypt " + p.Path)
+		}
+		cmd = exec.Command("age", "--decrypt", "--identity", p.Identity, p.Path)
+	case ".gpg", ".asc":
+		cmd = exec.Command("gpg", "--quiet", "--batch", "--decrypt", p.Path)
+	default:
+		return "", errors.New(fmt.Sprintf("unknown vault type for %s, expected a .age, .gpg or .asc file", p.Path))
+	}
+	stderr := bytes.Buffer{}
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to decrypt vault %s: %s", p.Path, strings.TrimSpace(stderr.String()))
+	}
+
+	vault := map[string]string{}
+	err = yaml.Unmarshal(out, &vault)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("failed to decode vault %s, it must contain key value pairs", p.Path))
+	}
+	secret, ok := vault[p.Key]
+	if !ok {
+		return "", errors.New(fmt.Sprintf("key %s not found in vault %s", p.Key, p.Path))
+	}
+	return nonEmpty(secret, p)
+}
+
+func (p VaultProvider) String() string {
+	return fmt.Sprintf("vault %s key %s", p.Path, p.Key)
+}
+
+// CheckPermissions refuses files holding secrets that anyone but their owner
+// can access, as ssh does with private keys.
+// Windows does not use POSIX permissions so the check is skipped there.
+func CheckPermissions(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return errors.Wrap(err, "failed to read secret file")
+	}
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return errors.New(fmt.Sprintf("%s can be accessed by other users, restrict it with chmod 600", path))
+	}
+	return nil
+}
+
+func nonEmpty(secret string, p Provider) (string, error) {
+	if secret == "" {
+		return "", errors.New(fmt.Sprintf("secret from %s is empty", p))
+	}
+	return secret, nil
+}
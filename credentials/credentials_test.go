@@ -0,0 +1,167 @@
+package credentials
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		spec string
+		want Provider
+	}{
+		{"env:PELOTON_PASSWORD", EnvProvider{Name: "PELOTON_PASSWORD"}},
+		{"file:/home/joe/.password", FileProvider{Path: "/home/joe/.password"}},
+		{"cmd:pass show peloton", CommandProvider{Command: "pass show peloton"}},
+		{"vault:/home/joe/secrets.age#garmin", VaultProvider{Path: "/home/joe/secrets.age", Key: "garmin", Identity: "key.txt"}},
+		// The key follows the last #, so paths may contain one.
+		{"vault:/home/joe/#1.gpg#peloton", VaultProvider{Path: "/home/joe/#1.gpg", Key: "peloton", Identity: "key.txt"}},
+	}
+	for _, test := range tests {
+		got, err := Parse(test.spec, Options{VaultIdentity: "key.txt"})
+		if err != nil {
+			t.Errorf("Parse(%q): %v", test.spec, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("Parse(%q) = %#v, want %#v", test.spec, got, test.want)
+		}
+	}
+
+	for _, spec := range []string{"", "env", "env:", "ftp:host", "vault:/secrets.age", "vault:/secrets.age#", "vault:#key"} {
+		if _, err := Parse(spec, Options{}); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", spec)
+		}
+	}
+}
+
+func TestEnvProvider(t *testing.T) {
+	t.Setenv("PTG_TEST_SECRET", "hunter2")
+	t.Setenv("PTG_TEST_EMPTY", "")
+	secret, err := EnvProvider{Name: "PTG_TEST_SECRET"}.Secret()
+	if err != nil || secret != "hunter2" {
+		t.Errorf("Secret() = %q, %v, want hunter2", secret, err)
+	}
+	for _, name := range []string{"PTG_TEST_EMPTY", "PTG_TEST_UNSET"} {
+		if _, err := (EnvProvider{Name: name}).Secret(); err == nil {
+			t.Errorf("reading %s succeeded, want an error", name)
+		}
+	}
+}
+
+// writeSecret writes contents to a file with mode and returns its path.
+func writeSecret(t *testing.T, contents string, mode os.FileMode) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := ioutil.WriteFile(path, []byte(contents), mode); err != nil {
+		t.Fatal(err)
+	}
+	// The umask may have dropped bits from mode.
+	if err := os.Chmod(path, mode); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCheckPermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("windows does not use POSIX permissions")
+	}
+	tests := []struct {
+		mode    os.FileMode
+		wantErr bool
+	}{
+		{0600, false},
+		{0400, false},
+		{0700, false},
+		{0640, true},
+		{0604, true},
+		{0620, true},
+		{0610, true},
+		{0644, true},
+		{0666, true},
+	}
+	for _, test := range tests {
+		err := CheckPermissions(writeSecret(t, "secret", test.mode))
+		if (err != nil) != test.wantErr {
+			t.Errorf("CheckPermissions of a %#o file returned %v, want an error %v", test.mode, err, test.wantErr)
+		}
+	}
+	if err := CheckPermissions(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Errorf("CheckPermissions of a missing file succeeded, want an error")
+	}
+}
+
+func TestFileProvider(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("windows does not use POSIX permissions")
+	}
+	secret, err := FileProvider{Path: writeSecret(t, "hunter2\r\n", 0600)}.Secret()
+	if err != nil || secret != "hunter2" {
+		t.Errorf("Secret() = %q, %v, want hunter2", secret, err)
+	}
+	tests := map[string]string{
+		"group readable": writeSecret(t, "hunter2", 0640),
+		"empty":          writeSecret(t, "\n", 0600),
+		"missing":        filepath.Join(t.TempDir(), "missing"),
+	}
+	for name, path := range tests {
+		if _, err := (FileProvider{Path: path}).Secret(); err == nil {
+			t.Errorf("%s: reading the secret succeeded, want an error", name)
+		}
+	}
+}
+
+func TestCommandProvider(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the commands are written for sh")
+	}
+	secret, err := CommandProvider{Command: "printf 'hunter2\\n'"}.Secret()
+	if err != nil || secret != "hunter2" {
+		t.Errorf("Secret() = %q, %v, want hunter2", secret, err)
+	}
+
+	_, err = CommandProvider{Command: "echo hunter2; echo hunter2 >&2; exit 1"}.Secret()
+	if err == nil {
+		t.Fatalf("a failing command succeeded, want an error")
+	}
+	if strings.Contains(err.Error(), "hunter2") {
+		t.Errorf("the error of a failing command includes its output: %v", err)
+	}
+
+	if _, err := (CommandProvider{Command: "true"}).Secret(); err == nil {
+		t.Errorf("a command without output succeeded, want an error")
+	}
+}
+
+func TestVaultProvider(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("windows does not use POSIX permissions")
+	}
+	dir := t.TempDir()
+	vault := func(name string, mode os.FileMode) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte("encrypted"), mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	tests := map[string]VaultProvider{
+		"unknown vault type":   {Path: vault("secrets.zip", 0600), Key: "garmin"},
+		"age without identity": {Path: vault("secrets.age", 0600), Key: "garmin"},
+		"group readable":       {Path: vault("shared.gpg", 0640), Key: "garmin"},
+		"missing":              {Path: filepath.Join(dir, "missing.gpg"), Key: "garmin"},
+	}
+	for name, provider := range tests {
+		if _, err := provider.Secret(); err == nil {
+			t.Errorf("%s: reading the secret succeeded, want an error", name)
+		}
+	}
+}
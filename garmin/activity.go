@@ -0,0 +1,223 @@
+package garmin
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/mdordoy/peloton-to-garmin/peloton"
+	"github.com/pkg/errors"
+)
+
+// sportMapping describes how a Peloton fitness discipline is represented in
+// the TCX and FIT formats and in Garmin Connect. Disciplines without distance are uploaded as timed
+// activities, keeping heart rate and output but dropping speed and distance.
+type sportMapping struct {
+	TCXSport    string
+	FitSport    fitSport
+	FitSubSport fitSubSport
+	Distance    bool
+	// GarminType is the Garmin Connect activity type key set after upload.
+	GarminType string
+	// FTP is set when the output is measured against the cycling FTP.
+	FTP bool
+}
+
+var sportMappings = map[string]sportMapping{
+	"cycling":         {TCXSport: "Biking", FitSport: fitSportCycling, FitSubSport: fitSubSportIndoorCycling, Distance: true, GarminType: "indoor_cycling", FTP: true},
+	"running":         {TCXSport: "Running", FitSport: fitSportRunning, FitSubSport: fitSubSportTreadmill, Distance: true, GarminType: "treadmill_running"},
+	"walking":         {TCXSport: "Other", FitSport: fitSportWalking, FitSubSport: fitSubSportIndoorWalking, Distance: true, GarminType: "walking"},
+	"caesar":          {TCXSport: "Other", FitSport: fitSportRowing, FitSubSport: fitSubSportIndoorRowing, Distance: true, GarminType: "indoor_rowing"},
+	"strength":        {TCXSport: "Other", FitSport: fitSportTraining, FitSubSport: fitSubSportStrengthTraining, GarminType: "strength_training"},
+	"yoga":            {TCXSport: "Other", FitSport: fitSportTraining, FitSubSport: fitSubSportYoga, GarminType: "yoga"},
+	"meditation":      {TCXSport: "Other", FitSport: fitSportTraining, FitSubSport: fitSubSportBreathing, GarminType: "breathwork"},
+	"cardio":          {TCXSport: "Other", FitSport: fitSportTraining, FitSubSport: fitSubSportCardioTraining, GarminType: "indoor_cardio"},
+	"circuit":         {TCXSport: "Other", FitSport: fitSportTraining, FitSubSport: fitSubSportCardioTraining, GarminType: "indoor_cardio"},
+	"bike_bootcamp":   {TCXSport: "Other", FitSport: fitSportTraining, FitSubSport: fitSubSportCardioTraining, GarminType: "indoor_cardio"},
+	"caesar_bootcamp": {TCXSport: "Other", FitSport: fitSportTraining, FitSubSport: fitSubSportCardioTraining, GarminType: "indoor_cardio"},
+	"stretching":      {TCXSport: "Other", FitSport: fitSportTraining, FitSubSport: fitSubSportFlexibilityTraining, GarminType: "stretching"},
+}
+
+// SupportedDisciplines returns the Peloton fitness disciplines that can be
+// converted.
+func SupportedDisciplines() []string {
+	disciplines := make([]string, 0, len(sportMappings))
+	for discipline := range sportMappings {
+		disciplines = append(disciplines, discipline)
+	}
+	sort.Strings(disciplines)
+	return disciplines
+}
+
+// Supported reports whether workouts of a Peloton fitness discipline can be
+// converted.
+func Supported(discipline string) bool {
+	_, ok := sportMappings[discipline]
+	return ok
+}
+
+// ActivityTypeKey returns the Garmin Connect activity type, such as
+// indoor_cycling, for a Peloton fitness discipline.
+func ActivityTypeKey(discipline string) string {
+	return sportMappings[discipline].GarminType
+}
+
+// activity is the format independent representation of a Peloton workout
+// that both the TCX and FIT encoders are built from.
+type activity struct {
+	ID           string
+	Title        string
+	Sport        sportMapping
+	StartTime    time.Time
+	EndTime      time.Time
+	Distance     float64
+	Calories     int
+	AverageSpeed float64
+	AverageWatts int
+	Summary      metricDetails
+	Samples      []sample
+	HasIncline   bool
+	// Ascent is the total climb in meters.
+	Ascent   float64
+	Laps     []lap
+	Training training
+	// Created is when the file was created, the start unless
+	// ConvertOptions.Created is set.
+	Created time.Time
+}
+
+// sample is a single data point of a workout.
+type sample struct {
+	Time      time.Time
+	HeartRate int
+	Cadence   int
+	Watts     int
+	Speed     float64
+	Distance  float64
+	Grade     float64
+	// Altitude is the height climbed from the start in meters, worked out
+	// from the distance covered at each incline.
+	Altitude float64
+}
+
+func newActivity(workoutDetail peloton.WorkoutDetail, opts ConvertOptions) (activity, error) {
+	sport, ok := sportMappings[workoutDetail.FitnessDiscipline]
+	if !ok {
+		return activity{}, errors.New(fmt.Sprintf("Unsupported sport activity: %s", workoutDetail.FitnessDiscipline))
+	}
+
+	location := opts.Location
+	if location == nil {
+		location = time.Local
+	}
+	workoutDetail.StartTime = workoutDetail.StartTime.In(location)
+	workoutDetail.EndTime = workoutDetail.EndTime.In(location)
+
+	act := activity{
+		ID:           workoutDetail.ID,
+		Title:        workoutDetail.Title,
+		Sport:        sport,
+		StartTime:    workoutDetail.StartTime,
+		EndTime:      workoutDetail.EndTime,
+		Distance:     getDistance(workoutDetail.Summaries),
+		Calories:     getTotalCalories(workoutDetail.Summaries),
+		AverageSpeed: getAverageSpeed(workoutDetail.AverageSummaries),
+		AverageWatts: getAverageWatts(workoutDetail.AverageSummaries),
+		Summary:      getSummaryMetricData(workoutDetail.Metrics),
+		Samples:      parseSamples(&workoutDetail),
+		HasIncline:   hasMetric(workoutDetail.Metrics, slugIncline),
+		Ascent:       getElevation(workoutDetail.Summaries),
+		Created:      workoutDetail.StartTime,
+	}
+	if !opts.Created.IsZero() {
+		act.Created = opts.Created
+	}
+	if len(opts.HeartRate) > 0 {
+		samples := append([]sample(nil), act.Samples...)
+		if mergeHeartRate(samples, opts.HeartRate) > 0 {
+			act.Samples = samples
+			act.Summary.AvarageHeartRate, act.Summary.MaxHeartRate = heartRateSummary(samples)
+		}
+	}
+	act.Training = newTraining(act.Samples, time.Duration(workoutDetail.DataGranularityInSeconds)*time.Second, sport, opts.Athlete)
+
+	if !sport.Distance {
+		act.Distance = 0
+		act.AverageSpeed = 0
+		act.Summary.MaximumSpeed = 0
+		act.Ascent = 0
+		for i := range act.Samples {
+			act.Samples[i].Speed = 0
+			act.Samples[i].Distance = 0
+			act.Samples[i].Altitude = 0
+		}
+		act.Laps = buildLaps(act, workoutDetail, opts.Laps)
+		return act, nil
+	}
+
+	// Treadmill pace and rower split pace are not reported as speed, so fill
+	// in the speed summary from the samples.
+	for _, s := range act.Samples {
+		if s.Speed > act.Summary.MaximumSpeed {
+			act.Summary.MaximumSpeed = s.Speed
+		}
+	}
+	if act.AverageSpeed == 0 && act.TotalTimeSeconds() > 0 {
+		act.AverageSpeed = act.Distance / act.TotalTimeSeconds()
+	}
+	act.Laps = buildLaps(act, workoutDetail, opts.Laps)
+
+	return act, nil
+}
+
+// TotalTimeSeconds returns the elapsed time of the activity.
+func (a activity) TotalTimeSeconds() float64 {
+	return a.EndTime.Sub(a.StartTime).Seconds()
+}
+
+func parseSamples(data *peloton.WorkoutDetail) []sample {
+	samples := []sample{}
+	distance, altitude := 0.0, 0.0
+	for index, offset := range data.SecondsSincePedalingStart {
+		s := sample{}
+		// Samples are timed from the offsets Peloton reports rather than
+		// their position, so pauses in the workout are kept.
+		s.Time = data.StartTime.Add(time.Second * time.Duration(offset))
+		for _, data := range data.Metrics {
+			if index >= len(data.Values) {
+				continue
+			}
+			value := data.Values[index]
+			switch data.Slug {
+			case slugOutput:
+				s.Watts = int(value)
+			case slugCadence, slugStrokeRate:
+				s.Cadence = int(value)
+			case slugHeartRate:
+				s.HeartRate = int(value)
+			case slugIncline:
+				s.Grade = value
+			}
+			// Speed is preferred over pace when a workout reports both.
+			if isSpeedSlug(data.Slug) && (s.Speed == 0 || data.Slug == slugSpeed) {
+				s.Speed = toMetersPerSecond(value, data.Slug, data.DisplayUnit)
+			}
+		}
+		// Each value covers the interval before it, so a pause does not add
+		// distance.
+		if index != 0 {
+			covered := s.Speed * float64(data.DataGranularityInSeconds)
+			distance += covered
+			altitude += covered * s.Grade / 100
+		}
+		s.Distance = distance
+		s.Altitude = altitude
+		samples = append(samples, s)
+	}
+	return samples
+}
+
+func hasMetric(data []peloton.WorkoutDetailMetrics, slug string) bool {
+	_, ok := findMetric(data, slug)
+	return ok
+}
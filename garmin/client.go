@@ -1,12 +1,307 @@
 package garmin
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
 	connect "github.com/abrander/garmin-connect"
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 )
 
-func NewClient(username, password string, logger zerolog.Logger) *connect.Client {
+// Client is a Garmin Connect client that keeps its session in a cache file
+// between runs, so the full SSO login only happens when the session expires.
+type Client struct {
+	*connect.Client
+	// mu guards the session, which the library reads and renews in place,
+	// along with the session cache and the cached lookups below.
+	mu sync.Mutex
+	// authMu serializes logging in, so workers that find the session missing
+	// or expired at the same time share one new session.
+	authMu sync.Mutex
+	// signIn performs the SSO login, connect.Client.Authenticate outside of
+	// tests.
+	signIn       func() error
+	sessionCache string
+	saved        cachedSession
+	logger       zerolog.Logger
+	// httpClient sends the requests the library has no method for.
+	httpClient *http.Client
+	// activityTypes caches the Garmin Connect activity types.
+	activityTypes []connect.ActivityType
+}
+
+// cachedSession is the Garmin Connect session persisted between runs. A
+// session ID is only valid together with the load balancer ID it came with.
+type cachedSession struct {
+	Email          string `json:"email"`
+	SessionID      string `json:"sessionId"`
+	LoadBalancerID string `json:"loadBalancerId"`
+}
+
+// DefaultSessionPath returns the session cache location inside the users
+// config directory.
+func DefaultSessionPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to find user config directory")
+	}
+	return filepath.Join(dir, "peloton-to-garmin", "garmin-session.json"), nil
+}
+
+// NewClient returns a Garmin Connect client, restoring the session cached at
+// sessionCache when it belongs to username. An empty sessionCache disables
+// caching.
+func NewClient(username, password, sessionCache string, logger zerolog.Logger) *Client {
+
+	options := []connect.Option{
+		connect.Credentials(username, password),
+		connect.AutoRenewSession(true),
+	}
+
+	client := &Client{sessionCache: sessionCache, logger: logger, httpClient: newHTTPClient()}
+	if session, ok := loadSession(sessionCache, username); ok {
+		logger.Debug().Str("Session Cache", sessionCache).Msg("Reusing cached Garmin session")
+		options = append(options, connect.SessionID(session.SessionID), connect.LoadBalancerID(session.LoadBalancerID))
+		client.saved = session
+	}
+	client.Client = connect.NewClient(options...)
+	client.signIn = client.Client.Authenticate
+	return client
+}
+
+// activitiesPageSize is the number of activities requested per page.
+const activitiesPageSize = 50
+
+// ActivitiesSince returns the users activities that started at or after
+// since, newest first.
+func (c *Client) ActivitiesSince(since time.Time) ([]connect.Activity, error) {
+	err := c.authenticate()
+	if err != nil {
+		return nil, err
+	}
+	activities := []connect.Activity{}
+	for start := 0; ; start += activitiesPageSize {
+		page := []connect.Activity{}
+		err := c.call(func() (err error) {
+			page, err = c.Client.Activities("", start, activitiesPageSize)
+			return err
+		})
+		if err != nil {
+			return activities, errors.Wrap(err, "failed to list garmin activities")
+		}
+		for _, activity := range page {
+			if activity.StartGMT.Before(since) {
+				return activities, nil
+			}
+			activities = append(activities, activity)
+		}
+		if len(page) < activitiesPageSize {
+			return activities, nil
+		}
+	}
+}
+
+// ExportActivity downloads an activity, see connect.Client.ExportActivity.
+func (c *Client) ExportActivity(activityID int, w io.Writer, format connect.ActivityFormat) error {
+	return c.call(func() error {
+		return c.Client.ExportActivity(activityID, w, format)
+	})
+}
+
+// ActivityExists reports whether an activity is still in Garmin Connect.
+func (c *Client) ActivityExists(activityID int) (bool, error) {
+	err := c.call(func() error {
+		_, err := c.Client.Activity(activityID)
+		return err
+	})
+	if errors.Is(err, connect.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to get garmin activity %d", activityID)
+	}
+	return true, nil
+}
+
+// DeleteActivity deletes an activity. Unlike connect.Client.DeleteActivity it
+// reports a delete Garmin refused, and connect.ErrNotFound for an activity
+// that no longer exists.
+func (c *Client) DeleteActivity(activityID int) error {
+	resp, err := c.send(http.MethodDelete, fmt.Sprintf(activityURL, activityID), "", nil)
+	if err != nil {
+		return errors.Wrapf(err, "failed to delete activity %d", activityID)
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return connect.ErrNotFound
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return errors.New(fmt.Sprintf("failed to delete activity %d: %d: %s", activityID, resp.StatusCode, http.StatusText(resp.StatusCode)))
+	}
+	return nil
+}
+
+// authenticate logs in when no session has been established yet. Most calls
+// establish a session on demand, but some refuse to run without one.
+func (c *Client) authenticate() error {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+	if c.session().SessionID != "" {
+		return nil
+	}
+	return c.login()
+}
+
+// reauthenticate logs in again after Garmin replaced the session in rejected,
+// returning the new session. Only one login runs at a time, and a worker that
+// waited for another's login reuses its session.
+func (c *Client) reauthenticate(rejected cachedSession) (cachedSession, error) {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+	current := c.session()
+	if current.SessionID != "" && current.SessionID != rejected.SessionID {
+		return current, nil
+	}
+	err := c.login()
+	if err != nil {
+		return cachedSession{}, err
+	}
+	return c.session(), nil
+}
+
+// login replaces the session with a new one. The caller holds authMu.
+func (c *Client) login() error {
+	c.mu.Lock()
+	c.SetOptions(connect.SessionID(""), connect.LoadBalancerID(""))
+	err := c.signIn()
+	c.mu.Unlock()
+	if err != nil {
+		return errors.Wrap(err, "failed to authenticate to garmin")
+	}
+	c.persist(nil)
+	return nil
+}
+
+// session returns the current session.
+func (c *Client) session() cachedSession {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return cachedSession{Email: c.Email, SessionID: c.SessionID, LoadBalancerID: c.LoadBalancerID}
+}
+
+// call makes a request through the library, holding the session while it
+// runs as the library renews an expired session in place, and keeps the
+// session cache in line with the result.
+func (c *Client) call(request func() error) error {
+	c.mu.Lock()
+	err := request()
+	c.mu.Unlock()
+	c.persist(err)
+	return err
+}
+
+// Overlap returns the fraction of start to end covered by a Garmin activity.
+func Overlap(activity connect.Activity, start, end time.Time) float64 {
+	if !end.After(start) {
+		return 0
+	}
+	duration := activity.ElapsedDuration
+	if activity.Duration > duration {
+		duration = activity.Duration
+	}
+	activityStart := activity.StartGMT.Time
+	activityEnd := activityStart.Add(time.Duration(duration * float64(time.Second)))
+
+	if activityStart.Before(start) {
+		activityStart = start
+	}
+	if activityEnd.After(end) {
+		activityEnd = end
+	}
+	if !activityEnd.After(activityStart) {
+		return 0
+	}
+	return activityEnd.Sub(activityStart).Seconds() / end.Sub(start).Seconds()
+}
+
+// persist keeps the session cache in line with the client after a request.
+// The library renews expired sessions itself, so a changed session is written
+// out, and a rejected request drops the cache so the next run logs in again.
+func (c *Client) persist(err error) {
+	if c.sessionCache == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if forbidden(err) {
+		c.logger.Debug().Err(err).Msg("Garmin rejected the request, clearing the cached session")
+		c.saved = cachedSession{}
+		removeErr := os.Remove(c.sessionCache)
+		if removeErr != nil && !os.IsNotExist(removeErr) {
+			c.logger.Warn().Err(removeErr).Msg("Failed to clear the cached Garmin session")
+		}
+		return
+	}
+
+	session := cachedSession{Email: c.Email, SessionID: c.SessionID, LoadBalancerID: c.LoadBalancerID}
+	if session.SessionID == "" || session == c.saved {
+		return
+	}
+	saveErr := saveSession(c.sessionCache, session)
+	if saveErr != nil {
+		c.logger.Warn().Err(saveErr).Msg("Failed to cache the Garmin session")
+		return
+	}
+	c.saved = session
+}
+
+// forbidden reports whether err is a 403 from Garmin Connect, which the library
+// returns as ErrForbidden or as the message Garmin sent with it. Garmin also
+// responds this way to sessions that are no longer valid.
+func forbidden(err error) bool {
+	var connectErr connect.Error
+	if !errors.As(err, &connectErr) {
+		return false
+	}
+	switch connectErr {
+	case connect.ErrNotFound, connect.ErrBadRequest, connect.ErrNoCredentials, connect.ErrWrongCredentials, connect.ErrUnknownFormat:
+		return false
+	}
+	return true
+}
+
+func loadSession(path, email string) (cachedSession, bool) {
+	session := cachedSession{}
+	if path == "" {
+		return session, false
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return session, false
+	}
+	err = json.Unmarshal(data, &session)
+	if err != nil || session.Email != email || session.SessionID == "" {
+		return cachedSession{}, false
+	}
+	return session, true
+}
 
-	opt := connect.Credentials(username, password)
-	return connect.NewClient(opt)
+func saveSession(path string, session cachedSession) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode session")
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return errors.Wrap(err, "failed to create session cache directory")
+	}
+	return errors.Wrap(ioutil.WriteFile(path, data, 0600), "failed to write session cache")
 }
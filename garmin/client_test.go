@@ -0,0 +1,92 @@
+package garmin
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	connect "github.com/abrander/garmin-connect"
+	"github.com/rs/zerolog"
+)
+
+func TestSendReauthenticatesOnce(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(sessionCookieName)
+		if err != nil || cookie.Value == "expired" {
+			// Garmin hands out a new session instead of accepting an
+			// expired one.
+			http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Value: "anonymous"})
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, "{}")
+	}))
+	defer server.Close()
+
+	cache := filepath.Join(t.TempDir(), "session.json")
+	client := NewClient("user@example.com", "password", cache, zerolog.Nop())
+	client.httpClient = server.Client()
+	client.SetOptions(connect.SessionID("expired"), connect.LoadBalancerID("lb"))
+	var logins int32
+	client.signIn = func() error {
+		n := atomic.AddInt32(&logins, 1)
+		client.SetOptions(connect.SessionID(fmt.Sprintf("session-%d", n)), connect.LoadBalancerID("lb"))
+		return nil
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.send(http.MethodGet, server.URL+"/activity", "", nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("status %d, want 200", resp.StatusCode)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if logins != 1 {
+		t.Errorf("logged in %d times, want 1", logins)
+	}
+	session, ok := loadSession(cache, "user@example.com")
+	if !ok || session.SessionID != "session-1" || session.LoadBalancerID != "lb" {
+		t.Errorf("cached session %+v, want session-1", session)
+	}
+}
+
+func TestAuthenticateOnce(t *testing.T) {
+	client := NewClient("user@example.com", "password", "", zerolog.Nop())
+	var logins int32
+	client.signIn = func() error {
+		atomic.AddInt32(&logins, 1)
+		client.SetOptions(connect.SessionID("session"))
+		return nil
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := client.authenticate(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if logins != 1 {
+		t.Errorf("logged in %d times, want 1", logins)
+	}
+}
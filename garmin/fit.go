@@ -0,0 +1,240 @@
+package garmin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The FIT protocol is documented in the Garmin FIT SDK. Only the subset needed
+// to describe an indoor activity is implemented here.
+
+const (
+	fitHeaderSize      = 14
+	fitProtocolVersion = 0x20
+	fitProfileVersion  = 2132
+
+	fitDefinitionHeader = 0x40
+	fitMaxLocalMessages = 16
+)
+
+// fitEpoch is the start of FIT time, 1989-12-31T00:00:00Z.
+var fitEpoch = time.Date(1989, time.December, 31, 0, 0, 0, 0, time.UTC)
+
+type fitBaseType byte
+
+const (
+	fitEnum    fitBaseType = 0x00
+	fitUint8   fitBaseType = 0x02
+	fitString  fitBaseType = 0x07
+	fitSint16  fitBaseType = 0x83
+	fitUint16  fitBaseType = 0x84
+	fitUint32  fitBaseType = 0x86
+	fitUint32z fitBaseType = 0x8C
+)
+
+// size returns the size in bytes of a single value of the base type.
+func (b fitBaseType) size() int {
+	switch b {
+	case fitEnum, fitUint8:
+		return 1
+	case fitSint16, fitUint16:
+		return 2
+	case fitUint32, fitUint32z:
+		return 4
+	}
+	return 1
+}
+
+// invalid returns the value the FIT protocol uses to mark a field as not set.
+func (b fitBaseType) invalid() int64 {
+	switch b {
+	case fitEnum, fitUint8:
+		return 0xFF
+	case fitSint16:
+		return 0x7FFF
+	case fitUint16:
+		return 0xFFFF
+	case fitUint32:
+		return 0xFFFFFFFF
+	}
+	return 0
+}
+
+// max returns the largest valid value of the base type.
+func (b fitBaseType) max() int64 {
+	if b == fitUint32z {
+		return 0xFFFFFFFF
+	}
+	return b.invalid() - 1
+}
+
+// min returns the smallest valid value of the base type.
+func (b fitBaseType) min() int64 {
+	if b == fitSint16 {
+		return -0x7FFF
+	}
+	return 0
+}
+
+type fitMesgNum uint16
+
+const (
+	fitMesgFileID     fitMesgNum = 0
+	fitMesgSport      fitMesgNum = 12
+	fitMesgSession    fitMesgNum = 18
+	fitMesgLap        fitMesgNum = 19
+	fitMesgRecord     fitMesgNum = 20
+	fitMesgEvent      fitMesgNum = 21
+	fitMesgDeviceInfo fitMesgNum = 23
+	fitMesgActivity   fitMesgNum = 34
+)
+
+type fitField struct {
+	Num      byte
+	BaseType fitBaseType
+	Value    int64
+	Str      string
+}
+
+// size returns the number of bytes the field takes up in a data message.
+func (f fitField) size() int {
+	if f.BaseType == fitString {
+		return len(f.Str) + 1
+	}
+	return f.BaseType.size()
+}
+
+// fitValue builds a numeric field, marking it invalid when the value does not
+// fit into the base type.
+func fitValue(num byte, baseType fitBaseType, value int64) fitField {
+	if value < baseType.min() || value > baseType.max() {
+		value = baseType.invalid()
+	}
+	return fitField{Num: num, BaseType: baseType, Value: value}
+}
+
+// fitOptional builds a numeric field that is only valid when value is positive.
+func fitOptional(num byte, baseType fitBaseType, value int64) fitField {
+	if value <= 0 {
+		return fitField{Num: num, BaseType: baseType, Value: baseType.invalid()}
+	}
+	return fitValue(num, baseType, value)
+}
+
+func fitScaled(num byte, baseType fitBaseType, value, scale float64) fitField {
+	return fitValue(num, baseType, int64(math.Round(value*scale)))
+}
+
+func fitStringValue(num byte, value string) fitField {
+	return fitField{Num: num, BaseType: fitString, Str: value}
+}
+
+func fitTimestamp(num byte, t time.Time) fitField {
+	return fitValue(num, fitUint32, int64(t.Sub(fitEpoch)/time.Second))
+}
+
+type fitMessage struct {
+	Num    fitMesgNum
+	Fields []fitField
+}
+
+// fitEncoder writes FIT messages, emitting definition messages whenever the
+// layout of a message changes.
+type fitEncoder struct {
+	data        bytes.Buffer
+	definitions [fitMaxLocalMessages]string
+	localTypes  map[fitMesgNum]byte
+}
+
+func newFitEncoder() *fitEncoder {
+	return &fitEncoder{localTypes: map[fitMesgNum]byte{}}
+}
+
+func (e *fitEncoder) writeMessage(msg fitMessage) error {
+	local, ok := e.localTypes[msg.Num]
+	if !ok {
+		if len(e.localTypes) >= fitMaxLocalMessages {
+			return errors.New(fmt.Sprintf("too many fit message types, unable to encode message %d", msg.Num))
+		}
+		local = byte(len(e.localTypes))
+		e.localTypes[msg.Num] = local
+	}
+
+	definition := e.definition(local, msg)
+	if e.definitions[local] != string(definition) {
+		e.data.Write(definition)
+		e.definitions[local] = string(definition)
+	}
+
+	e.data.WriteByte(local)
+	for _, field := range msg.Fields {
+		switch field.BaseType {
+		case fitString:
+			e.data.WriteString(field.Str)
+			e.data.WriteByte(0)
+		case fitEnum, fitUint8:
+			e.data.WriteByte(byte(field.Value))
+		case fitSint16, fitUint16:
+			_ = binary.Write(&e.data, binary.LittleEndian, uint16(field.Value))
+		case fitUint32, fitUint32z:
+			_ = binary.Write(&e.data, binary.LittleEndian, uint32(field.Value))
+		}
+	}
+	return nil
+}
+
+func (e *fitEncoder) definition(local byte, msg fitMessage) []byte {
+	def := bytes.Buffer{}
+	def.WriteByte(fitDefinitionHeader | local)
+	// Reserved byte followed by the architecture, 0 is little endian.
+	def.WriteByte(0)
+	def.WriteByte(0)
+	_ = binary.Write(&def, binary.LittleEndian, uint16(msg.Num))
+	def.WriteByte(byte(len(msg.Fields)))
+	for _, field := range msg.Fields {
+		def.WriteByte(field.Num)
+		def.WriteByte(byte(field.size()))
+		def.WriteByte(byte(field.BaseType))
+	}
+	return def.Bytes()
+}
+
+// bytes returns the complete FIT file, including the file header and CRC.
+func (e *fitEncoder) bytes() []byte {
+	header := bytes.Buffer{}
+	header.WriteByte(fitHeaderSize)
+	header.WriteByte(fitProtocolVersion)
+	_ = binary.Write(&header, binary.LittleEndian, uint16(fitProfileVersion))
+	_ = binary.Write(&header, binary.LittleEndian, uint32(e.data.Len()))
+	header.WriteString(".FIT")
+	_ = binary.Write(&header, binary.LittleEndian, fitCRC(0, header.Bytes()))
+
+	file := append(header.Bytes(), e.data.Bytes()...)
+	out := bytes.NewBuffer(file)
+	_ = binary.Write(out, binary.LittleEndian, fitCRC(0, file))
+	return out.Bytes()
+}
+
+var fitCRCTable = [16]uint16{
+	0x0000, 0xCC01, 0xD801, 0x1400, 0xF001, 0x3C00, 0x2800, 0xE401,
+	0xA001, 0x6C00, 0x7800, 0xB401, 0x5000, 0x9C01, 0x8801, 0x4400,
+}
+
+// fitCRC calculates the FIT flavour of CRC-16 over data.
+func fitCRC(crc uint16, data []byte) uint16 {
+	for _, b := range data {
+		tmp := fitCRCTable[crc&0xF]
+		crc = (crc >> 4) & 0x0FFF
+		crc = crc ^ tmp ^ fitCRCTable[b&0xF]
+
+		tmp = fitCRCTable[crc&0xF]
+		crc = (crc >> 4) & 0x0FFF
+		crc = crc ^ tmp ^ fitCRCTable[(b>>4)&0xF]
+	}
+	return crc
+}
@@ -0,0 +1,315 @@
+package garmin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// decodeFIT decodes a FIT file written by fitEncoder back into messages,
+// checking the header and file CRCs. It returns the messages and the number
+// of definition messages.
+func decodeFIT(t *testing.T, file []byte) ([]fitMessage, int) {
+	t.Helper()
+	if len(file) < fitHeaderSize+2 {
+		t.Fatalf("fit file is %d bytes, too short for a header and crc", len(file))
+	}
+	if got := fitCRC(0, file[:12]); got != binary.LittleEndian.Uint16(file[12:14]) {
+		t.Fatalf("header crc %#04x, want %#04x", binary.LittleEndian.Uint16(file[12:14]), got)
+	}
+	if got := fitCRC(0, file[:len(file)-2]); got != binary.LittleEndian.Uint16(file[len(file)-2:]) {
+		t.Fatalf("file crc %#04x, want %#04x", binary.LittleEndian.Uint16(file[len(file)-2:]), got)
+	}
+
+	type fieldDefinition struct {
+		Num      byte
+		Size     int
+		BaseType fitBaseType
+	}
+	type definition struct {
+		Num    fitMesgNum
+		Fields []fieldDefinition
+	}
+	definitions := map[byte]definition{}
+	definitionCount := 0
+	messages := []fitMessage{}
+	r := bytes.NewReader(file[fitHeaderSize : len(file)-2])
+	read := func(n int) []byte {
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			t.Fatalf("truncated fit data: %v", err)
+		}
+		return buf
+	}
+	for r.Len() > 0 {
+		header := read(1)[0]
+		if header&0x80 != 0 || header&0x20 != 0 {
+			t.Fatalf("unexpected fit record header %#02x", header)
+		}
+		if header&fitDefinitionHeader != 0 {
+			fixed := read(5)
+			if fixed[1] != 0 {
+				t.Fatalf("definition is not little endian")
+			}
+			def := definition{Num: fitMesgNum(binary.LittleEndian.Uint16(fixed[2:4]))}
+			for i := 0; i < int(fixed[4]); i++ {
+				field := read(3)
+				def.Fields = append(def.Fields, fieldDefinition{Num: field[0], Size: int(field[1]), BaseType: fitBaseType(field[2])})
+			}
+			definitions[header&0x0F] = def
+			definitionCount++
+			continue
+		}
+
+		def, ok := definitions[header&0x0F]
+		if !ok {
+			t.Fatalf("data message uses undefined local message %d", header&0x0F)
+		}
+		msg := fitMessage{Num: def.Num}
+		for _, fieldDef := range def.Fields {
+			value := read(fieldDef.Size)
+			field := fitField{Num: fieldDef.Num, BaseType: fieldDef.BaseType}
+			switch fieldDef.BaseType {
+			case fitString:
+				field.Str = string(bytes.TrimRight(value, "\x00"))
+			case fitEnum, fitUint8:
+				field.Value = int64(value[0])
+			case fitSint16:
+				field.Value = int64(int16(binary.LittleEndian.Uint16(value)))
+			case fitUint16:
+				field.Value = int64(binary.LittleEndian.Uint16(value))
+			case fitUint32, fitUint32z:
+				field.Value = int64(binary.LittleEndian.Uint32(value))
+			default:
+				t.Fatalf("unexpected base type %#02x", fieldDef.BaseType)
+			}
+			if fieldDef.Size != field.size() {
+				t.Fatalf("field %d of message %d is %d bytes, want %d", fieldDef.Num, def.Num, fieldDef.Size, field.size())
+			}
+			msg.Fields = append(msg.Fields, field)
+		}
+		messages = append(messages, msg)
+	}
+	return messages, definitionCount
+}
+
+func encodeFIT(t *testing.T, messages []fitMessage) []byte {
+	t.Helper()
+	enc := newFitEncoder()
+	for _, msg := range messages {
+		if err := enc.writeMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return enc.bytes()
+}
+
+func TestFitCRC(t *testing.T) {
+	// The FIT CRC is CRC-16/ARC, whose check value is 0xBB3D.
+	if got := fitCRC(0, []byte("123456789")); got != 0xBB3D {
+		t.Errorf("fitCRC(123456789) = %#04x, want 0xbb3d", got)
+	}
+	if got := fitCRC(0, nil); got != 0 {
+		t.Errorf("fitCRC(nil) = %#04x, want 0", got)
+	}
+	// The CRC can be continued over data split in two.
+	if got := fitCRC(fitCRC(0, []byte("1234")), []byte("56789")); got != 0xBB3D {
+		t.Errorf("continued fitCRC = %#04x, want 0xbb3d", got)
+	}
+}
+
+func TestFitHeader(t *testing.T) {
+	file := encodeFIT(t, []fitMessage{
+		{Num: fitMesgEvent, Fields: []fitField{fitTimestamp(253, fitStart), fitValue(0, fitEnum, fitEventTimer)}},
+	})
+	// Header, definition (6 bytes and 3 per field), data message and CRC.
+	dataSize := 6 + 2*3 + 1 + 4 + 1
+	if len(file) != fitHeaderSize+dataSize+2 {
+		t.Fatalf("file is %d bytes, want %d", len(file), fitHeaderSize+dataSize+2)
+	}
+	if file[0] != fitHeaderSize {
+		t.Errorf("header size %d, want %d", file[0], fitHeaderSize)
+	}
+	if file[1] != fitProtocolVersion {
+		t.Errorf("protocol version %#02x, want %#02x", file[1], fitProtocolVersion)
+	}
+	if got := binary.LittleEndian.Uint16(file[2:4]); got != fitProfileVersion {
+		t.Errorf("profile version %d, want %d", got, fitProfileVersion)
+	}
+	if got := binary.LittleEndian.Uint32(file[4:8]); got != uint32(dataSize) {
+		t.Errorf("data size %d, want %d", got, dataSize)
+	}
+	if string(file[8:12]) != ".FIT" {
+		t.Errorf("data type %q, want .FIT", file[8:12])
+	}
+	// A CRC over data followed by its own CRC is zero.
+	if got := fitCRC(0, file); got != 0 {
+		t.Errorf("crc over the whole file %#04x, want 0", got)
+	}
+}
+
+func TestFitValues(t *testing.T) {
+	tests := []struct {
+		field fitField
+		want  int64
+	}{
+		{fitValue(0, fitUint8, 255), 0xFF},
+		{fitValue(0, fitUint8, 254), 254},
+		{fitValue(0, fitUint8, -1), 0xFF},
+		{fitValue(0, fitUint16, 70000), 0xFFFF},
+		{fitValue(0, fitSint16, -150), -150},
+		{fitValue(0, fitSint16, -40000), 0x7FFF},
+		{fitOptional(0, fitUint8, 0), 0xFF},
+		{fitOptional(0, fitUint16, 180), 180},
+		{fitScaled(0, fitUint32, 1.2345, 1000), 1235},
+		{fitTimestamp(0, fitEpoch.Add(1000*time.Second)), 1000},
+	}
+	for _, test := range tests {
+		if test.field.Value != test.want {
+			t.Errorf("%#02x field value %d, want %d", test.field.BaseType, test.field.Value, test.want)
+		}
+	}
+}
+
+// fitStart is the start of the activities the FIT tests encode.
+var fitStart = time.Date(2024, 3, 1, 7, 0, 0, 0, time.UTC)
+
+// fitTestActivity returns a ten minute ride with a sample every minute,
+// covering 200 m a minute. The first sample has no heart rate.
+func fitTestActivity() activity {
+	act := activity{
+		ID:           "workout",
+		Sport:        sportMappings["cycling"],
+		StartTime:    fitStart,
+		EndTime:      fitStart.Add(10 * time.Minute),
+		Distance:     2000,
+		Calories:     100,
+		AverageSpeed: 2000.0 / 600,
+	}
+	for i := 0; i < 10; i++ {
+		s := sample{
+			Time:     fitStart.Add(time.Duration(i) * time.Minute),
+			Distance: float64(i * 200),
+			Speed:    3.3333,
+			Watts:    100 + i*10,
+			Cadence:  80,
+		}
+		if i > 0 {
+			s.HeartRate = 120 + i
+		}
+		act.Samples = append(act.Samples, s)
+	}
+	return act
+}
+
+func TestFitRoundTrip(t *testing.T) {
+	act := fitTestActivity()
+	act.Sport = sportMappings["running"]
+	act.HasIncline = true
+	for i := range act.Samples {
+		act.Samples[i].Grade = float64(i-5) / 2
+	}
+	act.Laps = fillLaps(act, []lap{
+		{StartTime: act.StartTime, EndTime: act.StartTime.Add(5 * time.Minute), Intensity: lapWarmup, Trigger: lapTriggerTime},
+		{StartTime: act.StartTime.Add(5 * time.Minute), EndTime: act.EndTime, Intensity: lapActive, Trigger: lapTriggerManual},
+	})
+	messages := fitActivityMessages(act)
+	decoded, definitions := decodeFIT(t, encodeFIT(t, messages))
+	if !reflect.DeepEqual(decoded, messages) {
+		t.Fatalf("decoded messages differ from the encoded ones\ngot  %+v\nwant %+v", decoded, messages)
+	}
+	// file_id, device_info, sport, event, record, lap, session and
+	// activity each need one definition, as the second event, the records
+	// and the laps reuse theirs.
+	if definitions != 8 {
+		t.Errorf("%d definition messages, want 8", definitions)
+	}
+
+	byNum := map[fitMesgNum][]fitMessage{}
+	for _, msg := range decoded {
+		byNum[msg.Num] = append(byNum[msg.Num], msg)
+	}
+	value := func(msg fitMessage, num byte) int64 {
+		for _, field := range msg.Fields {
+			if field.Num == num {
+				return field.Value
+			}
+		}
+		t.Fatalf("message %d has no field %d", msg.Num, num)
+		return 0
+	}
+
+	records := byNum[fitMesgRecord]
+	if len(records) != 10 {
+		t.Fatalf("%d records, want 10", len(records))
+	}
+	wantRecord := map[byte]int64{
+		253: int64(fitStart.Add(3*time.Minute).Sub(fitEpoch) / time.Second),
+		3:   123,
+		4:   80,
+		5:   60000,
+		6:   3333,
+		7:   130,
+		9:   -100,
+	}
+	for num, want := range wantRecord {
+		if got := value(records[3], num); got != want {
+			t.Errorf("record field %d = %d, want %d", num, got, want)
+		}
+	}
+	if got := value(records[0], 3); got != 0xFF {
+		t.Errorf("record without heart rate has %d, want invalid", got)
+	}
+
+	laps := byNum[fitMesgLap]
+	if len(laps) != 2 {
+		t.Fatalf("%d laps, want 2", len(laps))
+	}
+	wantLaps := []map[byte]int64{
+		{254: 0, 2: int64(fitStart.Sub(fitEpoch) / time.Second), 7: 300000, 9: 80000, 11: 50, 19: 120, 20: 140, 23: int64(lapWarmup), 24: int64(lapTriggerTime)},
+		{254: 1, 2: int64(fitStart.Add(5*time.Minute).Sub(fitEpoch) / time.Second), 7: 300000, 9: 120000, 11: 50, 19: 170, 20: 190, 23: int64(lapActive), 24: int64(lapTriggerManual)},
+	}
+	for i, want := range wantLaps {
+		for num, wantValue := range want {
+			if got := value(laps[i], num); got != wantValue {
+				t.Errorf("lap %d field %d = %d, want %d", i, num, got, wantValue)
+			}
+		}
+	}
+
+	sessions := byNum[fitMesgSession]
+	if len(sessions) != 1 {
+		t.Fatalf("%d sessions, want 1", len(sessions))
+	}
+	wantSession := map[byte]int64{
+		253: int64(act.EndTime.Sub(fitEpoch) / time.Second),
+		2:   int64(act.StartTime.Sub(fitEpoch) / time.Second),
+		5:   int64(fitSportRunning),
+		6:   int64(fitSubSportTreadmill),
+		7:   600000,
+		9:   200000,
+		11:  100,
+		14:  3333,
+		26:  2,
+	}
+	for num, want := range wantSession {
+		if got := value(sessions[0], num); got != want {
+			t.Errorf("session field %d = %d, want %d", num, got, want)
+		}
+	}
+}
+
+func TestFitTooManyMessageTypes(t *testing.T) {
+	enc := newFitEncoder()
+	for i := 0; i < fitMaxLocalMessages; i++ {
+		if err := enc.writeMessage(fitMessage{Num: fitMesgNum(100 + i)}); err != nil {
+			t.Fatalf("message type %d: %v", i, err)
+		}
+	}
+	if err := enc.writeMessage(fitMessage{Num: 200}); err == nil {
+		t.Errorf("writing a 17th message type succeeded, want an error")
+	}
+}
@@ -0,0 +1,101 @@
+package garmin
+
+import (
+	connect "github.com/abrander/garmin-connect"
+	"github.com/pkg/errors"
+)
+
+// profileID returns the users Garmin profile ID, which the gear service
+// needs. The library only knows it after a full login, so it is looked up
+// when the session came from the cache.
+func (c *Client) profileID() (int64, error) {
+	err := c.authenticate()
+	if err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	profile := c.Profile
+	c.mu.Unlock()
+	if profile != nil {
+		return profile.ProfileID, nil
+	}
+	err = c.call(func() (err error) {
+		profile, err = c.SocialProfile("")
+		return err
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to get garmin profile")
+	}
+	c.mu.Lock()
+	c.Profile = profile
+	c.mu.Unlock()
+	return profile.ProfileID, nil
+}
+
+// Gear returns the users gear, see connect.Client.Gear.
+func (c *Client) Gear() ([]connect.Gear, error) {
+	profileID, err := c.profileID()
+	if err != nil {
+		return nil, err
+	}
+	gear := []connect.Gear{}
+	err = c.call(func() (err error) {
+		gear, err = c.Client.Gear(profileID)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list garmin gear")
+	}
+	return gear, nil
+}
+
+// GearForActivity returns the gear linked to an activity, see
+// connect.Client.GearForActivity.
+func (c *Client) GearForActivity(activityID int) ([]connect.Gear, error) {
+	profileID, err := c.profileID()
+	if err != nil {
+		return nil, err
+	}
+	gear := []connect.Gear{}
+	err = c.call(func() (err error) {
+		gear, err = c.Client.GearForActivity(profileID, activityID)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get gear of activity %d", activityID)
+	}
+	return gear, nil
+}
+
+// GearLink links gear to an activity, see connect.Client.GearLink.
+func (c *Client) GearLink(uuid string, activityID int) error {
+	err := c.call(func() error {
+		return c.Client.GearLink(uuid, activityID)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to link gear %s to activity %d", uuid, activityID)
+	}
+	return nil
+}
+
+// GearUnlink removes gear from an activity, see connect.Client.GearUnlink.
+func (c *Client) GearUnlink(uuid string, activityID int) error {
+	err := c.call(func() error {
+		return c.Client.GearUnlink(uuid, activityID)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to unlink gear %s from activity %d", uuid, activityID)
+	}
+	return nil
+}
+
+// GearName returns the name Garmin Connect shows for gear.
+func GearName(gear connect.Gear) string {
+	switch {
+	case gear.DisplayName != "":
+		return gear.DisplayName
+	case gear.CustomMakeModel != "":
+		return gear.CustomMakeModel
+	}
+	return gear.GearMakeName + " " + gear.GearModelName
+}
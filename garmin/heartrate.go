@@ -0,0 +1,268 @@
+package garmin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	connect "github.com/abrander/garmin-connect"
+	"github.com/pkg/errors"
+)
+
+// heartRateMaxGap is how far a heart rate reading may be from a sample and
+// still be used for it. Watches record every second or, in smart recording
+// mode, every few seconds.
+const heartRateMaxGap = 5 * time.Second
+
+// HeartRateSample is a heart rate reading recorded by another device, such
+// as a Garmin watch.
+type HeartRateSample struct {
+	Time      time.Time
+	HeartRate int
+}
+
+// ReadHeartRate returns the heart rate readings of an activity exported from
+// Garmin Connect as FIT or TCX, in time order.
+func ReadHeartRate(data []byte, format connect.ActivityFormat) ([]HeartRateSample, error) {
+	var samples []HeartRateSample
+	var err error
+	switch format {
+	case connect.ActivityFormatFIT:
+		samples, err = readFITHeartRate(data)
+	case connect.ActivityFormatTCX:
+		samples, err = readTCXHeartRate(data)
+	default:
+		return nil, errors.New(fmt.Sprintf("Unsupported activity format: %s", format.Extension()))
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].Time.Before(samples[j].Time)
+	})
+	return samples, nil
+}
+
+// tcxHeartRate holds only the trackpoint times and heart rates of a TCX
+// document.
+type tcxHeartRate struct {
+	Trackpoints []struct {
+		Time      string `xml:"Time"`
+		HeartRate int    `xml:"HeartRateBpm>Value"`
+	} `xml:"Activities>Activity>Lap>Track>Trackpoint"`
+}
+
+func readTCXHeartRate(data []byte) ([]HeartRateSample, error) {
+	doc := tcxHeartRate{}
+	err := xml.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse tcx activity")
+	}
+	samples := []HeartRateSample{}
+	for _, trackpoint := range doc.Trackpoints {
+		if trackpoint.HeartRate <= 0 {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, trackpoint.Time)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid tcx trackpoint time %q", trackpoint.Time)
+		}
+		samples = append(samples, HeartRateSample{Time: t, HeartRate: trackpoint.HeartRate})
+	}
+	return samples, nil
+}
+
+// fitDefinition is the layout of a local message type in a FIT file being
+// read.
+type fitDefinition struct {
+	Num       fitMesgNum
+	BigEndian bool
+	Fields    []fitFieldDefinition
+	// DevSize is the number of bytes taken up by developer fields, which
+	// are skipped.
+	DevSize int
+}
+
+type fitFieldDefinition struct {
+	Num  byte
+	Size int
+}
+
+// Record message fields read from watch activities.
+const (
+	fitFieldTimestamp = 253
+	fitFieldHeartRate = 3
+)
+
+// readFITHeartRate reads the heart rate of every record message in a FIT
+// file. Only the framing of the protocol is decoded, every other message and
+// field is skipped.
+func readFITHeartRate(data []byte) ([]HeartRateSample, error) {
+	if len(data) < 12 || string(data[8:12]) != ".FIT" {
+		return nil, errors.New("not a fit file")
+	}
+	headerSize := int(data[0])
+	end := headerSize + int(binary.LittleEndian.Uint32(data[4:8]))
+	if headerSize < 12 || end > len(data) {
+		return nil, errors.New("truncated fit file")
+	}
+
+	samples := []HeartRateSample{}
+	definitions := map[byte]fitDefinition{}
+	lastTimestamp := uint32(0)
+	r := bytes.NewReader(data[headerSize:end])
+	for r.Len() > 0 {
+		header, _ := r.ReadByte()
+		var local byte
+		compressedTimestamp := false
+		switch {
+		case header&0x80 != 0:
+			// Compressed timestamp headers carry a 5 bit offset from the
+			// previous timestamp.
+			local = (header >> 5) & 0x03
+			offset := uint32(header & 0x1F)
+			timestamp := lastTimestamp&^0x1F + offset
+			if offset < lastTimestamp&0x1F {
+				timestamp += 0x20
+			}
+			lastTimestamp = timestamp
+			compressedTimestamp = true
+		case header&fitDefinitionHeader != 0:
+			definition, err := readFITDefinition(r, header&0x20 != 0)
+			if err != nil {
+				return nil, err
+			}
+			definitions[header&0x0F] = definition
+			continue
+		default:
+			local = header & 0x0F
+		}
+
+		definition, ok := definitions[local]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("fit data message uses undefined local message %d", local))
+		}
+		heartRate := 0
+		for _, field := range definition.Fields {
+			value := make([]byte, field.Size)
+			if _, err := io.ReadFull(r, value); err != nil {
+				return nil, errors.New("truncated fit file")
+			}
+			switch {
+			case field.Num == fitFieldTimestamp && field.Size == 4:
+				order := binary.ByteOrder(binary.LittleEndian)
+				if definition.BigEndian {
+					order = binary.BigEndian
+				}
+				lastTimestamp = order.Uint32(value)
+			case field.Num == fitFieldHeartRate && field.Size == 1 && definition.Num == fitMesgRecord:
+				if value[0] != byte(fitUint8.invalid()) {
+					heartRate = int(value[0])
+				}
+			}
+		}
+		if _, err := io.CopyN(io.Discard, r, int64(definition.DevSize)); err != nil {
+			return nil, errors.New("truncated fit file")
+		}
+		if definition.Num == fitMesgRecord && heartRate > 0 && (compressedTimestamp || lastTimestamp > 0) {
+			samples = append(samples, HeartRateSample{
+				Time:      fitEpoch.Add(time.Duration(lastTimestamp) * time.Second),
+				HeartRate: heartRate,
+			})
+		}
+	}
+	return samples, nil
+}
+
+func readFITDefinition(r *bytes.Reader, developerFields bool) (fitDefinition, error) {
+	definition := fitDefinition{}
+	fixed := make([]byte, 5)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return definition, errors.New("truncated fit file")
+	}
+	definition.BigEndian = fixed[1] == 1
+	if definition.BigEndian {
+		definition.Num = fitMesgNum(binary.BigEndian.Uint16(fixed[2:4]))
+	} else {
+		definition.Num = fitMesgNum(binary.LittleEndian.Uint16(fixed[2:4]))
+	}
+	fields := make([]byte, 3*int(fixed[4]))
+	if _, err := io.ReadFull(r, fields); err != nil {
+		return definition, errors.New("truncated fit file")
+	}
+	for i := 0; i < len(fields); i += 3 {
+		definition.Fields = append(definition.Fields, fitFieldDefinition{Num: fields[i], Size: int(fields[i+1])})
+	}
+	if !developerFields {
+		return definition, nil
+	}
+	count, err := r.ReadByte()
+	if err != nil {
+		return definition, errors.New("truncated fit file")
+	}
+	devFields := make([]byte, 3*int(count))
+	if _, err := io.ReadFull(r, devFields); err != nil {
+		return definition, errors.New("truncated fit file")
+	}
+	for i := 0; i < len(devFields); i += 3 {
+		definition.DevSize += int(devFields[i+1])
+	}
+	return definition, nil
+}
+
+// mergeHeartRate replaces the heart rate of each sample with the nearest
+// reading from heartRate, which must be in time order. Samples without a
+// reading close enough are left without heart rate. It returns the number of
+// samples given a reading.
+func mergeHeartRate(samples []sample, heartRate []HeartRateSample) int {
+	merged := 0
+	next := 0
+	for i := range samples {
+		for next < len(heartRate) && heartRate[next].Time.Before(samples[i].Time) {
+			next++
+		}
+		best, bestGap := 0, heartRateMaxGap+1
+		for _, j := range []int{next - 1, next} {
+			if j < 0 || j >= len(heartRate) {
+				continue
+			}
+			gap := heartRate[j].Time.Sub(samples[i].Time)
+			if gap < 0 {
+				gap = -gap
+			}
+			if gap < bestGap {
+				best, bestGap = heartRate[j].HeartRate, gap
+			}
+		}
+		samples[i].HeartRate = 0
+		if bestGap <= heartRateMaxGap {
+			samples[i].HeartRate = best
+			merged++
+		}
+	}
+	return merged
+}
+
+// heartRateSummary returns the average and maximum heart rate of samples
+// with a reading.
+func heartRateSummary(samples []sample) (int, int) {
+	total, count, max := 0, 0, 0
+	for _, s := range samples {
+		if s.HeartRate <= 0 {
+			continue
+		}
+		total += s.HeartRate
+		count++
+		if s.HeartRate > max {
+			max = s.HeartRate
+		}
+	}
+	if count == 0 {
+		return 0, 0
+	}
+	return (total + count/2) / count, max
+}
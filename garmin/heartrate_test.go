@@ -0,0 +1,320 @@
+package garmin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+
+	connect "github.com/abrander/garmin-connect"
+)
+
+// fitFile wraps hand built FIT records in a header and CRC.
+func fitFile(records ...[]byte) []byte {
+	enc := newFitEncoder()
+	enc.data.Write(bytes.Join(records, nil))
+	return enc.bytes()
+}
+
+// fitRecordDefinition defines a record message as local message local with
+// the given (field number, size) pairs, in the byte order given.
+func fitRecordDefinition(local byte, order binary.ByteOrder, fields ...[2]byte) []byte {
+	def := []byte{fitDefinitionHeader | local, 0, 0, 0, 0, byte(len(fields))}
+	if order == binary.BigEndian {
+		def[2] = 1
+	}
+	order.PutUint16(def[3:5], uint16(fitMesgRecord))
+	for _, field := range fields {
+		def = append(def, field[0], field[1], byte(fitUint8))
+	}
+	return def
+}
+
+func fitUint32Bytes(order binary.ByteOrder, value uint32) []byte {
+	b := make([]byte, 4)
+	order.PutUint32(b, value)
+	return b
+}
+
+func fitTime(seconds int) time.Time {
+	return fitEpoch.Add(time.Duration(seconds) * time.Second)
+}
+
+var (
+	fitTimestampField = [2]byte{fitFieldTimestamp, 4}
+	fitHeartRateField = [2]byte{fitFieldHeartRate, 1}
+)
+
+func TestReadFITHeartRate(t *testing.T) {
+	le := binary.LittleEndian
+	be := binary.BigEndian
+	tests := []struct {
+		name    string
+		records [][]byte
+		want    []HeartRateSample
+	}{
+		{
+			name: "little endian",
+			records: [][]byte{
+				fitRecordDefinition(0, le, fitTimestampField, fitHeartRateField),
+				append(append([]byte{0}, fitUint32Bytes(le, 1000)...), 120),
+				append(append([]byte{0}, fitUint32Bytes(le, 1001)...), 121),
+			},
+			want: []HeartRateSample{{fitTime(1000), 120}, {fitTime(1001), 121}},
+		},
+		{
+			name: "big endian",
+			records: [][]byte{
+				fitRecordDefinition(0, be, fitTimestampField, fitHeartRateField),
+				append(append([]byte{0}, fitUint32Bytes(be, 1000)...), 130),
+			},
+			want: []HeartRateSample{{fitTime(1000), 130}},
+		},
+		{
+			name: "compressed timestamps",
+			records: [][]byte{
+				fitRecordDefinition(0, le, fitTimestampField, fitHeartRateField),
+				fitRecordDefinition(1, le, fitHeartRateField),
+				// 1000 is 8 past a multiple of 32.
+				append(append([]byte{0}, fitUint32Bytes(le, 1000)...), 100),
+				{0x80 | 1<<5 | 10, 101},
+				// An offset below the last one rolls over to the next 32
+				// seconds.
+				{0x80 | 1<<5 | 2, 102},
+				{0x80 | 1<<5 | 2, 103},
+			},
+			want: []HeartRateSample{{fitTime(1000), 100}, {fitTime(1002), 101}, {fitTime(1026), 102}, {fitTime(1026), 103}},
+		},
+		{
+			name: "developer fields",
+			records: [][]byte{
+				append(
+					[]byte{fitDefinitionHeader | 0x20, 0, 0, byte(fitMesgRecord), 0, 2, fitFieldTimestamp, 4, byte(fitUint32), fitFieldHeartRate, 1, byte(fitUint8)},
+					// Two developer fields of 2 and 3 bytes.
+					2, 0, 2, 0, 1, 3, 0,
+				),
+				append(append([]byte{0}, fitUint32Bytes(le, 1000)...), 140, 0xAA, 0xBB, 0xCC, 0xDD, 0xEE),
+				append(append([]byte{0}, fitUint32Bytes(le, 1001)...), 141, 0xAA, 0xBB, 0xCC, 0xDD, 0xEE),
+			},
+			want: []HeartRateSample{{fitTime(1000), 140}, {fitTime(1001), 141}},
+		},
+		{
+			name: "other messages and invalid readings",
+			records: [][]byte{
+				// An event message also has a heart rate sized field 3.
+				{fitDefinitionHeader, 0, 0, byte(fitMesgEvent), 0, 2, fitFieldTimestamp, 4, byte(fitUint32), 3, 1, byte(fitUint8)},
+				append(append([]byte{0}, fitUint32Bytes(le, 999)...), 90),
+				fitRecordDefinition(0, le, fitTimestampField, fitHeartRateField),
+				append(append([]byte{0}, fitUint32Bytes(le, 1000)...), 0xFF),
+				append(append([]byte{0}, fitUint32Bytes(le, 1001)...), 0),
+				append(append([]byte{0}, fitUint32Bytes(le, 1002)...), 150),
+			},
+			want: []HeartRateSample{{fitTime(1002), 150}},
+		},
+	}
+	for _, test := range tests {
+		got, err := readFITHeartRate(fitFile(test.records...))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestReadFITHeartRateErrors(t *testing.T) {
+	valid := fitFile(
+		fitRecordDefinition(0, binary.LittleEndian, fitTimestampField, fitHeartRateField),
+		append(append([]byte{0}, fitUint32Bytes(binary.LittleEndian, 1000)...), 120),
+	)
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"not fit", []byte("<TrainingCenterDatabase/>")},
+		{"truncated", valid[:len(valid)-6]},
+		{"undefined local message", fitFile([]byte{0, 1, 2, 3, 4, 5})},
+		{"truncated message", fitFile(fitRecordDefinition(0, binary.LittleEndian, fitTimestampField, fitHeartRateField), []byte{0, 1, 2})},
+	}
+	for _, test := range tests {
+		if _, err := readFITHeartRate(test.data); err == nil {
+			t.Errorf("%s: read succeeded, want an error", test.name)
+		}
+	}
+}
+
+func TestReadHeartRateTCX(t *testing.T) {
+	tcx := []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<TrainingCenterDatabase xmlns="http://www.garmin.com/xmlschemas/TrainingCenterDatabase/v2">
+  <Activities>
+    <Activity Sport="Biking">
+      <Lap StartTime="2024-03-01T07:00:00Z">
+        <Track>
+          <Trackpoint><Time>2024-03-01T07:00:02Z</Time><HeartRateBpm><Value>102</Value></HeartRateBpm></Trackpoint>
+          <Trackpoint><Time>2024-03-01T07:00:01Z</Time></Trackpoint>
+          <Trackpoint><Time>2024-03-01T08:00:00+01:00</Time><HeartRateBpm><Value>100</Value></HeartRateBpm></Trackpoint>
+        </Track>
+      </Lap>
+      <Lap StartTime="2024-03-01T07:00:03Z">
+        <Track>
+          <Trackpoint><Time>2024-03-01T07:00:03.500Z</Time><HeartRateBpm><Value>103</Value></HeartRateBpm></Trackpoint>
+        </Track>
+      </Lap>
+    </Activity>
+  </Activities>
+</TrainingCenterDatabase>`)
+	got, err := ReadHeartRate(tcx, connect.ActivityFormatTCX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []HeartRateSample{
+		{fitStart, 100},
+		{fitStart.Add(2 * time.Second), 102},
+		{fitStart.Add(3500 * time.Millisecond), 103},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range got {
+		if !got[i].Time.Equal(want[i].Time) || got[i].HeartRate != want[i].HeartRate {
+			t.Errorf("reading %d is %v, want %v", i, got[i], want[i])
+		}
+	}
+
+	bad := bytes.Replace(tcx, []byte("2024-03-01T07:00:02Z"), []byte("yesterday"), 1)
+	if _, err := ReadHeartRate(bad, connect.ActivityFormatTCX); err == nil {
+		t.Errorf("reading an invalid trackpoint time succeeded, want an error")
+	}
+	if _, err := ReadHeartRate(tcx, connect.ActivityFormatGPX); err == nil {
+		t.Errorf("reading gpx succeeded, want an error")
+	}
+}
+
+func TestMergeHeartRate(t *testing.T) {
+	// readings returns a reading every second from start to end seconds
+	// after fitStart, of 100 plus the second.
+	readings := func(start, end int) []HeartRateSample {
+		samples := []HeartRateSample{}
+		for s := start; s <= end; s++ {
+			samples = append(samples, HeartRateSample{fitStart.Add(time.Duration(s) * time.Second), 100 + s})
+		}
+		return samples
+	}
+	tests := []struct {
+		name      string
+		heartRate []HeartRateSample
+		// want is the heart rate merged into the samples 0, 10, ... 60
+		// seconds after fitStart.
+		want   []int
+		merged int
+	}{
+		{
+			name:      "aligned",
+			heartRate: readings(0, 60),
+			want:      []int{100, 110, 120, 130, 140, 150, 160},
+			merged:    7,
+		},
+		{
+			name:      "started before and ended after the workout",
+			heartRate: readings(-600, 600),
+			want:      []int{100, 110, 120, 130, 140, 150, 160},
+			merged:    7,
+		},
+		{
+			name:      "started after the workout",
+			heartRate: readings(25, 600),
+			want:      []int{0, 0, 125, 130, 140, 150, 160},
+			merged:    5,
+		},
+		{
+			name:      "ended before the workout finished",
+			heartRate: readings(-600, 35),
+			want:      []int{100, 110, 120, 130, 135, 0, 0},
+			merged:    5,
+		},
+		{
+			name:      "entirely before the workout",
+			heartRate: readings(-600, -6),
+			want:      []int{0, 0, 0, 0, 0, 0, 0},
+		},
+		{
+			name:      "entirely after the workout",
+			heartRate: readings(66, 600),
+			want:      []int{0, 0, 0, 0, 0, 0, 0},
+		},
+		{
+			name:      "a reading 5 seconds before the start",
+			heartRate: readings(-5, -5),
+			want:      []int{95, 0, 0, 0, 0, 0, 0},
+			merged:    1,
+		},
+		{
+			name:      "short gap in the readings",
+			heartRate: append(readings(0, 16), readings(34, 60)...),
+			want:      []int{100, 110, 116, 134, 140, 150, 160},
+			merged:    7,
+		},
+		{
+			name:      "long gap in the readings",
+			heartRate: append(readings(0, 12), readings(37, 60)...),
+			want:      []int{100, 110, 0, 0, 140, 150, 160},
+			merged:    5,
+		},
+		{
+			name: "nearest reading",
+			heartRate: []HeartRateSample{
+				{fitStart.Add(7 * time.Second), 170},
+				{fitStart.Add(12 * time.Second), 180},
+				{fitStart.Add(17 * time.Second), 190},
+				{fitStart.Add(24 * time.Second), 200},
+			},
+			want:   []int{0, 180, 190, 0, 0, 0, 0},
+			merged: 2,
+		},
+		{
+			name: "offset readings",
+			heartRate: []HeartRateSample{
+				{fitStart.Add(3 * time.Second), 103},
+				{fitStart.Add(13 * time.Second), 113},
+				{fitStart.Add(23 * time.Second), 123},
+			},
+			want:   []int{103, 113, 123, 0, 0, 0, 0},
+			merged: 3,
+		},
+		{
+			name:   "no readings",
+			want:   []int{0, 0, 0, 0, 0, 0, 0},
+			merged: 0,
+		},
+	}
+	for _, test := range tests {
+		samples := []sample{}
+		for s := 0; s <= 60; s += 10 {
+			// Peloton heart rate is replaced, even where no reading is
+			// close enough.
+			samples = append(samples, sample{Time: fitStart.Add(time.Duration(s) * time.Second), HeartRate: 60})
+		}
+		merged := mergeHeartRate(samples, test.heartRate)
+		got := []int{}
+		for _, s := range samples {
+			got = append(got, s.HeartRate)
+		}
+		if merged != test.merged || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: merged %d readings %v, want %d readings %v", test.name, merged, got, test.merged, test.want)
+		}
+	}
+}
+
+func TestHeartRateSummary(t *testing.T) {
+	samples := []sample{{HeartRate: 0}, {HeartRate: 120}, {HeartRate: 131}, {HeartRate: 0}}
+	average, max := heartRateSummary(samples)
+	if average != 126 || max != 131 {
+		t.Errorf("heartRateSummary = %d, %d, want 126, 131", average, max)
+	}
+	if average, max := heartRateSummary([]sample{{}, {}}); average != 0 || max != 0 {
+		t.Errorf("heartRateSummary without readings = %d, %d, want 0, 0", average, max)
+	}
+}
@@ -0,0 +1,303 @@
+package garmin
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mdordoy/peloton-to-garmin/peloton"
+	"github.com/pkg/errors"
+)
+
+// LapMode decides how an activity is divided into laps.
+type LapMode string
+
+const (
+	// LapsSegments creates a lap for every class segment, such as the warm
+	// up, each interval and the cool down.
+	LapsSegments LapMode = "segments"
+	// LapsSplits creates a lap for every mile or kilometer, following the
+	// split distance Peloton shows for the workout.
+	LapsSplits LapMode = "splits"
+	// LapsSingle creates one lap covering the whole activity.
+	LapsSingle LapMode = "single"
+)
+
+// ParseLapMode returns the lap mode for a name.
+func ParseLapMode(mode string) (LapMode, error) {
+	switch LapMode(strings.ToLower(mode)) {
+	case LapsSegments:
+		return LapsSegments, nil
+	case LapsSplits:
+		return LapsSplits, nil
+	case LapsSingle:
+		return LapsSingle, nil
+	}
+	return LapsSingle, errors.New(fmt.Sprintf("Unsupported lap mode: %s, use segments, splits or single", mode))
+}
+
+// lapIntensity is the effort of a lap, using the FIT intensity values. TCX
+// only distinguishes active and resting laps.
+type lapIntensity int64
+
+const (
+	lapActive   lapIntensity = 0
+	lapRest     lapIntensity = 1
+	lapWarmup   lapIntensity = 2
+	lapCooldown lapIntensity = 3
+)
+
+// TCX returns the TCX Intensity value.
+func (i lapIntensity) TCX() string {
+	if i == lapRest {
+		return "Resting"
+	}
+	return "Active"
+}
+
+// lapTrigger is what ended a lap, using the FIT lap_trigger values.
+type lapTrigger int64
+
+const (
+	lapTriggerManual   lapTrigger = 0
+	lapTriggerTime     lapTrigger = 1
+	lapTriggerDistance lapTrigger = 2
+)
+
+// TCX returns the TCX TriggerMethod value.
+func (t lapTrigger) TCX() string {
+	switch t {
+	case lapTriggerTime:
+		return "Time"
+	case lapTriggerDistance:
+		return "Distance"
+	}
+	return "Manual"
+}
+
+// lap is a part of an activity with its own totals, averages and maxima.
+type lap struct {
+	StartTime        time.Time
+	EndTime          time.Time
+	Distance         float64
+	Calories         int
+	AverageSpeed     float64
+	MaximumSpeed     float64
+	AverageHeartRate int
+	MaxHeartRate     int
+	AverageCadence   int
+	MaxCadence       int
+	AverageWatts     int
+	MaxWatts         int
+	// Ascent is only known for the whole activity, so only a single lap has it.
+	Ascent    float64
+	Intensity lapIntensity
+	Trigger   lapTrigger
+	Samples   []sample
+}
+
+// TotalTimeSeconds returns the elapsed time of the lap.
+func (l lap) TotalTimeSeconds() float64 {
+	return l.EndTime.Sub(l.StartTime).Seconds()
+}
+
+// buildLaps divides an activity into laps. Workouts without the segments or
+// distance needed for the requested mode get a single lap.
+func buildLaps(act activity, workoutDetail peloton.WorkoutDetail, mode LapMode) []lap {
+	var laps []lap
+	switch mode {
+	case LapsSegments:
+		laps = segmentLaps(act, workoutDetail.SegmentList)
+	case LapsSplits:
+		if act.Sport.Distance {
+			laps = splitLaps(act, workoutDetail.SplitsData)
+		}
+	}
+	if len(laps) < 2 {
+		return []lap{singleLap(act)}
+	}
+	return laps
+}
+
+// singleLap covers the whole activity using the Peloton summary values.
+func singleLap(act activity) lap {
+	return lap{
+		StartTime:        act.StartTime,
+		EndTime:          act.EndTime,
+		Distance:         act.Distance,
+		Calories:         act.Calories,
+		AverageSpeed:     act.AverageSpeed,
+		MaximumSpeed:     act.Summary.MaximumSpeed,
+		AverageHeartRate: act.Summary.AvarageHeartRate,
+		MaxHeartRate:     act.Summary.MaxHeartRate,
+		AverageCadence:   act.Summary.AverageCadence,
+		MaxCadence:       act.Summary.MaxBikeCadence,
+		AverageWatts:     act.AverageWatts,
+		MaxWatts:         act.Summary.MaxWatts,
+		Ascent:           act.Ascent,
+		Intensity:        lapActive,
+		Trigger:          lapTriggerManual,
+		Samples:          act.Samples,
+	}
+}
+
+// segmentLaps starts a lap at the offset of every class segment, in offset
+// order. The first lap also covers any time before the first segment, and
+// segments starting with the one before them are left out.
+func segmentLaps(act activity, segments []peloton.WorkoutDetailSegmentList) []lap {
+	sorted := make([]peloton.WorkoutDetailSegmentList, len(segments))
+	copy(sorted, segments)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].StartTimeOffset < sorted[j].StartTimeOffset
+	})
+
+	laps := []lap{}
+	for i, segment := range sorted {
+		start := act.StartTime.Add(time.Duration(segment.StartTimeOffset) * time.Second)
+		if i == 0 {
+			start = act.StartTime
+		}
+		if !start.Before(act.EndTime) {
+			break
+		}
+		if len(laps) > 0 {
+			if !start.After(laps[len(laps)-1].StartTime) {
+				continue
+			}
+			laps[len(laps)-1].EndTime = start
+		}
+		laps = append(laps, lap{
+			StartTime: start,
+			EndTime:   act.EndTime,
+			Intensity: segmentIntensity(segment),
+			Trigger:   lapTriggerTime,
+		})
+	}
+	return fillLaps(act, laps)
+}
+
+func segmentIntensity(segment peloton.WorkoutDetailSegmentList) lapIntensity {
+	name := strings.ToLower(segment.IconSlug + " " + segment.Name)
+	switch {
+	case strings.Contains(name, "warm"):
+		return lapWarmup
+	case strings.Contains(name, "cool"):
+		return lapCooldown
+	case strings.Contains(name, "rest") || strings.Contains(name, "recover"):
+		return lapRest
+	}
+	return lapActive
+}
+
+// splitLaps starts a new lap each time the distance passes a split marker.
+func splitLaps(act activity, splits peloton.WorkoutDetailSplitsData) []lap {
+	unit := splits.DistanceMarkerDisplayUnit
+	if unit == "" {
+		unit = "mi"
+	}
+	length := 1.0
+	if len(splits.Splits) > 0 && splits.Splits[0].DistanceMarker > 0 {
+		length = splits.Splits[0].DistanceMarker
+	}
+	splitMeters := toMeters(length, unit)
+	if splitMeters <= 0 {
+		return nil
+	}
+
+	laps := []lap{{StartTime: act.StartTime, EndTime: act.EndTime, Intensity: lapActive, Trigger: lapTriggerDistance}}
+	next := splitMeters
+	for _, s := range act.Samples {
+		if s.Distance < next {
+			continue
+		}
+		if s.Time.After(laps[len(laps)-1].StartTime) && s.Time.Before(act.EndTime) {
+			laps[len(laps)-1].EndTime = s.Time
+			laps = append(laps, lap{StartTime: s.Time, EndTime: act.EndTime, Intensity: lapActive, Trigger: lapTriggerDistance})
+		}
+		next = (math.Floor(s.Distance/splitMeters) + 1) * splitMeters
+	}
+	// Whatever is left after the last full split ends with the activity.
+	laps[len(laps)-1].Trigger = lapTriggerManual
+	return fillLaps(act, laps)
+}
+
+// fillLaps assigns samples to laps and calculates their totals from them.
+// Lap distances and calories are adjusted so they add up to the activity
+// totals Peloton reports.
+func fillLaps(act activity, laps []lap) []lap {
+	if len(laps) == 0 {
+		return laps
+	}
+	index := 0
+	for i := range laps {
+		for index < len(act.Samples) && (i == len(laps)-1 || act.Samples[index].Time.Before(laps[i].EndTime)) {
+			laps[i].Samples = append(laps[i].Samples, act.Samples[index])
+			index++
+		}
+	}
+
+	previousDistance := 0.0
+	distance := 0.0
+	calories := 0
+	totalTime := act.TotalTimeSeconds()
+	for i := range laps {
+		l := &laps[i]
+		if len(l.Samples) > 0 {
+			last := l.Samples[len(l.Samples)-1].Distance
+			l.Distance = last - previousDistance
+			previousDistance = last
+		}
+		if totalTime > 0 {
+			l.Calories = int(math.Round(float64(act.Calories) * l.TotalTimeSeconds() / totalTime))
+		}
+		if i == len(laps)-1 {
+			l.Distance = math.Max(act.Distance-distance, 0)
+			l.Calories = act.Calories - calories
+			if l.Calories < 0 {
+				l.Calories = 0
+			}
+		}
+		distance += l.Distance
+		calories += l.Calories
+		if l.TotalTimeSeconds() > 0 {
+			l.AverageSpeed = l.Distance / l.TotalTimeSeconds()
+		}
+		summariseSamples(l)
+	}
+	return laps
+}
+
+// summariseSamples fills the averages and maxima of a lap. Heart rate
+// averages ignore samples without a reading.
+func summariseSamples(l *lap) {
+	heartRate, heartRateCount, cadence, watts := 0, 0, 0, 0
+	for _, s := range l.Samples {
+		if s.HeartRate > 0 {
+			heartRate += s.HeartRate
+			heartRateCount++
+		}
+		cadence += s.Cadence
+		watts += s.Watts
+		if s.HeartRate > l.MaxHeartRate {
+			l.MaxHeartRate = s.HeartRate
+		}
+		if s.Cadence > l.MaxCadence {
+			l.MaxCadence = s.Cadence
+		}
+		if s.Watts > l.MaxWatts {
+			l.MaxWatts = s.Watts
+		}
+		if s.Speed > l.MaximumSpeed {
+			l.MaximumSpeed = s.Speed
+		}
+	}
+	if heartRateCount > 0 {
+		l.AverageHeartRate = int(math.Round(float64(heartRate) / float64(heartRateCount)))
+	}
+	if len(l.Samples) > 0 {
+		l.AverageCadence = int(math.Round(float64(cadence) / float64(len(l.Samples))))
+		l.AverageWatts = int(math.Round(float64(watts) / float64(len(l.Samples))))
+	}
+}
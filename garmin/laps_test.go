@@ -0,0 +1,211 @@
+package garmin
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/mdordoy/peloton-to-garmin/peloton"
+)
+
+var lapStart = time.Date(2024, 3, 1, 7, 0, 0, 0, time.UTC)
+
+// lapActivity returns a ten minute activity with a sample every minute,
+// covering 200 m a minute. The first sample has no heart rate.
+func lapActivity() activity {
+	act := activity{
+		StartTime: lapStart,
+		EndTime:   lapStart.Add(10 * time.Minute),
+		Distance:  2000,
+		Calories:  100,
+	}
+	for i := 0; i < 10; i++ {
+		s := sample{
+			Time:     lapStart.Add(time.Duration(i) * time.Minute),
+			Distance: float64(i * 200),
+			Watts:    100 + i*10,
+			Cadence:  80,
+		}
+		if i > 0 {
+			s.HeartRate = 120 + i
+		}
+		act.Samples = append(act.Samples, s)
+	}
+	return act
+}
+
+func lapBounds(laps []lap) [][2]time.Duration {
+	bounds := [][2]time.Duration{}
+	for _, l := range laps {
+		bounds = append(bounds, [2]time.Duration{l.StartTime.Sub(lapStart), l.EndTime.Sub(lapStart)})
+	}
+	return bounds
+}
+
+func TestSegmentLaps(t *testing.T) {
+	tests := []struct {
+		name        string
+		segments    []peloton.WorkoutDetailSegmentList
+		bounds      [][2]time.Duration
+		intensities []lapIntensity
+	}{
+		{
+			name: "in order",
+			segments: []peloton.WorkoutDetailSegmentList{
+				{StartTimeOffset: 0, Name: "Warm Up"},
+				{StartTimeOffset: 120, Name: "Ride"},
+				{StartTimeOffset: 300, Name: "Cool Down"},
+			},
+			bounds:      [][2]time.Duration{{0, 2 * time.Minute}, {2 * time.Minute, 5 * time.Minute}, {5 * time.Minute, 10 * time.Minute}},
+			intensities: []lapIntensity{lapWarmup, lapActive, lapCooldown},
+		},
+		{
+			name: "out of order",
+			segments: []peloton.WorkoutDetailSegmentList{
+				{StartTimeOffset: 300, Name: "Cool Down"},
+				{StartTimeOffset: 0, Name: "Warm Up"},
+				{StartTimeOffset: 120, IconSlug: "recovery"},
+			},
+			bounds:      [][2]time.Duration{{0, 2 * time.Minute}, {2 * time.Minute, 5 * time.Minute}, {5 * time.Minute, 10 * time.Minute}},
+			intensities: []lapIntensity{lapWarmup, lapRest, lapCooldown},
+		},
+		{
+			name: "first segment after the start",
+			segments: []peloton.WorkoutDetailSegmentList{
+				{StartTimeOffset: 30, Name: "Ride"},
+				{StartTimeOffset: 240, Name: "Ride"},
+			},
+			bounds:      [][2]time.Duration{{0, 4 * time.Minute}, {4 * time.Minute, 10 * time.Minute}},
+			intensities: []lapIntensity{lapActive, lapActive},
+		},
+		{
+			name: "same offset and after the end",
+			segments: []peloton.WorkoutDetailSegmentList{
+				{StartTimeOffset: 0, Name: "Ride"},
+				{StartTimeOffset: 240, Name: "Ride"},
+				{StartTimeOffset: 240, Name: "Recovery"},
+				{StartTimeOffset: 600, Name: "Cool Down"},
+			},
+			bounds:      [][2]time.Duration{{0, 4 * time.Minute}, {4 * time.Minute, 10 * time.Minute}},
+			intensities: []lapIntensity{lapActive, lapActive},
+		},
+	}
+	for _, test := range tests {
+		laps := segmentLaps(lapActivity(), test.segments)
+		bounds := lapBounds(laps)
+		if len(bounds) != len(test.bounds) {
+			t.Errorf("%s: laps %v, want %v", test.name, bounds, test.bounds)
+			continue
+		}
+		for i := range bounds {
+			if bounds[i] != test.bounds[i] {
+				t.Errorf("%s: lap %d covers %v, want %v", test.name, i, bounds[i], test.bounds[i])
+			}
+			if laps[i].Intensity != test.intensities[i] {
+				t.Errorf("%s: lap %d intensity %d, want %d", test.name, i, laps[i].Intensity, test.intensities[i])
+			}
+			if laps[i].Trigger != lapTriggerTime {
+				t.Errorf("%s: lap %d trigger %d, want time", test.name, i, laps[i].Trigger)
+			}
+		}
+	}
+}
+
+func TestSegmentLapsKeepsSegmentOrder(t *testing.T) {
+	segments := []peloton.WorkoutDetailSegmentList{{StartTimeOffset: 300}, {StartTimeOffset: 0}}
+	segmentLaps(lapActivity(), segments)
+	if segments[0].StartTimeOffset != 300 {
+		t.Errorf("segments were sorted in place")
+	}
+}
+
+func TestSplitLaps(t *testing.T) {
+	tests := []struct {
+		name   string
+		splits peloton.WorkoutDetailSplitsData
+		bounds [][2]time.Duration
+	}{
+		{
+			name:   "kilometers",
+			splits: peloton.WorkoutDetailSplitsData{DistanceMarkerDisplayUnit: "km", Splits: []peloton.WorkoutDetailSplits{{DistanceMarker: 1}}},
+			bounds: [][2]time.Duration{{0, 5 * time.Minute}, {5 * time.Minute, 10 * time.Minute}},
+		},
+		{
+			name:   "half kilometers",
+			splits: peloton.WorkoutDetailSplitsData{DistanceMarkerDisplayUnit: "km", Splits: []peloton.WorkoutDetailSplits{{DistanceMarker: 0.5}}},
+			bounds: [][2]time.Duration{{0, 3 * time.Minute}, {3 * time.Minute, 5 * time.Minute}, {5 * time.Minute, 8 * time.Minute}, {8 * time.Minute, 10 * time.Minute}},
+		},
+		{
+			name:   "miles by default",
+			splits: peloton.WorkoutDetailSplitsData{},
+			bounds: [][2]time.Duration{{0, 9 * time.Minute}, {9 * time.Minute, 10 * time.Minute}},
+		},
+	}
+	for _, test := range tests {
+		laps := splitLaps(lapActivity(), test.splits)
+		bounds := lapBounds(laps)
+		if len(bounds) != len(test.bounds) {
+			t.Errorf("%s: laps %v, want %v", test.name, bounds, test.bounds)
+			continue
+		}
+		for i := range bounds {
+			if bounds[i] != test.bounds[i] {
+				t.Errorf("%s: lap %d covers %v, want %v", test.name, i, bounds[i], test.bounds[i])
+			}
+			want := lapTriggerDistance
+			if i == len(laps)-1 {
+				want = lapTriggerManual
+			}
+			if laps[i].Trigger != want {
+				t.Errorf("%s: lap %d trigger %d, want %d", test.name, i, laps[i].Trigger, want)
+			}
+		}
+	}
+}
+
+func TestFillLaps(t *testing.T) {
+	act := lapActivity()
+	laps := fillLaps(act, []lap{
+		{StartTime: lapStart, EndTime: lapStart.Add(5 * time.Minute)},
+		{StartTime: lapStart.Add(5 * time.Minute), EndTime: act.EndTime},
+	})
+
+	want := []lap{
+		{Distance: 800, Calories: 50, AverageSpeed: 800.0 / 300, AverageHeartRate: 123, MaxHeartRate: 124, AverageCadence: 80, MaxCadence: 80, AverageWatts: 120, MaxWatts: 140},
+		{Distance: 1200, Calories: 50, AverageSpeed: 1200.0 / 300, AverageHeartRate: 127, MaxHeartRate: 129, AverageCadence: 80, MaxCadence: 80, AverageWatts: 170, MaxWatts: 190},
+	}
+	for i, l := range laps {
+		if len(l.Samples) != 5 {
+			t.Errorf("lap %d has %d samples, want 5", i, len(l.Samples))
+		}
+		w := want[i]
+		if l.Distance != w.Distance || l.Calories != w.Calories || math.Abs(l.AverageSpeed-w.AverageSpeed) > 1e-9 {
+			t.Errorf("lap %d totals %.0f m, %d kcal, %.3f m/s, want %.0f m, %d kcal, %.3f m/s", i, l.Distance, l.Calories, l.AverageSpeed, w.Distance, w.Calories, w.AverageSpeed)
+		}
+		if l.AverageHeartRate != w.AverageHeartRate || l.MaxHeartRate != w.MaxHeartRate {
+			t.Errorf("lap %d heart rate %d/%d, want %d/%d", i, l.AverageHeartRate, l.MaxHeartRate, w.AverageHeartRate, w.MaxHeartRate)
+		}
+		if l.AverageCadence != w.AverageCadence || l.MaxCadence != w.MaxCadence || l.AverageWatts != w.AverageWatts || l.MaxWatts != w.MaxWatts {
+			t.Errorf("lap %d cadence %d/%d watts %d/%d, want %d/%d and %d/%d", i, l.AverageCadence, l.MaxCadence, l.AverageWatts, l.MaxWatts, w.AverageCadence, w.MaxCadence, w.AverageWatts, w.MaxWatts)
+		}
+	}
+}
+
+func TestFillLapsMatchesActivityTotals(t *testing.T) {
+	act := lapActivity()
+	act.Calories = 101
+	act.Distance = 2050
+	laps := fillLaps(act, []lap{
+		{StartTime: lapStart, EndTime: lapStart.Add(200 * time.Second)},
+		{StartTime: lapStart.Add(200 * time.Second), EndTime: lapStart.Add(400 * time.Second)},
+		{StartTime: lapStart.Add(400 * time.Second), EndTime: act.EndTime},
+	})
+	distance, calories := 0.0, 0
+	for _, l := range laps {
+		distance += l.Distance
+		calories += l.Calories
+	}
+	if distance != act.Distance || calories != act.Calories {
+		t.Errorf("laps add up to %.0f m and %d kcal, want %.0f m and %d kcal", distance, calories, act.Distance, act.Calories)
+	}
+}
@@ -0,0 +1,254 @@
+package garmin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+
+	connect "github.com/abrander/garmin-connect"
+	"github.com/mdordoy/peloton-to-garmin/peloton"
+	"github.com/pkg/errors"
+)
+
+const (
+	activityURL      = "https://connect.garmin.com/modern/proxy/activity-service/activity/%d"
+	activityTypesURL = "https://connect.garmin.com/modern/proxy/activity-service/activity/activityTypes"
+)
+
+// ActivityUpdate holds the activity details set after upload. Empty fields
+// are left as they are.
+type ActivityUpdate struct {
+	Name        string
+	Description string
+	Type        *connect.ActivityType
+}
+
+// UpdateActivity sets the name, description and type of an activity in a
+// single request.
+func (c *Client) UpdateActivity(activityID int, update ActivityUpdate) error {
+	payload := struct {
+		ID          int                   `json:"activityId"`
+		Name        string                `json:"activityName,omitempty"`
+		Description string                `json:"description,omitempty"`
+		Type        *connect.ActivityType `json:"activityTypeDTO,omitempty"`
+	}{activityID, update.Name, update.Description, update.Type}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode activity update")
+	}
+	resp, err := c.send(http.MethodPut, fmt.Sprintf(activityURL, activityID), "application/json", body)
+	if err != nil {
+		return errors.Wrapf(err, "failed to update activity %d", activityID)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New(fmt.Sprintf("failed to update activity %d: %d: %s", activityID, resp.StatusCode, http.StatusText(resp.StatusCode)))
+	}
+	return nil
+}
+
+// ActivityType returns the Garmin Connect activity type with a key such as
+// indoor_cycling. The list of types is downloaded once.
+func (c *Client) ActivityType(key string) (connect.ActivityType, error) {
+	c.mu.Lock()
+	types := c.activityTypes
+	c.mu.Unlock()
+	if types == nil {
+		buf := bytes.Buffer{}
+		err := c.call(func() error {
+			return c.Download(activityTypesURL, &buf)
+		})
+		if err != nil {
+			return connect.ActivityType{}, errors.Wrap(err, "failed to get garmin activity types")
+		}
+		err = json.Unmarshal(buf.Bytes(), &types)
+		if err != nil {
+			return connect.ActivityType{}, errors.Wrap(err, "failed to decode garmin activity types")
+		}
+		c.mu.Lock()
+		c.activityTypes = types
+		c.mu.Unlock()
+	}
+	for _, activityType := range types {
+		if activityType.TypeKey == key {
+			return activityType, nil
+		}
+	}
+	return connect.ActivityType{}, errors.New(fmt.Sprintf("unknown garmin activity type %s", key))
+}
+
+// TemplateData is the workout information available to name and description
+// templates.
+type TemplateData struct {
+	Title       string
+	Description string
+	Instructor  string
+	Discipline  string
+	// Difficulty is the average difficulty members rated the class, out
+	// of 10.
+	Difficulty float64
+	Music      []peloton.Song
+	// TotalOutput is the work done in kilojoules.
+	TotalOutput    float64
+	PersonalRecord bool
+	ClassURL       string
+	StartTime      time.Time
+	Duration       time.Duration
+	// FTP, NormalizedPower, IntensityFactor and TSS measure the training
+	// load of rides against the profile FTP. They are zero without power.
+	FTP             int
+	NormalizedPower float64
+	IntensityFactor float64
+	TSS             float64
+	// PowerZones and HeartRateZones hold the time spent in each zone.
+	PowerZones     []Zone
+	HeartRateZones []Zone
+}
+
+// DefaultNameTemplate names activities after the class.
+const DefaultNameTemplate = "{{.Title}}"
+
+// DefaultDescriptionTemplate describes the class, the instructor and the
+// effort.
+const DefaultDescriptionTemplate = `{{.Title}}{{if .Instructor}} with {{.Instructor}}{{end}}
+{{if .Description}}{{.Description}}
+{{end}}{{if .TotalOutput}}Total output: {{printf "%.0f" .TotalOutput}} kJ{{if .PersonalRecord}} (personal record){{end}}
+{{end}}{{if .TSS}}NP {{printf "%.0f" .NormalizedPower}} W, IF {{printf "%.2f" .IntensityFactor}}, TSS {{printf "%.0f" .TSS}} (FTP {{.FTP}} W)
+{{end}}{{if .PowerZones}}Power zones:{{range .PowerZones}} Z{{.Zone}} {{.Time}}{{end}}
+{{end}}{{if .HeartRateZones}}Heart rate zones:{{range .HeartRateZones}} Z{{.Zone}} {{.Time}}{{end}}
+{{end}}{{if .ClassURL}}{{.ClassURL}}{{end}}`
+
+// ParseTemplate parses a text/template for an activity name or description.
+// The template is also executed against an empty workout, so references to
+// fields that do not exist are reported now rather than during a sync.
+func ParseTemplate(name, text string) (*template.Template, error) {
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid %s template", name)
+	}
+	err = tmpl.Execute(ioutil.Discard, TemplateData{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid %s template", name)
+	}
+	return tmpl, nil
+}
+
+// UsesField reports whether a template, or any template it defines, refers
+// to a TemplateData field such as Music.
+func UsesField(tmpl *template.Template, field string) bool {
+	for _, t := range tmpl.Templates() {
+		if t.Tree != nil && usesField(t.Tree.Root, field) {
+			return true
+		}
+	}
+	return false
+}
+
+func usesField(node parse.Node, field string) bool {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+		for _, child := range n.Nodes {
+			if usesField(child, field) {
+				return true
+			}
+		}
+	case *parse.ActionNode:
+		return usesField(n.Pipe, field)
+	case *parse.IfNode:
+		return usesField(n.Pipe, field) || usesField(n.List, field) || usesField(n.ElseList, field)
+	case *parse.RangeNode:
+		return usesField(n.Pipe, field) || usesField(n.List, field) || usesField(n.ElseList, field)
+	case *parse.WithNode:
+		return usesField(n.Pipe, field) || usesField(n.List, field) || usesField(n.ElseList, field)
+	case *parse.TemplateNode:
+		return usesField(n.Pipe, field)
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		for _, cmd := range n.Cmds {
+			if usesField(cmd, field) {
+				return true
+			}
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			if usesField(arg, field) {
+				return true
+			}
+		}
+	case *parse.FieldNode:
+		return len(n.Ident) > 0 && n.Ident[0] == field
+	case *parse.VariableNode:
+		return len(n.Ident) > 1 && n.Ident[0] == "$" && n.Ident[1] == field
+	case *parse.ChainNode:
+		return usesField(n.Node, field)
+	}
+	return false
+}
+
+// newTemplateData collects the template data of a workout converted into act,
+// so the training load and zones are the ones written to the uploaded file.
+// The start time is in opts.Location.
+func newTemplateData(workoutDetail peloton.WorkoutDetail, act activity, opts ConvertOptions) TemplateData {
+	location := opts.Location
+	if location == nil {
+		location = time.Local
+	}
+	data := TemplateData{
+		Title:          workoutDetail.Title,
+		Description:    workoutDetail.Description,
+		Instructor:     workoutDetail.Instructor,
+		Discipline:     workoutDetail.FitnessDiscipline,
+		Difficulty:     workoutDetail.Difficulty,
+		Music:          workoutDetail.Music,
+		PersonalRecord: workoutDetail.PersonalRecord,
+		StartTime:      workoutDetail.StartTime.In(location),
+		Duration:       workoutDetail.EndTime.Sub(workoutDetail.StartTime),
+	}
+	if summary, ok := findSummary(workoutDetail.Summaries, slugTotalOutput); ok {
+		data.TotalOutput = summary.Value
+	}
+	if workoutDetail.RideID != "" {
+		data.ClassURL = fmt.Sprintf("https://members.onepeloton.com/classes/%s?modal=classDetailsModal&classId=%s", classPath(workoutDetail.FitnessDiscipline), workoutDetail.RideID)
+	}
+	data.FTP = act.Training.FTP
+	data.NormalizedPower = act.Training.NormalizedPower
+	data.IntensityFactor = act.Training.IntensityFactor
+	data.TSS = act.Training.TSS
+	data.PowerZones = act.Training.PowerZones
+	data.HeartRateZones = act.Training.HeartRateZones
+	return data
+}
+
+// classPath returns the section of the Peloton website a discipline's
+// classes are listed under.
+func classPath(discipline string) string {
+	switch discipline {
+	case "caesar", "caesar_bootcamp":
+		return "rowing"
+	case "bike_bootcamp":
+		return "bootcamp"
+	}
+	return discipline
+}
+
+// RenderTemplate executes a name or description template with the template
+// data returned by ConvertWorkout.
+func RenderTemplate(tmpl *template.Template, data TemplateData) (string, error) {
+	buf := bytes.Buffer{}
+	err := tmpl.Execute(&buf, data)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to render %s", tmpl.Name())
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
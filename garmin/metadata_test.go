@@ -0,0 +1,95 @@
+package garmin
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	connect "github.com/abrander/garmin-connect"
+)
+
+func TestUsesField(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want bool
+	}{
+		{"field", "{{.Title}}: {{.Music}}", true},
+		{"range", "{{range .Music}}{{.Title}} {{end}}", true},
+		{"if", "{{if .Music}}with music{{end}}", true},
+		{"nested", "{{with .Instructor}}{{range $.Music}}{{.Artist}}{{end}}{{end}}", true},
+		{"function argument", "{{len .Music}} songs", true},
+		{"defined template", `{{define "songs"}}{{.Music}}{{end}}{{template "songs" .}}`, true},
+		{"text only", "Music by {{.Instructor}}", false},
+		{"other fields", DefaultDescriptionTemplate, false},
+		{"range field", "{{range .PowerZones}}{{.Time}}{{end}}", false},
+	}
+	for _, test := range tests {
+		tmpl, err := ParseTemplate("name", test.text)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if got := UsesField(tmpl, "Music"); got != test.want {
+			t.Errorf("%s: UsesField(%q) = %v, want %v", test.name, test.text, got, test.want)
+		}
+	}
+}
+
+func TestConvertWorkoutTemplateData(t *testing.T) {
+	start := time.Date(2024, 3, 1, 7, 0, 0, 0, time.UTC)
+	workoutDetail := zoneWorkout(start)
+	// A watch recorded a higher heart rate than Peloton for the whole ride.
+	heartRate := []HeartRateSample{}
+	for offset := 0; offset <= 1200; offset += 60 {
+		heartRate = append(heartRate, HeartRateSample{Time: start.Add(time.Duration(offset) * time.Second), HeartRate: 190})
+	}
+	opts := ConvertOptions{
+		Format:    connect.ActivityFormatFIT,
+		Laps:      LapsSegments,
+		Location:  time.UTC,
+		HeartRate: heartRate,
+		Athlete:   &Athlete{FTP: 200, MaxHeartRate: 200, HeartRateZoneBounds: []float64{0, 0.65, 0.75, 0.85, 0.95}},
+	}
+	_, data, err := ConvertWorkout(workoutDetail, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	act, err := newActivity(workoutDetail, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.Title != workoutDetail.Title || data.Discipline != "cycling" || !data.StartTime.Equal(start) || data.Duration != 20*time.Minute {
+		t.Errorf("template data %+v does not describe the workout", data)
+	}
+	if data.FTP != 200 || data.NormalizedPower != act.Training.NormalizedPower || data.TSS != act.Training.TSS {
+		t.Errorf("training load FTP %d, NP %v, TSS %v, want the converted activity's %+v", data.FTP, data.NormalizedPower, data.TSS, act.Training)
+	}
+	if !reflect.DeepEqual(data.PowerZones, act.Training.PowerZones) || !reflect.DeepEqual(data.HeartRateZones, act.Training.HeartRateZones) {
+		t.Errorf("zones differ from the converted activity")
+	}
+	// The merged heart rate puts the whole ride in the top zone, where
+	// Peloton's own heart rate stays in the lower zones.
+	for i, zone := range data.HeartRateZones {
+		if top := i == len(data.HeartRateZones)-1; top != (zone.Time > 0) {
+			t.Errorf("heart rate zones %+v, want time only in the top zone", data.HeartRateZones)
+			break
+		}
+	}
+
+	tmpl, err := ParseTemplate("name", "{{.Title}} TSS {{printf \"%.0f\" .TSS}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, err := RenderTemplate(tmpl, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "20 min Ride TSS " + fmt.Sprintf("%.0f", act.Training.TSS); name != want {
+		t.Errorf("rendered %q, want %q", name, want)
+	}
+
+	if _, _, err := ConvertWorkout(workoutDetail, ConvertOptions{Format: connect.ActivityFormat(99)}); err == nil {
+		t.Errorf("converting to an unknown format succeeded, want an error")
+	}
+}
@@ -26,7 +26,7 @@ type Activity struct {
 	Text  string `xml:",chardata"`
 	Sport string `xml:"Sport,attr"`
 	ID    string `xml:"Id"`
-	Lap   Lap    `xml:"Lap"`
+	Laps  []Lap  `xml:"Lap"`
 }
 
 type Lap struct {
@@ -90,11 +90,15 @@ type Track struct {
 }
 
 type Trackpoint struct {
-	Text         string                 `xml:",chardata"`
-	Time         string                 `xml:"Time"`
-	HeartRateBpm TrackpointHeartRateBpm `xml:"HeartRateBpm"`
-	Cadence      int                    `xml:"Cadence"`
-	Extensions   TrackpointExtensions   `xml:"Extensions"`
+	Text string `xml:",chardata"`
+	Time string `xml:"Time"`
+	// AltitudeMeters and DistanceMeters are left out for workouts without
+	// incline or distance.
+	AltitudeMeters *float64               `xml:"AltitudeMeters,omitempty"`
+	DistanceMeters *float64               `xml:"DistanceMeters,omitempty"`
+	HeartRateBpm   TrackpointHeartRateBpm `xml:"HeartRateBpm"`
+	Cadence        int                    `xml:"Cadence"`
+	Extensions     TrackpointExtensions   `xml:"Extensions"`
 }
 
 type metricDetails struct {
@@ -6,16 +6,91 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 	"time"
 
+	connect "github.com/abrander/garmin-connect"
 	"github.com/mdordoy/peloton-to-garmin/peloton"
 	"github.com/pkg/errors"
 )
 
 const milesToMetersDistance = 1609.344
-const milesPHToMetersPerSecond = 2.237
 
-func ParsePelotonWorkout(workoutDetail peloton.WorkoutDetail, tcxOutToDisk string) (bytes.Buffer, error) {
+// ParseFormat returns the Garmin activity format for a format name, only the
+// formats the converter can produce are accepted.
+func ParseFormat(format string) (connect.ActivityFormat, error) {
+	switch strings.ToLower(format) {
+	case "tcx":
+		return connect.ActivityFormatTCX, nil
+	case "fit":
+		return connect.ActivityFormatFIT, nil
+	}
+	return connect.ActivityFormatTCX, errors.New(fmt.Sprintf("Unsupported activity format: %s, use fit or tcx", format))
+}
+
+// ConvertOptions controls how a Peloton workout is converted.
+type ConvertOptions struct {
+	Format connect.ActivityFormat
+	// OutToDisk is a directory the converted file is also written to.
+	OutToDisk string
+	Laps      LapMode
+	// Location is the time zone the workout took place in, it defaults to
+	// the local time zone of the host.
+	Location *time.Location
+	// HeartRate is heart rate recorded by another device, such as a watch,
+	// which replaces the heart rate Peloton recorded when it overlaps the
+	// workout.
+	HeartRate []HeartRateSample
+	// Athlete holds the FTP and heart rate zones training load and time in
+	// zone are measured against, nil to leave them out.
+	Athlete *Athlete
+	// Created replaces the workout start as the FIT file creation time.
+	// Garmin rejects a file created at the same time as one already uploaded
+	// as a duplicate, so replacing an activity needs a new creation time.
+	Created time.Time
+}
+
+// ConvertPelotonWorkout converts a Peloton workout into the requested format,
+// optionally writing the result to opts.OutToDisk.
+func ConvertPelotonWorkout(workoutDetail peloton.WorkoutDetail, opts ConvertOptions) (bytes.Buffer, error) {
+	buf, _, err := ConvertWorkout(workoutDetail, opts)
+	return buf, err
+}
+
+// ConvertWorkout converts a Peloton workout like ConvertPelotonWorkout and
+// also returns the template data of the converted activity, so names and
+// descriptions are rendered without converting the workout again.
+func ConvertWorkout(workoutDetail peloton.WorkoutDetail, opts ConvertOptions) (bytes.Buffer, TemplateData, error) {
+	var encode func(activity, peloton.WorkoutDetail, ConvertOptions) (bytes.Buffer, error)
+	switch opts.Format {
+	case connect.ActivityFormatFIT:
+		encode = encodeFit
+	case connect.ActivityFormatTCX:
+		encode = encodeTCX
+	default:
+		return bytes.Buffer{}, TemplateData{}, errors.New(fmt.Sprintf("Unsupported activity format: %s", opts.Format.Extension()))
+	}
+	act, err := newActivity(workoutDetail, opts)
+	if err != nil {
+		return bytes.Buffer{}, TemplateData{}, err
+	}
+	buf, err := encode(act, workoutDetail, opts)
+	if err != nil {
+		return bytes.Buffer{}, TemplateData{}, err
+	}
+	return buf, newTemplateData(workoutDetail, act, opts), nil
+}
+
+// ParsePelotonWorkout converts a Peloton workout into a TCX document.
+func ParsePelotonWorkout(workoutDetail peloton.WorkoutDetail, opts ConvertOptions) (bytes.Buffer, error) {
+	act, err := newActivity(workoutDetail, opts)
+	if err != nil {
+		return bytes.Buffer{}, err
+	}
+	return encodeTCX(act, workoutDetail, opts)
+}
+
+func encodeTCX(act activity, workoutDetail peloton.WorkoutDetail, opts ConvertOptions) (bytes.Buffer, error) {
 	tcd := TrainingCenterDatabase{}
 	tcd.SchemaLocation = "http://www.garmin.com/xmlschemas/TrainingCenterDatabase/v2 http://www.garmin.com/xmlschemas/TrainingCenterDatabasev2.xsd"
 	tcd.Ns5 = "http://www.garmin.com/xmlschemas/ActivityGoals/v1"
@@ -25,137 +100,128 @@ func ParsePelotonWorkout(workoutDetail peloton.WorkoutDetail, tcxOutToDisk strin
 	tcd.Xsi = "http://www.w3.org/2001/XMLSchema-instance"
 	tcd.Ns4 = "http://www.garmin.com/xmlschemas/ProfileExtension/v1"
 
-	switch workoutDetail.FitnessDiscipline {
-	case "cycling":
-		tcd.Activities.Activity.Sport = "Biking"
-	case "stretching":
-		tcd.Activities.Activity.Sport = "Other"
-	default:
-		return bytes.Buffer{}, errors.New(fmt.Sprintf("Unsupported sport activity: %s", workoutDetail.FitnessDiscipline))
+	tcd.Activities.Activity.Sport = act.Sport.TCXSport
+	tcd.Activities.Activity.ID = tcxTime(act.StartTime)
+	for _, l := range act.Laps {
+		tcd.Activities.Activity.Laps = append(tcd.Activities.Activity.Laps, parseLap(act, l))
 	}
 
-	startTime := workoutDetail.StartTime.Format("2006-01-02T15:04:05.000Z")
-	tcd.Activities.Activity.ID = startTime
-	tcd.Activities.Activity.Lap.StartTime = startTime
-	tcd.Activities.Activity.Lap.TotalTimeSeconds = workoutDetail.EndTime.Sub(workoutDetail.StartTime).Seconds()
-	tcd.Activities.Activity.Lap.DistanceMeters = getDistance(workoutDetail.Summaries)
-	tcd.Activities.Activity.Lap.Calories = getTotalCalories(workoutDetail.Summaries)
+	buf, err := writeOutTcxData(tcd, workoutDetail.ID, opts.OutToDisk)
+	if err != nil {
+		return bytes.Buffer{}, errors.Wrap(err, "failed to write tcx data to file")
+	}
 
-	summaryMetricData := getSummaryMetricData(workoutDetail.Metrics)
+	return buf, nil
+}
 
-	tcd.Activities.Activity.Lap.AverageHeartRateBpm.Value = summaryMetricData.AvarageHeartRate
-	tcd.Activities.Activity.Lap.MaximumHeartRateBpm.Value = summaryMetricData.MaxHeartRate
-	tcd.Activities.Activity.Lap.Cadence = summaryMetricData.AverageCadence
-	tcd.Activities.Activity.Lap.Extensions.LX.MaxBikeCadence = summaryMetricData.MaxBikeCadence
-	tcd.Activities.Activity.Lap.Extensions.LX.MaxWatts = summaryMetricData.MaxWatts
-	tcd.Activities.Activity.Lap.Intensity = "Active"
-	tcd.Activities.Activity.Lap.TriggerMethod = "Manual"
+func parseLap(act activity, l lap) Lap {
+	tcxLap := Lap{}
+	tcxLap.StartTime = tcxTime(l.StartTime)
+	tcxLap.TotalTimeSeconds = l.TotalTimeSeconds()
+	tcxLap.DistanceMeters = l.Distance
+	tcxLap.Calories = l.Calories
 
-	tcd.Activities.Activity.Lap.MaximumSpeed = summaryMetricData.MaximumSpeed
+	tcxLap.AverageHeartRateBpm.Value = l.AverageHeartRate
+	tcxLap.MaximumHeartRateBpm.Value = l.MaxHeartRate
+	tcxLap.Cadence = l.AverageCadence
+	tcxLap.Extensions.LX.MaxBikeCadence = l.MaxCadence
+	tcxLap.Extensions.LX.MaxWatts = l.MaxWatts
+	tcxLap.Intensity = l.Intensity.TCX()
+	tcxLap.TriggerMethod = l.Trigger.TCX()
 
-	tcd.Activities.Activity.Lap.Extensions.LX.AvgSpeed = getAverageSpeed(workoutDetail.AverageSummaries)
-	tcd.Activities.Activity.Lap.Extensions.LX.AvgWatts = getAverageWatts(workoutDetail.AverageSummaries)
+	tcxLap.MaximumSpeed = l.MaximumSpeed
 
-	tcd.Activities.Activity.Lap.Track.Trackpoint = parseTrackpointData(&workoutDetail)
+	tcxLap.Extensions.LX.AvgSpeed = l.AverageSpeed
+	tcxLap.Extensions.LX.AvgWatts = l.AverageWatts
 
-	buf, err := writeOutTcxData(tcd, workoutDetail.ID, tcxOutToDisk)
-	if err != nil {
-		return bytes.Buffer{}, errors.Wrap(err, "failed to write tcx data to file")
-	}
+	tcxLap.Track.Trackpoint = parseTrackpointData(act, l.Samples)
+	return tcxLap
+}
 
-	return buf, nil
+// tcxTime formats a time in UTC, as TCX requires.
+func tcxTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
 }
 
-func parseTrackpointData(data *peloton.WorkoutDetail) []Trackpoint {
+// parseTrackpointData converts samples of act to trackpoints. Workouts with
+// distance get the distance covered so far, and those with incline the
+// altitude climbed, so Garmin keeps the pace and grade of treadmill classes.
+func parseTrackpointData(act activity, samples []sample) []Trackpoint {
 	trackpoints := []Trackpoint{}
-	intervalTime := data.StartTime
-	for index := range data.SecondsSincePedalingStart {
+	for _, s := range samples {
+		s := s
 		trackpoint := Trackpoint{}
-		if index == 0 {
-			trackpoint.Time = intervalTime.Format("2006-01-02T15:04:05.000Z")
-		} else {
-			intervalTime = intervalTime.Add(time.Second * time.Duration(data.DataGranularityInSeconds))
-			trackpoint.Time = intervalTime.Format("2006-01-02T15:04:05.000Z")
-		}
-		for _, data := range data.Metrics {
-			switch data.DisplayName {
-			case "Output":
-				trackpoint.Extensions.TPX.Watts = int(data.Values[index])
-			case "Cadence":
-				trackpoint.Cadence = int(data.Values[index])
-			case "Heart Rate":
-				trackpoint.HeartRateBpm.Value = int(data.Values[index])
-			case "Speed":
-				trackpoint.Extensions.TPX.Speed = data.Values[index] / milesPHToMetersPerSecond
+		trackpoint.Time = tcxTime(s.Time)
+		if act.Sport.Distance {
+			trackpoint.DistanceMeters = &s.Distance
+			if act.HasIncline {
+				trackpoint.AltitudeMeters = &s.Altitude
 			}
 		}
+		trackpoint.Extensions.TPX.Watts = s.Watts
+		trackpoint.Cadence = s.Cadence
+		trackpoint.HeartRateBpm.Value = s.HeartRate
+		trackpoint.Extensions.TPX.Speed = s.Speed
 		trackpoints = append(trackpoints, trackpoint)
 	}
 	return trackpoints
 }
 
 func getDistance(summaryData []peloton.WorkoutDetailSummaries) float64 {
-	for _, data := range summaryData {
-		switch data.DisplayName {
-		case "Distance":
-			//Convert miles to meteres
-			return data.Value * milesToMetersDistance
-		}
+	distance, ok := findSummary(summaryData, slugDistance)
+	if !ok {
+		return 0
 	}
-	return 0
+	return toMeters(distance.Value, distance.DisplayUnit)
 }
 
-func getTotalCalories(summaryData []peloton.WorkoutDetailSummaries) int {
-	for _, data := range summaryData {
-		switch data.DisplayName {
-		case "Calories":
-			//Convert miles to meteres
-			return int(data.Value)
-		}
+// getElevation returns the total climb in meters.
+func getElevation(summaryData []peloton.WorkoutDetailSummaries) float64 {
+	elevation, ok := findSummary(summaryData, slugElevation)
+	if !ok {
+		return 0
 	}
-	return 0
+	return toMeters(elevation.Value, elevation.DisplayUnit)
+}
+
+func getTotalCalories(summaryData []peloton.WorkoutDetailSummaries) int {
+	calories, _ := findSummary(summaryData, slugCalories)
+	return int(calories.Value)
 }
 
 func getSummaryMetricData(data []peloton.WorkoutDetailMetrics) metricDetails {
 	metricData := metricDetails{}
 
-	for _, metric := range data {
-		switch metric.DisplayName {
-		case "Speed":
-			//Convert Mph to meters per second
-			metricData.MaximumSpeed = metric.MaxValue / milesPHToMetersPerSecond
-			continue
-		case "Heart Rate":
-			metricData.MaxHeartRate = int(metric.MaxValue)
-			metricData.AvarageHeartRate = int(metric.AverageValue)
-			continue
-		case "Cadence":
-			metricData.MaxBikeCadence = int(metric.MaxValue)
-			metricData.AverageCadence = int(metric.AverageValue)
-			continue
-		case "Output":
-			metricData.MaxWatts = int(metric.MaxValue)
-		}
+	if speed, ok := findMetric(data, slugSpeed); ok {
+		metricData.MaximumSpeed = toMetersPerSecond(speed.MaxValue, speed.Slug, speed.DisplayUnit)
+	}
+	if heartRate, ok := findMetric(data, slugHeartRate); ok {
+		metricData.MaxHeartRate = int(heartRate.MaxValue)
+		metricData.AvarageHeartRate = int(heartRate.AverageValue)
+	}
+	if cadence, ok := findMetric(data, slugCadence, slugStrokeRate); ok {
+		metricData.MaxBikeCadence = int(cadence.MaxValue)
+		metricData.AverageCadence = int(cadence.AverageValue)
+	}
+	if output, ok := findMetric(data, slugOutput); ok {
+		metricData.MaxWatts = int(output.MaxValue)
 	}
 	return metricData
 }
 
 func getAverageWatts(data []peloton.WorkoutDetailAverageSummaries) int {
-	for _, metric := range data {
-		switch metric.DisplayName {
-		case "Avg Output":
-			return int(metric.Value)
-		}
-	}
-	return 0
+	output, _ := findAverage(data, slugAvgOutput)
+	return int(output.Value)
 }
 
+// getAverageSpeed returns the average speed in meters per second, from the
+// average speed or, for treadmill workouts, the average pace.
 func getAverageSpeed(data []peloton.WorkoutDetailAverageSummaries) float64 {
-	for _, metric := range data {
-		switch metric.DisplayName {
-		case "Avg Speed":
-			return metric.Value
-		}
+	if speed, ok := findAverage(data, slugAvgSpeed); ok {
+		return toMetersPerSecond(speed.Value, speed.Slug, speed.DisplayUnit)
+	}
+	if pace, ok := findAverage(data, slugAvgPace); ok {
+		return toMetersPerSecond(pace.Value, pace.Slug, pace.DisplayUnit)
 	}
 	return 0
 }
@@ -166,20 +232,9 @@ func writeOutTcxData(data TrainingCenterDatabase, workoutID, tcxOutToDisk string
 	if err != nil {
 		return bytes.Buffer{}, errors.Wrap(err, "failed to marshall xml")
 	}
-	if tcxOutToDisk != "" {
-		exists, err := exists(tcxOutToDisk)
-		if err != nil {
-			return bytes.Buffer{}, errors.Wrap(err, "issue with path provided to write tcx file out to disk")
-		}
-
-		if !exists {
-			return bytes.Buffer{}, errors.New("Path provided to write tcx to disk does not exist, please fix")
-		}
-
-		err = ioutil.WriteFile(fmt.Sprintf("%s/%s.tcx", tcxOutToDisk, workoutID), file, 0644)
-		if err != nil {
-			return bytes.Buffer{}, errors.Wrap(err, "failed to write file")
-		}
+	err = writeOutToDisk(file, workoutID, "tcx", tcxOutToDisk)
+	if err != nil {
+		return bytes.Buffer{}, err
 	}
 	var buf bytes.Buffer
 	err = xml.NewEncoder(&buf).Encode(data)
@@ -189,6 +244,27 @@ func writeOutTcxData(data TrainingCenterDatabase, workoutID, tcxOutToDisk string
 	return buf, nil
 }
 
+// writeOutToDisk writes an encoded workout to outToDisk when a path is provided
+func writeOutToDisk(file []byte, workoutID, extension, outToDisk string) error {
+	if outToDisk == "" {
+		return nil
+	}
+	exists, err := exists(outToDisk)
+	if err != nil {
+		return errors.Wrapf(err, "issue with path provided to write %s file out to disk", extension)
+	}
+
+	if !exists {
+		return errors.New(fmt.Sprintf("Path provided to write %s to disk does not exist, please fix", extension))
+	}
+
+	err = ioutil.WriteFile(fmt.Sprintf("%s/%s.%s", outToDisk, workoutID, extension), file, 0644)
+	if err != nil {
+		return errors.Wrap(err, "failed to write file")
+	}
+	return nil
+}
+
 // exists returns whether the given file or directory exists
 func exists(path string) (bool, error) {
 	stat, err := os.Stat(path)
@@ -0,0 +1,222 @@
+package garmin
+
+import (
+	"bytes"
+	"hash/crc32"
+	"math"
+
+	"github.com/mdordoy/peloton-to-garmin/peloton"
+	"github.com/pkg/errors"
+)
+
+type fitSport int64
+
+const (
+	fitSportGeneric          fitSport = 0
+	fitSportRunning          fitSport = 1
+	fitSportCycling          fitSport = 2
+	fitSportFitnessEquipment fitSport = 4
+	fitSportTraining         fitSport = 10
+	fitSportWalking          fitSport = 11
+	fitSportRowing           fitSport = 15
+)
+
+type fitSubSport int64
+
+const (
+	fitSubSportGeneric             fitSubSport = 0
+	fitSubSportTreadmill           fitSubSport = 1
+	fitSubSportIndoorCycling       fitSubSport = 6
+	fitSubSportIndoorRowing        fitSubSport = 14
+	fitSubSportFlexibilityTraining fitSubSport = 19
+	fitSubSportStrengthTraining    fitSubSport = 20
+	fitSubSportCardioTraining      fitSubSport = 26
+	fitSubSportIndoorWalking       fitSubSport = 27
+	fitSubSportYoga                fitSubSport = 43
+	fitSubSportBreathing           fitSubSport = 62
+)
+
+const (
+	fitFileActivity = 4
+
+	fitManufacturerDevelopment = 255
+
+	fitEventTimer    = 0
+	fitEventLap      = 9
+	fitEventSession  = 8
+	fitEventActivity = 26
+
+	fitEventTypeStart   = 0
+	fitEventTypeStop    = 1
+	fitEventTypeStopAll = 4
+
+	fitSessionTriggerActivityEnd = 0
+	fitActivityManual            = 0
+)
+
+// fitProductName is written to the file_id and device_info messages so the
+// activity shows where it came from in Garmin Connect.
+const fitProductName = "Peloton"
+
+// ParsePelotonWorkoutFit converts a Peloton workout into a FIT activity file.
+func ParsePelotonWorkoutFit(workoutDetail peloton.WorkoutDetail, opts ConvertOptions) (bytes.Buffer, error) {
+	act, err := newActivity(workoutDetail, opts)
+	if err != nil {
+		return bytes.Buffer{}, err
+	}
+	return encodeFit(act, workoutDetail, opts)
+}
+
+func encodeFit(act activity, workoutDetail peloton.WorkoutDetail, opts ConvertOptions) (bytes.Buffer, error) {
+	enc := newFitEncoder()
+	for _, msg := range fitActivityMessages(act) {
+		err := enc.writeMessage(msg)
+		if err != nil {
+			return bytes.Buffer{}, errors.Wrap(err, "failed to encode fit data")
+		}
+	}
+	file := enc.bytes()
+
+	err := writeOutToDisk(file, workoutDetail.ID, "fit", opts.OutToDisk)
+	if err != nil {
+		return bytes.Buffer{}, errors.Wrap(err, "failed to write fit data to file")
+	}
+
+	return *bytes.NewBuffer(file), nil
+}
+
+func fitActivityMessages(act activity) []fitMessage {
+	// The serial number only has to be stable for a workout, so derive it
+	// from the Peloton workout ID.
+	serial := int64(crc32.ChecksumIEEE([]byte(act.ID)))
+	if serial == 0 {
+		serial = 1
+	}
+	totalTime := act.TotalTimeSeconds()
+	// The local timestamp uses the offset in force when the activity ended,
+	// which differs from the start when a workout spans a DST change.
+	_, offset := act.EndTime.Zone()
+
+	messages := []fitMessage{
+		{Num: fitMesgFileID, Fields: []fitField{
+			fitValue(0, fitEnum, fitFileActivity),
+			fitValue(1, fitUint16, fitManufacturerDevelopment),
+			fitValue(2, fitUint16, 0),
+			fitValue(3, fitUint32z, serial),
+			fitTimestamp(4, act.Created),
+			fitStringValue(8, fitProductName),
+		}},
+		{Num: fitMesgDeviceInfo, Fields: []fitField{
+			fitTimestamp(253, act.StartTime),
+			fitValue(0, fitUint8, 0),
+			fitValue(2, fitUint16, fitManufacturerDevelopment),
+			fitValue(3, fitUint32z, serial),
+			fitValue(4, fitUint16, 0),
+			fitStringValue(27, fitProductName),
+		}},
+		{Num: fitMesgSport, Fields: []fitField{
+			fitValue(0, fitEnum, int64(act.Sport.FitSport)),
+			fitValue(1, fitEnum, int64(act.Sport.FitSubSport)),
+		}},
+		{Num: fitMesgEvent, Fields: []fitField{
+			fitTimestamp(253, act.StartTime),
+			fitValue(0, fitEnum, fitEventTimer),
+			fitValue(1, fitEnum, fitEventTypeStart),
+		}},
+	}
+
+	for _, s := range act.Samples {
+		fields := []fitField{
+			fitTimestamp(253, s.Time),
+			fitOptional(3, fitUint8, int64(s.HeartRate)),
+			fitValue(4, fitUint8, int64(s.Cadence)),
+			fitValue(7, fitUint16, int64(s.Watts)),
+		}
+		if act.Sport.Distance {
+			fields = append(fields,
+				fitScaled(5, fitUint32, s.Distance, 100),
+				fitScaled(6, fitUint16, s.Speed, 1000),
+			)
+		}
+		if act.HasIncline {
+			fields = append(fields, fitScaled(9, fitSint16, s.Grade, 100))
+		}
+		messages = append(messages, fitMessage{Num: fitMesgRecord, Fields: fields})
+	}
+
+	messages = append(messages, fitMessage{Num: fitMesgEvent, Fields: []fitField{
+		fitTimestamp(253, act.EndTime),
+		fitValue(0, fitEnum, fitEventTimer),
+		fitValue(1, fitEnum, fitEventTypeStopAll),
+	}})
+	for i, l := range act.Laps {
+		lapTime := l.TotalTimeSeconds()
+		messages = append(messages, fitMessage{Num: fitMesgLap, Fields: []fitField{
+			fitTimestamp(253, l.EndTime),
+			fitValue(254, fitUint16, int64(i)),
+			fitValue(0, fitEnum, fitEventLap),
+			fitValue(1, fitEnum, fitEventTypeStop),
+			fitTimestamp(2, l.StartTime),
+			fitScaled(7, fitUint32, lapTime, 1000),
+			fitScaled(8, fitUint32, lapTime, 1000),
+			fitScaled(9, fitUint32, l.Distance, 100),
+			fitValue(11, fitUint16, int64(l.Calories)),
+			fitScaled(13, fitUint16, l.AverageSpeed, 1000),
+			fitScaled(14, fitUint16, l.MaximumSpeed, 1000),
+			fitOptional(15, fitUint8, int64(l.AverageHeartRate)),
+			fitOptional(16, fitUint8, int64(l.MaxHeartRate)),
+			fitOptional(17, fitUint8, int64(l.AverageCadence)),
+			fitOptional(18, fitUint8, int64(l.MaxCadence)),
+			fitOptional(19, fitUint16, int64(l.AverageWatts)),
+			fitOptional(20, fitUint16, int64(l.MaxWatts)),
+			fitOptional(21, fitUint16, int64(math.Round(l.Ascent))),
+			fitValue(23, fitEnum, int64(l.Intensity)),
+			fitValue(24, fitEnum, int64(l.Trigger)),
+			fitValue(25, fitEnum, int64(act.Sport.FitSport)),
+			fitValue(39, fitEnum, int64(act.Sport.FitSubSport)),
+		}})
+	}
+
+	messages = append(messages,
+		fitMessage{Num: fitMesgSession, Fields: []fitField{
+			fitTimestamp(253, act.EndTime),
+			fitValue(254, fitUint16, 0),
+			fitValue(0, fitEnum, fitEventSession),
+			fitValue(1, fitEnum, fitEventTypeStop),
+			fitTimestamp(2, act.StartTime),
+			fitValue(5, fitEnum, int64(act.Sport.FitSport)),
+			fitValue(6, fitEnum, int64(act.Sport.FitSubSport)),
+			fitScaled(7, fitUint32, totalTime, 1000),
+			fitScaled(8, fitUint32, totalTime, 1000),
+			fitScaled(9, fitUint32, act.Distance, 100),
+			fitValue(11, fitUint16, int64(act.Calories)),
+			fitScaled(14, fitUint16, act.AverageSpeed, 1000),
+			fitScaled(15, fitUint16, act.Summary.MaximumSpeed, 1000),
+			fitOptional(16, fitUint8, int64(act.Summary.AvarageHeartRate)),
+			fitOptional(17, fitUint8, int64(act.Summary.MaxHeartRate)),
+			fitOptional(18, fitUint8, int64(act.Summary.AverageCadence)),
+			fitOptional(19, fitUint8, int64(act.Summary.MaxBikeCadence)),
+			fitOptional(20, fitUint16, int64(act.AverageWatts)),
+			fitOptional(21, fitUint16, int64(act.Summary.MaxWatts)),
+			fitOptional(22, fitUint16, int64(math.Round(act.Ascent))),
+			fitValue(25, fitUint16, 0),
+			fitValue(26, fitUint16, int64(len(act.Laps))),
+			fitValue(28, fitEnum, fitSessionTriggerActivityEnd),
+			fitOptional(34, fitUint16, int64(math.Round(act.Training.NormalizedPower))),
+			fitOptional(35, fitUint16, int64(math.Round(act.Training.TSS*10))),
+			fitOptional(36, fitUint16, int64(math.Round(act.Training.IntensityFactor*1000))),
+			fitOptional(45, fitUint16, int64(act.Training.FTP)),
+		}},
+		fitMessage{Num: fitMesgActivity, Fields: []fitField{
+			fitTimestamp(253, act.EndTime),
+			fitScaled(0, fitUint32, totalTime, 1000),
+			fitValue(1, fitUint16, 1),
+			fitValue(2, fitEnum, fitActivityManual),
+			fitValue(3, fitEnum, fitEventActivity),
+			fitValue(4, fitEnum, fitEventTypeStop),
+			fitValue(5, fitUint32, int64(act.EndTime.Sub(fitEpoch).Seconds())+int64(offset)),
+		}},
+	)
+
+	return messages
+}
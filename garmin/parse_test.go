@@ -0,0 +1,257 @@
+package garmin
+
+import (
+	"bytes"
+	"encoding/xml"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+	_ "time/tzdata"
+
+	connect "github.com/abrander/garmin-connect"
+	"github.com/mdordoy/peloton-to-garmin/peloton"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// zoneWorkout returns a 20 minute ride starting at start, with a sample every
+// minute and a five minute pause from 10 to 15 minutes in.
+func zoneWorkout(start time.Time) peloton.WorkoutDetail {
+	offsets := []int{0, 60, 120, 180, 240, 300, 360, 420, 480, 540, 600, 900, 960, 1020, 1080, 1140, 1200}
+	output, cadence, heartRate, speed := []float64{}, []float64{}, []float64{}, []float64{}
+	for i := range offsets {
+		output = append(output, float64(150+i*5))
+		cadence = append(cadence, float64(80+i%5))
+		heartRate = append(heartRate, float64(120+i))
+		speed = append(speed, 18+float64(i%3))
+	}
+	return peloton.WorkoutDetail{
+		ID:                        "zones",
+		Title:                     "20 min Ride",
+		FitnessDiscipline:         "cycling",
+		DataGranularityInSeconds:  60,
+		StartTime:                 start,
+		EndTime:                   start.Add(20 * time.Minute),
+		SecondsSincePedalingStart: offsets,
+		Metrics: []peloton.WorkoutDetailMetrics{
+			{Slug: slugOutput, DisplayUnit: "watts", Values: output},
+			{Slug: slugCadence, DisplayUnit: "rpm", Values: cadence},
+			{Slug: slugHeartRate, DisplayUnit: "bpm", Values: heartRate},
+			{Slug: slugSpeed, DisplayUnit: "mph", Values: speed},
+		},
+		Summaries: []peloton.WorkoutDetailSummaries{
+			{Slug: slugDistance, DisplayUnit: "mi", Value: 4.5},
+			{Slug: slugCalories, DisplayUnit: "kcal", Value: 250},
+		},
+		SegmentList: []peloton.WorkoutDetailSegmentList{
+			{StartTimeOffset: 0, Name: "Warm Up"},
+			{StartTimeOffset: 300, Name: "Ride"},
+		},
+	}
+}
+
+// zoneTests are workouts in several time zones, including workouts spanning
+// the start and end of daylight saving time. offset is the UTC offset in
+// force when the workout ended.
+var zoneTests = []struct {
+	name     string
+	location string
+	start    time.Time
+	offset   time.Duration
+}{
+	{"utc", "UTC", time.Date(2024, 3, 1, 7, 0, 0, 0, time.UTC), 0},
+	// 01:50 EST to 03:10 EDT, the clocks go forward at 02:00.
+	{"new_york_dst_start", "America/New_York", time.Date(2024, 3, 10, 6, 50, 0, 0, time.UTC), -4 * time.Hour},
+	// 01:50 EDT to 01:10 EST, the clocks go back at 02:00.
+	{"new_york_dst_end", "America/New_York", time.Date(2024, 11, 3, 5, 50, 0, 0, time.UTC), -5 * time.Hour},
+	{"new_york_winter", "America/New_York", time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC), -5 * time.Hour},
+	// 00:50 GMT to 02:10 BST, the clocks go forward at 01:00.
+	{"london_dst_start", "Europe/London", time.Date(2024, 3, 31, 0, 50, 0, 0, time.UTC), time.Hour},
+	// 01:50 BST to 01:10 GMT, the clocks go back at 02:00.
+	{"london_dst_end", "Europe/London", time.Date(2024, 10, 27, 0, 50, 0, 0, time.UTC), 0},
+	{"london_summer", "Europe/London", time.Date(2024, 7, 1, 6, 0, 0, 0, time.UTC), time.Hour},
+}
+
+// checkGolden compares a converted file with its golden copy in testdata,
+// rewriting the golden copy with -update.
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v, run go test -update to create it", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs from the golden file, run go test -update if the change is intended", name)
+	}
+}
+
+func TestConvertTCXTimeZones(t *testing.T) {
+	for _, test := range zoneTests {
+		location, err := time.LoadLocation(test.location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		workoutDetail := zoneWorkout(test.start)
+		buf, err := ConvertPelotonWorkout(workoutDetail, ConvertOptions{Format: connect.ActivityFormatTCX, Laps: LapsSegments, Location: location})
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		checkGolden(t, test.name+".tcx", buf.Bytes())
+
+		doc := struct {
+			ID   string `xml:"Activities>Activity>Id"`
+			Laps []struct {
+				StartTime   string   `xml:"StartTime,attr"`
+				Trackpoints []string `xml:"Track>Trackpoint>Time"`
+			} `xml:"Activities>Activity>Lap"`
+		}{}
+		if err := xml.Unmarshal(buf.Bytes(), &doc); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		// TCX times are always UTC, whatever the time zone.
+		if want := test.start.UTC().Format("2006-01-02T15:04:05.000Z"); doc.ID != want {
+			t.Errorf("%s: activity id %s, want %s", test.name, doc.ID, want)
+		}
+		if len(doc.Laps) != 2 || doc.Laps[1].StartTime != test.start.Add(5*time.Minute).UTC().Format("2006-01-02T15:04:05.000Z") {
+			t.Errorf("%s: laps %+v, want the second starting 5 minutes in", test.name, doc.Laps)
+		}
+		trackpoints := []string{}
+		for _, l := range doc.Laps {
+			trackpoints = append(trackpoints, l.Trackpoints...)
+		}
+		if len(trackpoints) != len(workoutDetail.SecondsSincePedalingStart) {
+			t.Fatalf("%s: %d trackpoints, want %d", test.name, len(trackpoints), len(workoutDetail.SecondsSincePedalingStart))
+		}
+		for i, offset := range workoutDetail.SecondsSincePedalingStart {
+			want := test.start.Add(time.Duration(offset) * time.Second).UTC().Format("2006-01-02T15:04:05.000Z")
+			if trackpoints[i] != want {
+				t.Errorf("%s: trackpoint %d at %s, want %s", test.name, i, trackpoints[i], want)
+			}
+		}
+	}
+}
+
+func TestConvertFITTimeZones(t *testing.T) {
+	for _, test := range zoneTests {
+		location, err := time.LoadLocation(test.location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		workoutDetail := zoneWorkout(test.start)
+		buf, err := ConvertPelotonWorkout(workoutDetail, ConvertOptions{Format: connect.ActivityFormatFIT, Laps: LapsSegments, Location: location})
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		checkGolden(t, test.name+".fit", buf.Bytes())
+
+		messages, _ := decodeFIT(t, buf.Bytes())
+		records := []int64{}
+		var activity fitMessage
+		for _, msg := range messages {
+			switch msg.Num {
+			case fitMesgRecord:
+				records = append(records, msg.Fields[0].Value)
+			case fitMesgActivity:
+				activity = msg
+			}
+		}
+		// FIT timestamps count seconds since the FIT epoch in UTC.
+		if len(records) != len(workoutDetail.SecondsSincePedalingStart) {
+			t.Fatalf("%s: %d records, want %d", test.name, len(records), len(workoutDetail.SecondsSincePedalingStart))
+		}
+		for i, offset := range workoutDetail.SecondsSincePedalingStart {
+			want := int64(test.start.Add(time.Duration(offset)*time.Second).Sub(fitEpoch) / time.Second)
+			if records[i] != want {
+				t.Errorf("%s: record %d at %d, want %d", test.name, i, records[i], want)
+			}
+		}
+
+		// The activity local_timestamp is the end time shifted by the UTC
+		// offset in force when the workout ended.
+		if len(activity.Fields) < 7 || activity.Fields[0].Num != 253 || activity.Fields[6].Num != 5 {
+			t.Fatalf("%s: unexpected activity message %+v", test.name, activity)
+		}
+		end := int64(test.start.Add(20*time.Minute).Sub(fitEpoch) / time.Second)
+		if activity.Fields[0].Value != end {
+			t.Errorf("%s: activity timestamp %d, want %d", test.name, activity.Fields[0].Value, end)
+		}
+		if got := time.Duration(activity.Fields[6].Value-activity.Fields[0].Value) * time.Second; got != test.offset {
+			t.Errorf("%s: local timestamp offset %v, want %v", test.name, got, test.offset)
+		}
+	}
+}
+
+func TestTrackpointDistanceAndAltitude(t *testing.T) {
+	start := time.Date(2024, 3, 1, 7, 0, 0, 0, time.UTC)
+	run := peloton.WorkoutDetail{
+		ID:                        "run",
+		FitnessDiscipline:         "running",
+		DataGranularityInSeconds:  5,
+		StartTime:                 start,
+		EndTime:                   start.Add(15 * time.Second),
+		SecondsSincePedalingStart: []int{0, 5, 10, 15},
+		Metrics: []peloton.WorkoutDetailMetrics{
+			{Slug: slugSpeed, DisplayUnit: "mph", Values: []float64{6, 6, 6, 6}},
+			{Slug: slugIncline, DisplayUnit: "%", Values: []float64{0, 1, 2, -3}},
+		},
+	}
+	strength := run
+	strength.FitnessDiscipline = "strength"
+	flat := run
+	flat.Metrics = run.Metrics[:1]
+
+	// 6 mph covers 13.4112 m every 5 seconds.
+	tests := []struct {
+		name     string
+		workout  peloton.WorkoutDetail
+		distance []float64
+		altitude []float64
+	}{
+		{"treadmill run", run, []float64{0, 13.4112, 26.8224, 40.2336}, []float64{0, 0.134112, 0.402336, 0.0}},
+		{"treadmill run without incline", flat, []float64{0, 13.4112, 26.8224, 40.2336}, nil},
+		{"strength", strength, nil, nil},
+	}
+	for _, test := range tests {
+		act, err := newActivity(test.workout, ConvertOptions{Laps: LapsSingle, Location: time.UTC})
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		trackpoints := parseTrackpointData(act, act.Samples)
+		if len(trackpoints) != 4 {
+			t.Fatalf("%s: %d trackpoints, want 4", test.name, len(trackpoints))
+		}
+		for i, trackpoint := range trackpoints {
+			if test.distance == nil {
+				if trackpoint.DistanceMeters != nil {
+					t.Errorf("%s: trackpoint %d has distance %v, want none", test.name, i, *trackpoint.DistanceMeters)
+				}
+			} else if trackpoint.DistanceMeters == nil || !closeTo(*trackpoint.DistanceMeters, test.distance[i]) {
+				t.Errorf("%s: trackpoint %d distance %v, want %v", test.name, i, trackpoint.DistanceMeters, test.distance[i])
+			}
+			if test.altitude == nil {
+				if trackpoint.AltitudeMeters != nil {
+					t.Errorf("%s: trackpoint %d has altitude %v, want none", test.name, i, *trackpoint.AltitudeMeters)
+				}
+			} else if trackpoint.AltitudeMeters == nil || !closeTo(*trackpoint.AltitudeMeters, test.altitude[i]) {
+				t.Errorf("%s: trackpoint %d altitude %v, want %v", test.name, i, trackpoint.AltitudeMeters, test.altitude[i])
+			}
+		}
+	}
+
+	buf, err := ConvertPelotonWorkout(run, ConvertOptions{Format: connect.ActivityFormatTCX, Laps: LapsSingle, Location: time.UTC})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte("<Time>2024-03-01T07:00:05.000Z</Time><AltitudeMeters>0.134112</AltitudeMeters><DistanceMeters>13.4112")) {
+		t.Errorf("tcx trackpoints do not carry altitude and distance in schema order:\n%s", buf.Bytes())
+	}
+}
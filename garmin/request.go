@@ -0,0 +1,99 @@
+package garmin
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net/http"
+	"time"
+
+	connect "github.com/abrander/garmin-connect"
+	"github.com/pkg/errors"
+)
+
+// Cookies Garmin Connect keeps its session in.
+const (
+	sessionCookieName      = "SESSIONID"
+	loadBalancerCookieName = "__cflb"
+)
+
+// newHTTPClient returns an HTTP client configured like the library's, which
+// Cloudflare in front of Garmin Connect accepts.
+func newHTTPClient() *http.Client {
+	return &http.Client{
+		Timeout: 2 * time.Minute,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				MinVersion: tls.VersionTLS11,
+				MaxVersion: tls.VersionTLS12,
+			},
+		},
+	}
+}
+
+// send makes a request the library has no method for, or does not report
+// fully, using the clients session. Like the library it logs in again and
+// retries once when Garmin hands out a new session, and clears the session
+// cache when the request is forbidden.
+func (c *Client) send(method, url, contentType string, body []byte) (*http.Response, error) {
+	err := c.authenticate()
+	if err != nil {
+		return nil, err
+	}
+	session := c.session()
+	resp, err := c.sendOnce(method, url, contentType, body, session)
+	if err != nil {
+		return nil, err
+	}
+	if sessionRenewed(resp) {
+		resp.Body.Close()
+		session, err = c.reauthenticate(session)
+		if err != nil {
+			return nil, err
+		}
+		resp, err = c.sendOnce(method, url, contentType, body, session)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		resp.Body.Close()
+		c.persist(connect.ErrForbidden)
+		return nil, connect.ErrForbidden
+	}
+	return resp, nil
+}
+
+func (c *Client) sendOnce(method, url, contentType string, body []byte, session cachedSession) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to build http request")
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	// Garmin Connect requires the nk header on API requests.
+	req.Header.Set("nk", "NT")
+	req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: session.SessionID})
+	if session.LoadBalancerID != "" {
+		req.AddCookie(&http.Cookie{Name: loadBalancerCookieName, Value: session.LoadBalancerID})
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to perform request")
+	}
+	return resp, nil
+}
+
+// sessionRenewed reports whether Garmin replaced the session with the
+// response.
+func sessionRenewed(resp *http.Response) bool {
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == sessionCookieName {
+			return true
+		}
+	}
+	return false
+}
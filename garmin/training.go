@@ -0,0 +1,172 @@
+package garmin
+
+import (
+	"math"
+	"time"
+
+	"github.com/mdordoy/peloton-to-garmin/peloton"
+)
+
+// normalizedPowerWindow is the rolling average normalized power is computed
+// over.
+const normalizedPowerWindow = 30 * time.Second
+
+// powerZoneBounds are the lower bounds of the seven Peloton power zones, as
+// fractions of FTP.
+var powerZoneBounds = []float64{0, 0.55, 0.75, 0.90, 1.05, 1.20, 1.50}
+
+// Athlete holds the thresholds workouts are measured against, taken from the
+// Peloton profile.
+type Athlete struct {
+	// FTP is the cycling functional threshold power in watts.
+	FTP          int
+	MaxHeartRate int
+	// HeartRateZoneBounds are the lower bounds of the heart rate zones, as
+	// fractions of MaxHeartRate.
+	HeartRateZoneBounds []float64
+}
+
+// NewAthlete returns the thresholds of a Peloton profile. The FTP Peloton
+// estimates is used when the member has not taken an FTP test, and the max
+// heart rate Peloton works out from their age when they have not set one.
+func NewAthlete(user peloton.User) *Athlete {
+	athlete := &Athlete{FTP: user.Ftp, MaxHeartRate: user.CustomMaxHr}
+	if athlete.FTP <= 0 {
+		athlete.FTP = user.EstimatedFtp
+	}
+	if athlete.MaxHeartRate <= 0 {
+		athlete.MaxHeartRate = user.DefaultMaxHr
+	}
+	for _, bound := range user.DefaultHrZones {
+		// Some profiles report the zones as percentages.
+		if bound > 1 {
+			bound /= 100
+		}
+		athlete.HeartRateZoneBounds = append(athlete.HeartRateZoneBounds, bound)
+	}
+	return athlete
+}
+
+// Zone is a power or heart rate training zone and the time spent in it.
+type Zone struct {
+	// Zone is the zone number, starting from 1.
+	Zone int `json:"zone"`
+	// Min and Max are the watts or beats per minute the zone covers. Max is
+	// 0 for the top zone.
+	Min  int           `json:"min"`
+	Max  int           `json:"max,omitempty"`
+	Time time.Duration `json:"-"`
+}
+
+// PowerZones returns the Peloton power zones for the athletes FTP, or nil
+// without an FTP.
+func (a *Athlete) PowerZones() []Zone {
+	if a == nil || a.FTP <= 0 {
+		return nil
+	}
+	return zones(powerZoneBounds, float64(a.FTP))
+}
+
+// HeartRateZones returns the heart rate zones for the athletes max heart
+// rate, or nil without one.
+func (a *Athlete) HeartRateZones() []Zone {
+	if a == nil || a.MaxHeartRate <= 0 || len(a.HeartRateZoneBounds) == 0 {
+		return nil
+	}
+	return zones(a.HeartRateZoneBounds, float64(a.MaxHeartRate))
+}
+
+func zones(bounds []float64, threshold float64) []Zone {
+	result := make([]Zone, len(bounds))
+	for i, bound := range bounds {
+		result[i] = Zone{Zone: i + 1, Min: int(math.Round(bound * threshold))}
+		if i > 0 {
+			result[i-1].Max = result[i].Min
+		}
+	}
+	return result
+}
+
+// training is the training load of a workout, measured against the athletes
+// thresholds. Metrics that cannot be worked out are left zero.
+type training struct {
+	FTP             int
+	NormalizedPower float64
+	IntensityFactor float64
+	// TSS is the training stress score, where an hour at FTP scores 100.
+	TSS            float64
+	PowerZones     []Zone
+	HeartRateZones []Zone
+}
+
+// newTraining measures the samples of a workout against the athletes
+// thresholds. Each sample covers the interval before it, so a pause does not
+// count towards a zone. Power is only measured for sports the cycling FTP
+// applies to.
+func newTraining(samples []sample, interval time.Duration, sport sportMapping, athlete *Athlete) training {
+	t := training{HeartRateZones: athlete.HeartRateZones()}
+	if sport.FTP {
+		t.PowerZones = athlete.PowerZones()
+	}
+	if len(samples) < 2 || interval <= 0 {
+		return t
+	}
+	hasPower := false
+	for _, s := range samples[1:] {
+		if s.Watts > 0 {
+			hasPower = true
+		}
+		addZoneTime(t.HeartRateZones, s.HeartRate, interval)
+		addZoneTime(t.PowerZones, s.Watts, interval)
+	}
+	if t.PowerZones == nil || !hasPower {
+		t.PowerZones = nil
+		return t
+	}
+
+	t.FTP = athlete.FTP
+	t.NormalizedPower = normalizedPower(samples[1:], interval)
+	t.IntensityFactor = t.NormalizedPower / float64(t.FTP)
+	duration := time.Duration(len(samples)-1) * interval
+	t.TSS = duration.Hours() * t.IntensityFactor * t.IntensityFactor * 100
+	return t
+}
+
+// addZoneTime adds interval to the zone value falls in. Zero values are
+// missing readings and not counted.
+func addZoneTime(zones []Zone, value int, interval time.Duration) {
+	if value <= 0 {
+		return
+	}
+	for i := len(zones) - 1; i >= 0; i-- {
+		if value >= zones[i].Min {
+			zones[i].Time += interval
+			return
+		}
+	}
+}
+
+// normalizedPower is the fourth root of the mean of the fourth powers of the
+// 30 second rolling average power. Workouts shorter than the window use their
+// average power.
+func normalizedPower(samples []sample, interval time.Duration) float64 {
+	window := int(normalizedPowerWindow / interval)
+	if window < 1 {
+		window = 1
+	}
+	if len(samples) < window {
+		window = len(samples)
+	}
+	sum, total, count := 0, 0.0, 0
+	for i, s := range samples {
+		sum += s.Watts
+		if i >= window {
+			sum -= samples[i-window].Watts
+		}
+		if i+1 >= window {
+			total += math.Pow(float64(sum)/float64(window), 4)
+			count++
+		}
+	}
+	return math.Pow(total/float64(count), 0.25)
+}
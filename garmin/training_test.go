@@ -0,0 +1,159 @@
+package garmin
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// powerSamples returns a sample for each watts value. newTraining skips the
+// first sample, which marks the start, so a zero sample is put in front.
+func powerSamples(watts ...int) []sample {
+	samples := []sample{{}}
+	for _, w := range watts {
+		samples = append(samples, sample{Watts: w})
+	}
+	return samples
+}
+
+func repeat(value, count int) []int {
+	values := make([]int, count)
+	for i := range values {
+		values[i] = value
+	}
+	return values
+}
+
+func closeTo(got, want float64) bool {
+	return math.Abs(got-want) < 1e-6
+}
+
+func TestNewTrainingLoad(t *testing.T) {
+	cycling := sportMappings["cycling"]
+	// Alternating 400 W and 0 W every 30 seconds for an hour averages 200 W,
+	// but the rolling average covers a single sample so NP is the fourth
+	// root of half of 400^4.
+	intervals := []int{}
+	for i := 0; i < 60; i++ {
+		intervals = append(intervals, 400, 0)
+	}
+	// 30 seconds at 0 W then 30 at 300 W give rolling averages of 0, 10, ...
+	// 300 W over the last 31 seconds.
+	sumOfFourthPowers := 0.0
+	for k := 1; k <= 30; k++ {
+		sumOfFourthPowers += math.Pow(float64(k), 4)
+	}
+	steps := append(repeat(0, 30), repeat(300, 30)...)
+	stepsNP := 10 * math.Pow(sumOfFourthPowers/31, 0.25)
+
+	tests := []struct {
+		name     string
+		samples  []sample
+		interval time.Duration
+		ftp      int
+		np       float64
+		ifactor  float64
+		tss      float64
+	}{
+		{"an hour at ftp", powerSamples(repeat(200, 3600)...), time.Second, 200, 200, 1, 100},
+		{"half an hour at ftp", powerSamples(repeat(250, 1800)...), time.Second, 250, 250, 1, 50},
+		{"an hour at 80% of ftp", powerSamples(repeat(160, 720)...), 5 * time.Second, 200, 160, 0.8, 64},
+		{"intervals", powerSamples(intervals...), 30 * time.Second, 250, 400 * math.Pow(0.5, 0.25), 1.6 * math.Pow(0.5, 0.25), 100 * 2.56 * math.Sqrt(0.5)},
+		{"rolling average", powerSamples(steps...), time.Second, 200, stepsNP, stepsNP / 200, math.Pow(stepsNP/200, 2) * 100 / 60},
+		{"under 30 samples", powerSamples(100, 110, 120, 130, 140, 150, 160, 170, 180, 190), time.Second, 145, 145, 1, 10.0 / 36},
+	}
+	for _, test := range tests {
+		got := newTraining(test.samples, test.interval, cycling, &Athlete{FTP: test.ftp})
+		if got.FTP != test.ftp {
+			t.Errorf("%s: FTP %d, want %d", test.name, got.FTP, test.ftp)
+		}
+		if !closeTo(got.NormalizedPower, test.np) || !closeTo(got.IntensityFactor, test.ifactor) || !closeTo(got.TSS, test.tss) {
+			t.Errorf("%s: NP %.4f, IF %.4f, TSS %.4f, want NP %.4f, IF %.4f, TSS %.4f", test.name, got.NormalizedPower, got.IntensityFactor, got.TSS, test.np, test.ifactor, test.tss)
+		}
+	}
+}
+
+func TestNormalizedPowerShortWorkout(t *testing.T) {
+	// Fewer samples than the 30 second window use the average power.
+	samples := powerSamples(100, 200, 300)[1:]
+	if got := normalizedPower(samples, time.Second); !closeTo(got, 200) {
+		t.Errorf("normalizedPower = %v, want 200", got)
+	}
+	// Samples further apart than the window are each their own average.
+	if got := normalizedPower(samples, time.Minute); !closeTo(got, math.Pow((math.Pow(100, 4)+math.Pow(200, 4)+math.Pow(300, 4))/3, 0.25)) {
+		t.Errorf("normalizedPower with one minute samples = %v", got)
+	}
+}
+
+func TestNewTrainingWithoutFTP(t *testing.T) {
+	samples := powerSamples(repeat(200, 600)...)
+	tests := []struct {
+		name    string
+		sport   sportMapping
+		athlete *Athlete
+	}{
+		{"zero ftp", sportMappings["cycling"], &Athlete{}},
+		{"no athlete", sportMappings["cycling"], nil},
+		{"not measured against ftp", sportMappings["running"], &Athlete{FTP: 200}},
+	}
+	for _, test := range tests {
+		got := newTraining(samples, time.Second, test.sport, test.athlete)
+		if got.FTP != 0 || got.NormalizedPower != 0 || got.IntensityFactor != 0 || got.TSS != 0 || got.PowerZones != nil {
+			t.Errorf("%s: got %+v, want no power training load", test.name, got)
+		}
+	}
+
+	got := newTraining(powerSamples(repeat(0, 600)...), time.Second, sportMappings["cycling"], &Athlete{FTP: 200})
+	if got.NormalizedPower != 0 || got.PowerZones != nil {
+		t.Errorf("without power: got %+v, want no power training load", got)
+	}
+}
+
+func TestNewTrainingZones(t *testing.T) {
+	athlete := &Athlete{FTP: 200, MaxHeartRate: 200, HeartRateZoneBounds: []float64{0, 0.65, 0.75, 0.85, 0.95}}
+	samples := []sample{{}}
+	for i := 0; i < 10; i++ {
+		samples = append(samples, sample{Watts: 100, HeartRate: 120})
+	}
+	for i := 0; i < 20; i++ {
+		samples = append(samples, sample{Watts: 160, HeartRate: 160})
+	}
+	// Readings without heart rate are left out of the heart rate zones.
+	for i := 0; i < 5; i++ {
+		samples = append(samples, sample{Watts: 300})
+	}
+
+	got := newTraining(samples, 2*time.Second, sportMappings["cycling"], athlete)
+
+	wantPower := []Zone{
+		{Zone: 1, Min: 0, Max: 110, Time: 20 * time.Second},
+		{Zone: 2, Min: 110, Max: 150},
+		{Zone: 3, Min: 150, Max: 180, Time: 40 * time.Second},
+		{Zone: 4, Min: 180, Max: 210},
+		{Zone: 5, Min: 210, Max: 240},
+		{Zone: 6, Min: 240, Max: 300},
+		{Zone: 7, Min: 300, Time: 10 * time.Second},
+	}
+	wantHeartRate := []Zone{
+		{Zone: 1, Min: 0, Max: 130, Time: 20 * time.Second},
+		{Zone: 2, Min: 130, Max: 150},
+		{Zone: 3, Min: 150, Max: 170, Time: 40 * time.Second},
+		{Zone: 4, Min: 170, Max: 190},
+		{Zone: 5, Min: 190},
+	}
+	compareZones(t, "power", got.PowerZones, wantPower)
+	compareZones(t, "heart rate", got.HeartRateZones, wantHeartRate)
+}
+
+func compareZones(t *testing.T, name string, got, want []Zone) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("%s zones %+v, want %+v", name, got, want)
+		return
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("%s zone %d %+v, want %+v", name, i+1, got[i], want[i])
+		}
+	}
+}
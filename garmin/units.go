@@ -0,0 +1,114 @@
+package garmin
+
+import (
+	"strings"
+
+	"github.com/mdordoy/peloton-to-garmin/peloton"
+)
+
+// Peloton reports metrics in the units the account is configured for, so
+// metrics are found by their slug, which does not change with the locale, and
+// converted to SI units using their display unit.
+
+const feetToMeters = 0.3048
+
+// Metric slugs used by the performance graph.
+const (
+	slugOutput     = "output"
+	slugCadence    = "cadence"
+	slugStrokeRate = "stroke_rate"
+	slugHeartRate  = "heart_rate"
+	slugSpeed      = "speed"
+	slugPace       = "pace"
+	slugSplitPace  = "split_pace"
+	slugIncline    = "incline"
+	slugDistance   = "distance"
+	slugCalories   = "calories"
+	slugElevation  = "elevation"
+	slugAvgOutput  = "avg_output"
+	slugAvgSpeed   = "avg_speed"
+	slugAvgPace    = "avg_pace"
+	// slugTotalOutput is the work done in kilojoules.
+	slugTotalOutput = "total_output"
+)
+
+// toMeters converts a distance to meters. Distances without a recognised unit
+// are assumed to be in miles, the unit Peloton defaults to.
+func toMeters(value float64, unit string) float64 {
+	switch strings.ToLower(unit) {
+	case "m":
+		return value
+	case "km":
+		return value * 1000
+	case "ft":
+		return value * feetToMeters
+	}
+	return value * milesToMetersDistance
+}
+
+// toMetersPerSecond converts a speed or pace to meters per second. Paces are
+// the time taken to cover a distance, so zero means no movement. When unit is
+// missing the slug decides between mph, min/mi and seconds per 500m.
+func toMetersPerSecond(value float64, slug, unit string) float64 {
+	if value <= 0 {
+		return 0
+	}
+	unit = strings.ToLower(unit)
+	if unit == "" {
+		switch slug {
+		case slugPace, slugAvgPace:
+			unit = "min/mi"
+		case slugSplitPace:
+			unit = "/500m"
+		default:
+			unit = "mph"
+		}
+	}
+	switch unit {
+	case "m/s":
+		return value
+	case "kph", "km/h":
+		return value * 1000 / 3600
+	case "min/mi":
+		return milesToMetersDistance / (value * 60)
+	case "min/km":
+		return 1000 / (value * 60)
+	case "/500m", "sec/500m", "s/500m":
+		return 500 / value
+	}
+	return value * milesToMetersDistance / 3600
+}
+
+// isSpeedSlug reports whether a metric describes how fast the user moved.
+func isSpeedSlug(slug string) bool {
+	return slug == slugSpeed || slug == slugPace || slug == slugSplitPace
+}
+
+func findMetric(metrics []peloton.WorkoutDetailMetrics, slugs ...string) (peloton.WorkoutDetailMetrics, bool) {
+	for _, slug := range slugs {
+		for _, metric := range metrics {
+			if metric.Slug == slug {
+				return metric, true
+			}
+		}
+	}
+	return peloton.WorkoutDetailMetrics{}, false
+}
+
+func findSummary(summaries []peloton.WorkoutDetailSummaries, slug string) (peloton.WorkoutDetailSummaries, bool) {
+	for _, summary := range summaries {
+		if summary.Slug == slug {
+			return summary, true
+		}
+	}
+	return peloton.WorkoutDetailSummaries{}, false
+}
+
+func findAverage(averages []peloton.WorkoutDetailAverageSummaries, slug string) (peloton.WorkoutDetailAverageSummaries, bool) {
+	for _, average := range averages {
+		if average.Slug == slug {
+			return average, true
+		}
+	}
+	return peloton.WorkoutDetailAverageSummaries{}, false
+}
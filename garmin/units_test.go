@@ -0,0 +1,63 @@
+package garmin
+
+import (
+	"math"
+	"testing"
+)
+
+func TestToMeters(t *testing.T) {
+	tests := []struct {
+		value float64
+		unit  string
+		want  float64
+	}{
+		{1, "mi", 1609.344},
+		{3.1, "mi", 4988.9664},
+		{5, "km", 5000},
+		{5, "KM", 5000},
+		{400, "m", 400},
+		{100, "ft", 30.48},
+		// Without a unit the distance is taken to be in miles.
+		{2, "", 3218.688},
+	}
+	for _, test := range tests {
+		got := toMeters(test.value, test.unit)
+		if math.Abs(got-test.want) > 1e-6 {
+			t.Errorf("toMeters(%v, %q) = %v, want %v", test.value, test.unit, got, test.want)
+		}
+	}
+}
+
+func TestToMetersPerSecond(t *testing.T) {
+	tests := []struct {
+		value float64
+		slug  string
+		unit  string
+		want  float64
+	}{
+		{10, slugSpeed, "mph", 4.4704},
+		{18, slugSpeed, "kph", 5},
+		{18, slugSpeed, "km/h", 5},
+		{3, slugSpeed, "m/s", 3},
+		{8, slugPace, "min/mi", 3.3528},
+		{5, slugPace, "min/km", 1000.0 / 300},
+		{120, slugSplitPace, "/500m", 500.0 / 120},
+		{120, slugSplitPace, "sec/500m", 500.0 / 120},
+		// Without a unit the slug decides, assuming miles for speed and pace.
+		{10, slugSpeed, "", 4.4704},
+		{10, slugAvgSpeed, "", 4.4704},
+		{8, slugPace, "", 3.3528},
+		{8, slugAvgPace, "", 3.3528},
+		{120, slugSplitPace, "", 500.0 / 120},
+		// A pace of zero means standing still, not infinitely fast.
+		{0, slugPace, "min/mi", 0},
+		{0, slugSplitPace, "/500m", 0},
+		{-1, slugSpeed, "mph", 0},
+	}
+	for _, test := range tests {
+		got := toMetersPerSecond(test.value, test.slug, test.unit)
+		if math.Abs(got-test.want) > 1e-6 {
+			t.Errorf("toMetersPerSecond(%v, %q, %q) = %v, want %v", test.value, test.slug, test.unit, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package garmin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	connect "github.com/abrander/garmin-connect"
+	"github.com/pkg/errors"
+)
+
+// uploadURL is the upload endpoint, the file extension is appended to it.
+const uploadURL = "https://connect.garmin.com/modern/proxy/upload-service/upload/."
+
+// duplicateCode is the message code Garmin uses for an activity that has
+// already been uploaded.
+const duplicateCode = 202
+
+// UploadStatus is what Garmin did with an uploaded activity.
+type UploadStatus int
+
+const (
+	// UploadCreated means the activity was created.
+	UploadCreated UploadStatus = iota
+	// UploadPending means Garmin accepted the file but is still processing
+	// it, see Client.UploadStatus.
+	UploadPending
+	// UploadDuplicate means the activity already exists in Garmin.
+	UploadDuplicate
+	// UploadFailed means Garmin rejected the file.
+	UploadFailed
+)
+
+func (s UploadStatus) String() string {
+	switch s {
+	case UploadCreated:
+		return "created"
+	case UploadPending:
+		return "pending"
+	case UploadDuplicate:
+		return "duplicate"
+	}
+	return "failed"
+}
+
+// UploadResult describes the outcome of an upload.
+type UploadResult struct {
+	Status UploadStatus
+	// ActivityID is the created activity or, for a duplicate, the activity
+	// already in Garmin. Garmin does not always say which activity a
+	// duplicate is.
+	ActivityID int
+	// UploadID identifies a pending upload.
+	UploadID int
+	// Message is the reason Garmin gave for a failed upload.
+	Message string
+	// statusURL is where a pending upload is polled.
+	statusURL string
+}
+
+// uploadResponse is the part of the upload service response describing the
+// outcome, both when uploading and when polling.
+type uploadResponse struct {
+	ImportResult struct {
+		UploadID  int `json:"uploadId"`
+		Successes []struct {
+			InternalID int `json:"internalId"`
+		} `json:"successes"`
+		Failures []struct {
+			InternalID int `json:"internalId"`
+			Messages   []struct {
+				Code    int    `json:"code"`
+				Content string `json:"content"`
+			} `json:"messages"`
+		} `json:"failures"`
+	} `json:"detailedImportResult"`
+}
+
+// result interprets the response. A response without successes or failures
+// is still being processed.
+func (r uploadResponse) result(statusURL string) UploadResult {
+	imp := r.ImportResult
+	if len(imp.Failures) > 0 {
+		messages := []string{}
+		for _, failure := range imp.Failures {
+			for _, message := range failure.Messages {
+				if message.Code == duplicateCode || strings.Contains(message.Content, "Duplicate Activity") {
+					return UploadResult{Status: UploadDuplicate, ActivityID: failure.InternalID, UploadID: imp.UploadID, Message: message.Content}
+				}
+				messages = append(messages, message.Content)
+			}
+		}
+		return UploadResult{Status: UploadFailed, UploadID: imp.UploadID, Message: strings.Join(messages, "; ")}
+	}
+	if len(imp.Successes) > 0 && imp.Successes[0].InternalID != 0 {
+		return UploadResult{Status: UploadCreated, ActivityID: imp.Successes[0].InternalID, UploadID: imp.UploadID}
+	}
+	return UploadResult{Status: UploadPending, UploadID: imp.UploadID, statusURL: statusURL}
+}
+
+// Upload uploads an activity file. Unlike connect.Client.ImportActivity it
+// reports files Garmin is still processing and duplicates as results rather
+// than errors. An error means the upload did not reach Garmin or the session
+// was rejected.
+func (c *Client) Upload(file []byte, format connect.ActivityFormat) (UploadResult, error) {
+	switch format {
+	case connect.ActivityFormatFIT, connect.ActivityFormatTCX:
+	default:
+		return UploadResult{}, errors.New(fmt.Sprintf("Unsupported activity format: %s", format.Extension()))
+	}
+	body, contentType, err := uploadBody(file, format)
+	if err != nil {
+		return UploadResult{}, err
+	}
+	resp, err := c.send(http.MethodPost, uploadURL+format.Extension(), contentType, body)
+	if err != nil {
+		return UploadResult{}, errors.Wrap(err, "failed to upload activity")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return UploadResult{}, errors.New(fmt.Sprintf("garmin upload failed: %d: %s", resp.StatusCode, http.StatusText(resp.StatusCode)))
+	}
+
+	response := uploadResponse{}
+	err = json.NewDecoder(resp.Body).Decode(&response)
+	if err != nil {
+		if resp.StatusCode == http.StatusAccepted {
+			return UploadResult{Status: UploadPending, statusURL: statusLocation(resp)}, nil
+		}
+		if resp.StatusCode >= http.StatusBadRequest {
+			return UploadResult{Status: UploadFailed, Message: fmt.Sprintf("%d: %s", resp.StatusCode, http.StatusText(resp.StatusCode))}, nil
+		}
+		return UploadResult{}, errors.Wrap(err, "failed to decode garmin upload response")
+	}
+	return response.result(statusLocation(resp)), nil
+}
+
+// UploadStatus checks on a pending upload once, returning its new result.
+func (c *Client) UploadStatus(pending UploadResult) (UploadResult, error) {
+	if pending.Status != UploadPending {
+		return pending, nil
+	}
+	if pending.statusURL == "" {
+		return pending, errors.New(fmt.Sprintf("garmin did not say where to check on upload %d", pending.UploadID))
+	}
+	buf := bytes.Buffer{}
+	err := c.call(func() error {
+		return c.Download(pending.statusURL, &buf)
+	})
+	if err != nil {
+		return pending, errors.Wrapf(err, "failed to check on upload %d", pending.UploadID)
+	}
+	response := uploadResponse{}
+	err = json.Unmarshal(buf.Bytes(), &response)
+	if err != nil {
+		return pending, errors.Wrapf(err, "failed to decode status of upload %d", pending.UploadID)
+	}
+	result := response.result(pending.statusURL)
+	if result.UploadID == 0 {
+		result.UploadID = pending.UploadID
+	}
+	return result, nil
+}
+
+// uploadBody encodes an activity file as the multipart form Garmin expects,
+// returning the body and its content type.
+func uploadBody(file []byte, format connect.ActivityFormat) ([]byte, string, error) {
+	body := bytes.Buffer{}
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreateFormFile("file", "activity."+format.Extension())
+	if err != nil {
+		return nil, "", errors.Wrap(err, "failed to build upload")
+	}
+	_, err = part.Write(file)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "failed to build upload")
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, "", errors.Wrap(err, "failed to build upload")
+	}
+	return body.Bytes(), writer.FormDataContentType(), nil
+}
+
+// statusLocation returns where Garmin says a pending upload can be polled,
+// resolved against the upload URL.
+func statusLocation(resp *http.Response) string {
+	location, err := resp.Location()
+	if err != nil {
+		return ""
+	}
+	return location.String()
+}
@@ -0,0 +1,71 @@
+package garmin
+
+import (
+	"time"
+
+	connect "github.com/abrander/garmin-connect"
+	"github.com/pkg/errors"
+)
+
+// GramsPerPound converts the pounds Peloton records body weight in to the
+// grams Garmin uses.
+const GramsPerPound = 453.59237
+
+// LatestWeight returns the most recent weigh-in on or before date, and false
+// when Garmin has none.
+func (c *Client) LatestWeight(date time.Time) (connect.Weightin, bool, error) {
+	err := c.authenticate()
+	if err != nil {
+		return connect.Weightin{}, false, err
+	}
+	var weightin *connect.Weightin
+	err = c.call(func() (err error) {
+		weightin, err = c.Client.LatestWeight(date)
+		return err
+	})
+	if errors.Is(err, connect.ErrNotFound) {
+		return connect.Weightin{}, false, nil
+	}
+	if err != nil {
+		return connect.Weightin{}, false, errors.Wrap(err, "failed to get the latest garmin weigh-in")
+	}
+	if weightin == nil || weightin.Weight <= 0 {
+		return connect.Weightin{}, false, nil
+	}
+	return *weightin, true, nil
+}
+
+// HasWeightOn reports whether Garmin has a weigh-in on the day of date.
+func (c *Client) HasWeightOn(date time.Time) (bool, error) {
+	err := c.authenticate()
+	if err != nil {
+		return false, err
+	}
+	err = c.call(func() error {
+		_, _, err := c.Client.WeightByDate(date)
+		return err
+	})
+	if errors.Is(err, connect.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to get the garmin weigh-in of %s", date.Format("2006-01-02"))
+	}
+	return true, nil
+}
+
+// AddWeight adds a manual weigh-in of grams on the day of date, see
+// connect.Client.AddUserWeight.
+func (c *Client) AddWeight(date time.Time, grams float64) error {
+	err := c.authenticate()
+	if err != nil {
+		return err
+	}
+	err = c.call(func() error {
+		return c.Client.AddUserWeight(date, grams)
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to add garmin weigh-in")
+	}
+	return nil
+}
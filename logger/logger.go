@@ -9,17 +9,25 @@ import (
 
 // NewLogger returns a zerolog logger based on the conventions in a LoggingConfig
 func NewLogger(logLevel string, pretty bool) zerolog.Logger {
+	return NewLoggerTo(os.Stdout, logLevel, pretty)
+}
+
+// NewLoggerTo returns a logger like NewLogger that writes to out.
+func NewLoggerTo(out io.Writer, logLevel string, pretty bool) zerolog.Logger {
 	level, err := zerolog.ParseLevel(logLevel)
 	if err != nil {
 		level = zerolog.InfoLevel
 	}
 
-	out := io.Writer(os.Stdout)
-	if pretty {
-		out = zerolog.ConsoleWriter{Out: out}
-	}
-
-	logger := zerolog.New(out).With().Timestamp().Logger()
+	logger := zerolog.New(Writer(out, pretty)).With().Timestamp().Logger()
 
 	return logger.Level(level)
 }
+
+// Writer returns the writer a logger uses to write log events to out.
+func Writer(out io.Writer, pretty bool) io.Writer {
+	if pretty {
+		return zerolog.ConsoleWriter{Out: out}
+	}
+	return out
+}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"os"
+	// Embed the time zone database for --timezone on hosts without one, such
+	// as Windows.
+	_ "time/tzdata"
 
 	"github.com/mdordoy/peloton-to-garmin/cmd"
 )
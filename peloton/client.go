@@ -5,6 +5,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -15,25 +18,75 @@ type authResponse struct {
 	UserID    string `json:"user_id"`
 }
 
+type authErrorResponse struct {
+	Message string `json:"message"`
+}
+
+// sessionCookieName is the cookie Peloton uses to identify a logged in session.
+const sessionCookieName = "peloton_session_id"
+
+// AuthError is returned when Peloton rejects the username or password, as
+// opposed to the login request failing to reach Peloton at all.
+type AuthError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *AuthError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("peloton rejected the credentials, status code %d", e.StatusCode)
+	}
+	return fmt.Sprintf("peloton rejected the credentials: %s", e.Message)
+}
+
+// Option configures optional Client behaviour.
+type Option func(*Client)
+
+// SessionCache persists the Peloton session to path so later runs can reuse
+// it instead of logging in again.
+func SessionCache(path string) Option {
+	return func(c *Client) {
+		c.sessionCache = path
+	}
+}
+
 type Client struct {
-	httpClient http.Client
-	UserID     string
-	authCookie *http.Cookie
-	Host       string
+	httpClient   http.Client
+	UserID       string
+	authCookie   *http.Cookie
+	Host         string
+	username     string
+	password     string
+	sessionCache string
+	mu           sync.Mutex
+	// authMu serializes logging in again, so workers rejected at the same
+	// time share one new session.
+	authMu sync.Mutex
 }
 
-func NewClient(username, password, host string) (Client, error) {
+// NewClient returns a Peloton client with an authenticated session, reusing a
+// cached session when one is configured and still present.
+func NewClient(username, password, host string, options ...Option) (*Client, error) {
 
 	httpClient := http.Client{
 		Timeout: time.Second * 10,
 	}
 
-	pelotonClient := Client{
+	pelotonClient := &Client{
 		httpClient: httpClient,
 		Host:       host,
+		username:   username,
+		password:   password,
+	}
+	for _, option := range options {
+		option(pelotonClient)
+	}
+
+	if pelotonClient.loadSession() {
+		return pelotonClient, nil
 	}
 
-	err := pelotonClient.getSessionCookie(username, password)
+	err := pelotonClient.getSessionCookie()
 	if err != nil {
 		return pelotonClient, errors.Wrap(err, "failed to authenticate to peloton")
 	}
@@ -41,10 +94,16 @@ func NewClient(username, password, host string) (Client, error) {
 	return pelotonClient, nil
 }
 
-func (c *Client) getSessionCookie(username, password string) error {
+func (c *Client) getSessionCookie() error {
 
-	postData := bytes.NewBuffer([]byte(fmt.Sprintf("{\"username_or_email\": \"%v\", \"password\": \"%v\"}", username, password)))
-	req, err := http.NewRequest("POST", fmt.Sprintf("https://%s/auth/login", c.Host), postData)
+	body, err := json.Marshal(map[string]string{
+		"username_or_email": c.username,
+		"password":          c.password,
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to encode login request")
+	}
+	req, err := http.NewRequest("POST", fmt.Sprintf("https://%s/auth/login", c.Host), bytes.NewBuffer(body))
 	if err != nil {
 		return errors.Wrap(err, "failed to build http request")
 	}
@@ -57,67 +116,219 @@ func (c *Client) getSessionCookie(username, password string) error {
 
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		authErr := authErrorResponse{}
+		_ = json.NewDecoder(resp.Body).Decode(&authErr)
+		return &AuthError{StatusCode: resp.StatusCode, Message: authErr.Message}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New(fmt.Sprintf("login returned an unxpected status code: %d", resp.StatusCode))
+	}
+
 	authResp := authResponse{}
 	err = json.NewDecoder(resp.Body).Decode(&authResp)
 	if err != nil {
 		return errors.Wrap(err, "failed to decode peloton auth response")
 	}
-	c.UserID = authResp.UserID
+
+	var authCookie *http.Cookie
 	for _, cookie := range resp.Cookies() {
-		if cookie.Name == "peloton_session_id" {
-			c.authCookie = cookie
+		if cookie.Name == sessionCookieName {
+			authCookie = cookie
 		}
 	}
+	if authCookie == nil {
+		return errors.New("peloton login response did not contain a session cookie")
+	}
+
+	c.mu.Lock()
+	c.UserID = authResp.UserID
+	c.authCookie = authCookie
+	c.mu.Unlock()
 
+	c.saveSession()
 	return nil
 }
 
-func (c *Client) GetWorkouts(instances int) ([]WorkoutData, error) {
-	workoutData := []WorkoutData{}
-	instanceCount := 0
-	page := 0
-	for instanceCount < instances {
-		req, err := http.NewRequest("GET", fmt.Sprintf("https://%s/api/user/%s/workouts?joins=peloton.ride&limit=%d&page=%d&sort_by=-created", c.Host, c.UserID, instances, page), nil)
-		if err != nil {
-			return workoutData, errors.Wrap(err, "failed to bulid users workouts request")
-		}
+// do performs an authenticated GET request. When Peloton reports the session
+// is no longer valid it logs in again and retries the request once.
+func (c *Client) do(url string) (*http.Response, error) {
+	c.mu.Lock()
+	cookie := c.authCookie
+	c.mu.Unlock()
+	resp, err := c.get(url, cookie)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden {
+		return resp, nil
+	}
+	resp.Body.Close()
 
-		req.Header.Add("Content-Type", "application/json")
-		req.AddCookie(c.authCookie)
+	cookie, err = c.reauthenticate(cookie)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to re-authenticate to peloton")
+	}
+	return c.get(url, cookie)
+}
 
-		resp, err := c.httpClient.Do(req)
+// reauthenticate logs in again after Peloton rejected the session in
+// rejected, returning the new session cookie. Only one login runs at a time,
+// and a worker that waited for another's login reuses its session.
+func (c *Client) reauthenticate(rejected *http.Cookie) (*http.Cookie, error) {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
 
-		if err != nil {
-			return workoutData, errors.Wrapf(err, "failed to get user workouts response. StatusCode: %d", resp.StatusCode)
-		}
+	c.mu.Lock()
+	current := c.authCookie
+	c.mu.Unlock()
+	if current != rejected {
+		return current, nil
+	}
 
-		if resp.StatusCode < 200 || resp.StatusCode > 299 {
-			return workoutData, errors.New(fmt.Sprintf("API returned an unxpected status code: %d", resp.StatusCode))
-		}
+	err := c.getSessionCookie()
+	if err != nil {
+		// The cached session was rejected too, so the next run must not
+		// reuse it.
+		_ = c.clearSession()
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.authCookie, nil
+}
+
+func (c *Client) get(url string, cookie *http.Cookie) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to build http request")
+	}
+	req.Header.Add("Content-Type", "application/json")
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to perform request")
+	}
+	return resp, nil
+}
+
+// userURL returns an API URL for the logged in user.
+func (c *Client) userURL(format string, args ...interface{}) string {
+	c.mu.Lock()
+	userID := c.UserID
+	c.mu.Unlock()
+	return fmt.Sprintf("https://%s/api/user/%s/%s", c.Host, userID, fmt.Sprintf(format, args...))
+}
+
+// GetUser returns the profile of the logged in user.
+func (c *Client) GetUser() (User, error) {
+	user := User{}
+	resp, err := c.do(fmt.Sprintf("https://%s/api/me", c.Host))
+	if err != nil {
+		return user, errors.Wrap(err, "failed to get user profile response")
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return user, errors.New(fmt.Sprintf("API returned an unxpected status code: %d", resp.StatusCode))
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&user)
+	if err != nil {
+		return user, errors.Wrap(err, "failed to decode response for user profile")
+	}
+	return user, nil
+}
+
+// workoutsPageSize is the number of workouts requested per page.
+const workoutsPageSize = 50
+
+// workoutJoins expands the class and instructor of each workout.
+const workoutJoins = "peloton.ride,peloton.ride.instructor"
+
+// createdSlack is how long before it started a workout may have been created.
+// Workouts are listed by creation time but filtered on their start time, so
+// paging goes on until workouts were created this long before query.Since.
+const createdSlack = 24 * time.Hour
+
+// GetWorkouts returns the most recent workouts, newest first.
+func (c *Client) GetWorkouts(instances int) ([]WorkoutData, error) {
+	return c.ListWorkouts(WorkoutQuery{Limit: instances})
+}
 
-		defer resp.Body.Close()
-		workouts := Workouts{}
-		err = json.NewDecoder(resp.Body).Decode(&workouts)
+// ListWorkouts pages through the users workouts, newest first, returning those
+// matching query. Paging stops once workouts were created more than
+// createdSlack before query.Since.
+func (c *Client) ListWorkouts(query WorkoutQuery) ([]WorkoutData, error) {
+	workoutData := []WorkoutData{}
+	for page := 0; ; page++ {
+		workouts, err := c.getWorkoutsPage(page)
 		if err != nil {
-			return workoutData, errors.Wrap(err, "failed to decode response for user workouts")
+			return workoutData, err
 		}
 
 		for _, data := range workouts.Data {
-			if len(workoutData) <= instances {
-				workoutData = append(workoutData, data)
-				instanceCount++
-			} else {
-				break
+			if !query.Since.IsZero() && time.Unix(int64(data.Created), 0).Before(query.Since.Add(-createdSlack)) {
+				return workoutData, nil
+			}
+			if !query.Matches(data) {
+				continue
+			}
+			workoutData = append(workoutData, data)
+			if query.Limit > 0 && len(workoutData) >= query.Limit {
+				return workoutData, nil
 			}
 		}
 
-		if page == workouts.PageCount {
-			break
+		if len(workouts.Data) == 0 || page+1 >= workouts.PageCount {
+			return workoutData, nil
 		}
+	}
+}
+
+func (c *Client) getWorkoutsPage(page int) (Workouts, error) {
+	workouts := Workouts{}
+	resp, err := c.do(c.userURL("workouts?joins=%s&limit=%d&page=%d&sort_by=-created", workoutJoins, workoutsPageSize, page))
+	if err != nil {
+		return workouts, errors.Wrap(err, "failed to get user workouts response")
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return workouts, errors.New(fmt.Sprintf("API returned an unxpected status code: %d", resp.StatusCode))
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&workouts)
+	if err != nil {
+		return workouts, errors.Wrap(err, "failed to decode response for user workouts")
+	}
+	return workouts, nil
+}
+
+// GetWorkout returns a single workout by its ID.
+func (c *Client) GetWorkout(id string) (WorkoutData, error) {
+	workout := WorkoutData{}
+	resp, err := c.do(fmt.Sprintf("https://%s/api/workout/%s?joins=%s", c.Host, url.PathEscape(id), workoutJoins))
+	if err != nil {
+		return workout, errors.Wrap(err, "failed to get workout response")
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return workout, errors.New(fmt.Sprintf("workout %s not found", id))
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return workout, errors.New(fmt.Sprintf("API returned an unxpected status code: %d", resp.StatusCode))
+	}
 
-		page++
+	err = json.NewDecoder(resp.Body).Decode(&workout)
+	if err != nil {
+		return workout, errors.Wrap(err, "failed to decode response for workout")
 	}
-	return workoutData, nil
+	return workout, nil
 }
 
 func (c *Client) GetWorkoutDetails(detail WorkoutData, dataFrequency int) (WorkoutDetail, error) {
@@ -125,24 +336,25 @@ func (c *Client) GetWorkoutDetails(detail WorkoutData, dataFrequency int) (Worko
 		ID:                       detail.ID,
 		Title:                    detail.Peloton.Ride.Title,
 		Description:              detail.Peloton.Ride.Description,
+		RideID:                   detail.Peloton.Ride.ID,
+		Instructor:               detail.Peloton.Ride.Instructor.Name,
+		Difficulty:               detail.Peloton.Ride.Difficulty,
+		PersonalRecord:           detail.PersonalRecord,
+		DeviceType:               detail.DeviceType,
 		FitnessDiscipline:        detail.FitnessDiscipline,
 		DataGranularityInSeconds: dataFrequency,
 		StartTime:                time.Unix(int64(detail.StartTime), 0),
 		EndTime:                  time.Unix(int64(detail.EndTime), 0),
 	}
-	req, err := http.NewRequest("GET", fmt.Sprintf("https://%s/api/workout/%s/performance_graph?every_n=%d", c.Host, detail.ID, dataFrequency), nil)
-	if err != nil {
-		return workoutDetails, errors.Wrap(err, "failed to bulid workout details request")
-	}
-	req.Header.Add("Content-Type", "application/json")
-	req.AddCookie(c.authCookie)
-
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(fmt.Sprintf("https://%s/api/workout/%s/performance_graph?every_n=%d", c.Host, detail.ID, dataFrequency))
 	if err != nil {
 		return workoutDetails, errors.Wrap(err, "failed to get workout detail response")
 	}
 
 	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return workoutDetails, errors.New(fmt.Sprintf("API returned an unxpected status code: %d", resp.StatusCode))
+	}
 
 	err = json.NewDecoder(resp.Body).Decode(&workoutDetails)
 	if err != nil {
@@ -151,3 +363,35 @@ func (c *Client) GetWorkoutDetails(detail WorkoutData, dataFrequency int) (Worko
 
 	return workoutDetails, nil
 }
+
+// GetPlaylist returns the songs played during a class. Classes without music
+// return no songs.
+func (c *Client) GetPlaylist(rideID string) ([]Song, error) {
+	songs := []Song{}
+	if rideID == "" {
+		return songs, nil
+	}
+	resp, err := c.do(fmt.Sprintf("https://%s/api/ride/%s/details", c.Host, url.PathEscape(rideID)))
+	if err != nil {
+		return songs, errors.Wrap(err, "failed to get class details response")
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return songs, errors.New(fmt.Sprintf("API returned an unxpected status code: %d", resp.StatusCode))
+	}
+
+	details := rideDetails{}
+	err = json.NewDecoder(resp.Body).Decode(&details)
+	if err != nil {
+		return songs, errors.Wrap(err, "failed to decode response for class details")
+	}
+	for _, song := range details.Playlist.Songs {
+		artists := []string{}
+		for _, artist := range song.Artists {
+			artists = append(artists, artist.ArtistName)
+		}
+		songs = append(songs, Song{Title: song.Title, Artist: strings.Join(artists, ", ")})
+	}
+	return songs, nil
+}
@@ -0,0 +1,119 @@
+package peloton
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDoReauthenticatesOnce(t *testing.T) {
+	var logins int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/auth/login" {
+			n := atomic.AddInt32(&logins, 1)
+			http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Value: fmt.Sprintf("session-%d", n)})
+			fmt.Fprint(w, `{"session_id":"x","user_id":"user"}`)
+			return
+		}
+		cookie, err := r.Cookie(sessionCookieName)
+		if err != nil || cookie.Value == "expired" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, "{}")
+	}))
+	defer server.Close()
+
+	client := &Client{
+		httpClient:   *server.Client(),
+		Host:         strings.TrimPrefix(server.URL, "https://"),
+		UserID:       "user",
+		authCookie:   &http.Cookie{Name: sessionCookieName, Value: "expired"},
+		sessionCache: filepath.Join(t.TempDir(), "session.json"),
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.do(server.URL + "/api/me")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("status %d, want 200", resp.StatusCode)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if logins != 1 {
+		t.Errorf("logged in %d times, want 1", logins)
+	}
+	if !client.loadSession() || client.authCookie.Value != "session-1" {
+		t.Errorf("cached session %v, want session-1", client.authCookie)
+	}
+}
+
+func TestListWorkoutsSince(t *testing.T) {
+	since := time.Date(2024, 3, 1, 7, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) int {
+		return int(since.Add(d).Unix())
+	}
+	// Workouts are listed by creation time, newest first.
+	pages := [][]WorkoutData{
+		{
+			{ID: "after", Created: at(time.Hour), StartTime: at(time.Hour + 2*time.Minute)},
+			// Created before since but started after it.
+			{ID: "lobby", Created: at(-2 * time.Minute), StartTime: at(3 * time.Minute)},
+			{ID: "before", Created: at(-30 * time.Minute), StartTime: at(-25 * time.Minute)},
+		},
+		{
+			{ID: "old", Created: at(-48 * time.Hour), StartTime: at(-48 * time.Hour)},
+		},
+		{
+			{ID: "older", Created: at(-72 * time.Hour), StartTime: at(-72 * time.Hour)},
+		},
+	}
+	requested := []string{}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page := r.URL.Query().Get("page")
+		requested = append(requested, page)
+		n := 0
+		fmt.Sscan(page, &n)
+		json.NewEncoder(w).Encode(Workouts{PageCount: len(pages), Data: pages[n]})
+	}))
+	defer server.Close()
+
+	client := &Client{
+		httpClient: *server.Client(),
+		Host:       strings.TrimPrefix(server.URL, "https://"),
+		UserID:     "user",
+		authCookie: &http.Cookie{Name: sessionCookieName, Value: "session"},
+	}
+	workouts, err := client.ListWorkouts(WorkoutQuery{Since: since})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for _, workout := range workouts {
+		ids = append(ids, workout.ID)
+	}
+	if !reflect.DeepEqual(ids, []string{"after", "lobby"}) {
+		t.Errorf("listed %v, want [after lobby]", ids)
+	}
+	if !reflect.DeepEqual(requested, []string{"0", "1"}) {
+		t.Errorf("requested pages %v, want [0 1]", requested)
+	}
+}
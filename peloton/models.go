@@ -4,6 +4,8 @@ import (
 	"time"
 )
 
+// User is a Peloton member profile. Height is in inches and Weight in pounds,
+// whatever units the member displays.
 type User struct {
 	ID             string    `json:"id"`
 	FirstName      string    `json:"first_name"`
@@ -21,7 +23,7 @@ type User struct {
 	Height         float64   `json:"height"`
 	Weight         float64   `json:"weight"`
 	Gender         string    `json:"gender"`
-	LastWorkout    time.Time `json:"last_workout_at"`
+	LastWorkout    int       `json:"last_workout_at"`
 }
 
 type Workouts struct {
@@ -38,9 +40,16 @@ type Peloton struct {
 }
 
 type Ride struct {
-	Description string `json:"description"`
-	ID          string `json:"id"`
-	Title       string `json:"title"`
+	Description string     `json:"description"`
+	ID          string     `json:"id"`
+	Title       string     `json:"title"`
+	Instructor  Instructor `json:"instructor"`
+	Difficulty  float64    `json:"difficulty_rating_avg"`
+}
+
+type Instructor struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
 }
 
 type WorkoutData struct {
@@ -53,6 +62,7 @@ type WorkoutData struct {
 	Status            string  `json:"status"`
 	PersonalRecord    bool    `json:"is_total_work_personal_record"`
 	PedalingMetrics   bool    `json:"has_pedaling_metrics"`
+	DeviceType        string  `json:"device_type_display_name"`
 	Peloton           Peloton `json:"peloton"`
 }
 
@@ -158,14 +168,40 @@ type EffortZones struct {
 	HeartRateZoneDurations EffortZoneHeartRateDurations `json:"heart_rate_zone_durations"`
 }
 
+// Song is a track played during a class.
+type Song struct {
+	Title  string
+	Artist string
+}
+
+type playlistSong struct {
+	Title   string `json:"title"`
+	Artists []struct {
+		ArtistName string `json:"artist_name"`
+	} `json:"artists"`
+}
+
+type rideDetails struct {
+	Playlist struct {
+		Songs []playlistSong `json:"songs"`
+	} `json:"playlist"`
+}
+
 type WorkoutDetail struct {
-	Title                        string
-	Description                  string
-	ID                           string
-	FitnessDiscipline            string
-	DataGranularityInSeconds     int
-	StartTime                    time.Time
-	EndTime                      time.Time
+	Title                    string
+	Description              string
+	ID                       string
+	FitnessDiscipline        string
+	DataGranularityInSeconds int
+	StartTime                time.Time
+	EndTime                  time.Time
+	RideID                   string  `json:"-"`
+	Instructor               string  `json:"-"`
+	Difficulty               float64 `json:"-"`
+	PersonalRecord           bool    `json:"-"`
+	DeviceType               string  `json:"-"`
+	// Music is only filled in by GetPlaylist.
+	Music                        []Song                          `json:"-"`
 	Duration                     int                             `json:"duration"`
 	IsClassPlanShown             bool                            `json:"is_class_plan_shown"`
 	SegmentList                  []WorkoutDetailSegmentList      `json:"segment_list"`
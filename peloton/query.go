@@ -0,0 +1,53 @@
+package peloton
+
+import (
+	"strings"
+	"time"
+)
+
+// WorkoutQuery selects workouts. Zero values do not filter.
+type WorkoutQuery struct {
+	// Limit is the maximum number of workouts to return.
+	Limit int
+	// Since and Until bound the workout start time, Until is exclusive.
+	Since time.Time
+	Until time.Time
+	// Disciplines are Peloton fitness disciplines such as cycling or running.
+	Disciplines []string
+	// Instructors are matched against the instructor name, ignoring case.
+	Instructors []string
+	// MinDuration skips workouts shorter than this.
+	MinDuration time.Duration
+}
+
+// Matches reports whether a workout satisfies every filter in the query.
+func (q WorkoutQuery) Matches(workout WorkoutData) bool {
+	start := time.Unix(int64(workout.StartTime), 0)
+	if !q.Since.IsZero() && start.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !start.Before(q.Until) {
+		return false
+	}
+	if len(q.Disciplines) > 0 && !containsFold(q.Disciplines, workout.FitnessDiscipline) {
+		return false
+	}
+	if len(q.Instructors) > 0 && !containsFold(q.Instructors, workout.Peloton.Ride.Instructor.Name) {
+		return false
+	}
+	if q.MinDuration > 0 {
+		if workout.EndTime == 0 || time.Duration(workout.EndTime-workout.StartTime)*time.Second < q.MinDuration {
+			return false
+		}
+	}
+	return true
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(strings.TrimSpace(v), value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package peloton
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// cachedSession is the session state persisted between runs.
+type cachedSession struct {
+	Username  string    `json:"username"`
+	UserID    string    `json:"userId"`
+	SessionID string    `json:"sessionId"`
+	Expires   time.Time `json:"expires,omitempty"`
+}
+
+// DefaultSessionPath returns the session cache location inside the users config
+// directory.
+func DefaultSessionPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "peloton-to-garmin", "peloton-session.json"), nil
+}
+
+// loadSession restores a cached session for the configured user, reporting
+// whether one was found that has not expired.
+func (c *Client) loadSession() bool {
+	if c.sessionCache == "" {
+		return false
+	}
+	data, err := ioutil.ReadFile(c.sessionCache)
+	if err != nil {
+		return false
+	}
+	session := cachedSession{}
+	err = json.Unmarshal(data, &session)
+	if err != nil || session.SessionID == "" || session.UserID == "" || session.Username != c.username {
+		return false
+	}
+	if !session.Expires.IsZero() && time.Now().After(session.Expires) {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.UserID = session.UserID
+	c.authCookie = &http.Cookie{Name: sessionCookieName, Value: session.SessionID, Expires: session.Expires}
+	return true
+}
+
+// saveSession atomically persists the current session. Failing to cache the
+// session only means the next run has to log in again, so errors are ignored.
+func (c *Client) saveSession() {
+	if c.sessionCache == "" {
+		return
+	}
+	c.mu.Lock()
+	session := cachedSession{
+		Username:  c.username,
+		UserID:    c.UserID,
+		SessionID: c.authCookie.Value,
+		Expires:   c.authCookie.Expires,
+	}
+	c.mu.Unlock()
+
+	data, err := json.Marshal(session)
+	if err != nil {
+		return
+	}
+	err = os.MkdirAll(filepath.Dir(c.sessionCache), 0700)
+	if err != nil {
+		return
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(c.sessionCache), ".peloton-session-*")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err != nil || closeErr != nil {
+		return
+	}
+	_ = os.Rename(tmp.Name(), c.sessionCache)
+}
+
+// clearSession removes the cached session, forcing the next run to log in.
+func (c *Client) clearSession() error {
+	if c.sessionCache == "" {
+		return nil
+	}
+	err := os.Remove(c.sessionCache)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
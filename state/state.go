@@ -0,0 +1,193 @@
+package state
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Entry records a Peloton workout that has been synced to Garmin Connect.
+type Entry struct {
+	WorkoutID        string    `json:"workoutId"`
+	Title            string    `json:"title"`
+	WorkoutStart     time.Time `json:"workoutStart"`
+	GarminActivityID int       `json:"garminActivityId,omitempty"`
+	UploadedAt       time.Time `json:"uploadedAt"`
+	ContentHash      string    `json:"contentHash"`
+	Format           string    `json:"format"`
+	RunID            string    `json:"runId,omitempty"`
+}
+
+// Store is a JSON file mapping Peloton workout IDs to the Garmin activities
+// they were uploaded as. It is safe for concurrent use.
+type Store struct {
+	path    string
+	mu      sync.Mutex
+	entries map[string]Entry
+	// saveMu orders saves, so a slower save never replaces a newer file.
+	saveMu sync.Mutex
+}
+
+type storeFile struct {
+	Entries map[string]Entry `json:"entries"`
+}
+
+// DefaultPath returns the state file location inside the users config directory.
+func DefaultPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to find user config directory")
+	}
+	return filepath.Join(dir, "peloton-to-garmin", "state.json"), nil
+}
+
+// Open loads the store at path, a missing file results in an empty store.
+func Open(path string) (*Store, error) {
+	store := &Store{
+		path:    path,
+		entries: map[string]Entry{},
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read state file")
+	}
+
+	file := storeFile{}
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decode state file %s", path)
+	}
+	for id, entry := range file.Entries {
+		store.entries[id] = entry
+	}
+
+	return store, nil
+}
+
+// Path returns the file the store is persisted to.
+func (s *Store) Path() string {
+	return s.path
+}
+
+// Get returns the entry for a Peloton workout ID.
+func (s *Store) Get(workoutID string) (Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[workoutID]
+	return entry, ok
+}
+
+// Put adds or replaces the entry for entry.WorkoutID.
+func (s *Store) Put(entry Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[entry.WorkoutID] = entry
+}
+
+// Forget removes the entry for a Peloton workout ID, reporting whether it existed.
+func (s *Store) Forget(workoutID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.entries[workoutID]
+	delete(s.entries, workoutID)
+	return ok
+}
+
+// Prune removes all entries uploaded before the cutoff and returns them.
+func (s *Store) Prune(cutoff time.Time) []Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pruned := []Entry{}
+	for id, entry := range s.entries {
+		if entry.UploadedAt.Before(cutoff) {
+			pruned = append(pruned, entry)
+			delete(s.entries, id)
+		}
+	}
+	sortEntries(pruned)
+	return pruned
+}
+
+// List returns all entries ordered by workout start time.
+func (s *Store) List() []Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := make([]Entry, 0, len(s.entries))
+	for _, entry := range s.entries {
+		entries = append(entries, entry)
+	}
+	sortEntries(entries)
+	return entries
+}
+
+// Save atomically writes the store to disk.
+func (s *Store) Save() error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	s.mu.Lock()
+	data, err := json.MarshalIndent(storeFile{Entries: s.entries}, "", "  ")
+	s.mu.Unlock()
+	if err != nil {
+		return errors.Wrap(err, "failed to encode state file")
+	}
+
+	err = os.MkdirAll(filepath.Dir(s.path), 0700)
+	if err != nil {
+		return errors.Wrap(err, "failed to create state directory")
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), ".state-*")
+	if err != nil {
+		return errors.Wrap(err, "failed to create temporary state file")
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "failed to write state file")
+	}
+	err = tmp.Close()
+	if err != nil {
+		return errors.Wrap(err, "failed to write state file")
+	}
+
+	err = os.Rename(tmp.Name(), s.path)
+	if err != nil {
+		return errors.Wrap(err, "failed to replace state file")
+	}
+	return nil
+}
+
+// NewRunID returns the ID of a sync run started at t, recorded in the entries
+// it uploads so a run can be undone.
+func NewRunID(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// Hash returns the content hash stored for an uploaded activity file.
+func Hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func sortEntries(entries []Entry) {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].WorkoutStart.Equal(entries[j].WorkoutStart) {
+			return entries[i].WorkoutID < entries[j].WorkoutID
+		}
+		return entries[i].WorkoutStart.Before(entries[j].WorkoutStart)
+	})
+}
@@ -0,0 +1,253 @@
+package state
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2024, 3, 1, 7, 0, 0, 0, time.UTC)
+
+// entry returns an entry for a workout that started hours after start and was
+// uploaded an hour later.
+func entry(id string, hours int) Entry {
+	workoutStart := start.Add(time.Duration(hours) * time.Hour)
+	return Entry{
+		WorkoutID:        id,
+		Title:            "20 min Ride",
+		WorkoutStart:     workoutStart,
+		GarminActivityID: 1000 + hours,
+		UploadedAt:       workoutStart.Add(time.Hour),
+		ContentHash:      Hash([]byte(id)),
+		Format:           "fit",
+		RunID:            NewRunID(workoutStart.Add(time.Hour)),
+	}
+}
+
+func ids(entries []Entry) []string {
+	ids := []string{}
+	for _, e := range entries {
+		ids = append(ids, e.WorkoutID)
+	}
+	return ids
+}
+
+func TestOpenMissingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.Path() != path || len(store.List()) != 0 {
+		t.Errorf("store of a missing file has path %s and entries %v", store.Path(), store.List())
+	}
+	if _, ok := store.Get("a"); ok {
+		t.Errorf("Get found an entry in an empty store")
+	}
+}
+
+func TestOpenInvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := ioutil.WriteFile(path, []byte("{not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path); err == nil {
+		t.Errorf("opening an invalid state file succeeded, want an error")
+	}
+}
+
+func TestSaveRoundTrip(t *testing.T) {
+	// The state directory is created on the first save.
+	path := filepath.Join(t.TempDir(), "config", "peloton-to-garmin", "state.json")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Entry{entry("a", 0), entry("b", 1), entry("c", 2)}
+	// An entry recorded before Garmin gave the activity ID has none.
+	want[2].GarminActivityID = 0
+	for _, e := range want {
+		store.Put(e)
+	}
+	if err := store.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reopened.List(); !reflect.DeepEqual(got, want) {
+		t.Errorf("reopened store has\n%+v\nwant\n%+v", got, want)
+	}
+	got, ok := reopened.Get("b")
+	if !ok || !reflect.DeepEqual(got, want[1]) {
+		t.Errorf("Get(b) = %+v, %v, want %+v", got, ok, want[1])
+	}
+
+	// Putting an entry again replaces it.
+	replaced := entry("b", 1)
+	replaced.GarminActivityID = 2000
+	reopened.Put(replaced)
+	if got, _ := reopened.Get("b"); got.GarminActivityID != 2000 {
+		t.Errorf("replaced entry has activity %d, want 2000", got.GarminActivityID)
+	}
+}
+
+func TestSaveReplacesFileAtomically(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Put(entry("a", 0))
+	if err := store.Save(); err != nil {
+		t.Fatal(err)
+	}
+	store.Put(entry("b", 1))
+	if err := store.Save(); err != nil {
+		t.Fatal(err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != "state.json" {
+		t.Errorf("state directory holds %v, want only state.json", files)
+	}
+
+	// A save that cannot replace the file leaves it as it was, without a
+	// temporary file behind.
+	blocked := filepath.Join(dir, "blocked")
+	if err := os.MkdirAll(filepath.Join(blocked, "state.json", "child"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	failing := &Store{path: filepath.Join(blocked, "state.json"), entries: map[string]Entry{"a": entry("a", 0)}}
+	if err := failing.Save(); err == nil {
+		t.Errorf("saving over a directory succeeded, want an error")
+	}
+	files, err = ioutil.ReadDir(blocked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("a failed save left %d files behind", len(files)-1)
+	}
+
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(reopened.List()); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("reopened store has %v, want [a b]", got)
+	}
+}
+
+func TestForget(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Put(entry("a", 0))
+	store.Put(entry("b", 1))
+	if !store.Forget("a") {
+		t.Errorf("Forget(a) reported no entry")
+	}
+	if store.Forget("a") || store.Forget("missing") {
+		t.Errorf("Forget reported an entry that does not exist")
+	}
+	if err := store.Save(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(reopened.List()); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Errorf("reopened store has %v, want [b]", got)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	store, err := Open(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, id := range []string{"d", "a", "c", "b"} {
+		store.Put(entry(id, i*24))
+	}
+	// Entries are uploaded an hour after they start, so the cutoff at 49
+	// hours keeps the entry uploaded exactly then.
+	pruned := store.Prune(start.Add(49 * time.Hour))
+	if got := ids(pruned); !reflect.DeepEqual(got, []string{"d", "a"}) {
+		t.Errorf("pruned %v, want [d a] in start order", got)
+	}
+	if got := ids(store.List()); !reflect.DeepEqual(got, []string{"c", "b"}) {
+		t.Errorf("kept %v, want [c b]", got)
+	}
+	if pruned := store.Prune(start); len(pruned) != 0 {
+		t.Errorf("pruning before every upload removed %v", ids(pruned))
+	}
+}
+
+func TestListOrder(t *testing.T) {
+	store, err := Open(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Workouts starting together are ordered by ID.
+	for _, e := range []Entry{entry("c", 2), entry("b", 0), entry("a", 0), entry("d", 1)} {
+		store.Put(e)
+	}
+	if got := ids(store.List()); !reflect.DeepEqual(got, []string{"a", "b", "d", "c"}) {
+		t.Errorf("listed %v, want [a b d c]", got)
+	}
+}
+
+func TestConcurrentPutAndSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			store.Put(entry(fmt.Sprintf("w%d", i), i))
+			if err := store.Save(); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(reopened.List()); got != 8 {
+		t.Errorf("reopened store has %d entries, want 8", got)
+	}
+}
+
+func TestNewRunIDAndHash(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	if got := NewRunID(time.Date(2024, 3, 1, 2, 3, 4, 0, newYork)); got != "20240301T070304Z" {
+		t.Errorf("NewRunID = %s, want 20240301T070304Z", got)
+	}
+	if got := Hash([]byte("abc")); got != "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad" {
+		t.Errorf("Hash(abc) = %s", got)
+	}
+}